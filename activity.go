@@ -0,0 +1,86 @@
+package pgsnap
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// activity is what the fake server or the proxy is doing. It's reported when
+// the test timeout, so we know where it hangs.
+type activity struct {
+	mu       sync.Mutex
+	accepted bool
+
+	// pumps is the state of each goroutine, like "server" or "client pump"
+	pumps map[string]string
+
+	// last is the last message received from the client
+	last pgproto3.FrontendMessage
+}
+
+func newActivity() *activity {
+	return &activity{pumps: map[string]string{}}
+}
+
+// accept mark the connection is accepted
+func (a *activity) accept() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.accepted = true
+}
+
+// set the state of the goroutine
+func (a *activity) set(pump, format string, args ...interface{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pumps[pump] = fmt.Sprintf(format, args...)
+}
+
+// received save the last client message
+func (a *activity) received(msg pgproto3.FrontendMessage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.last = msg
+}
+
+func (a *activity) String() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.accepted {
+		return "no connection is accepted"
+	}
+
+	var names []string
+	for name := range a.pumps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var states []string
+	for _, name := range names {
+		states = append(states, name+": "+a.pumps[name])
+	}
+
+	if a.last == nil {
+		states = append(states, "no message is received from the client")
+	} else {
+		states = append(states, "last client message: "+describeMessage(a.last))
+	}
+
+	return strings.Join(states, "; ")
+}
+
+// describeMessage returns the type and the abbreviated json of the message
+func describeMessage(msg pgproto3.Message) string {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Sprintf("%T", msg)
+	}
+	return fmt.Sprintf("%T %s", msg, abbreviate(b))
+}
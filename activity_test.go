@@ -0,0 +1,32 @@
+package pgsnap
+
+import (
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_activity(t *testing.T) {
+	a := newActivity()
+	assert.Equal(t, "no connection is accepted", a.String())
+
+	a.accept()
+	a.set("database pump", "receiving from the database")
+	a.set("client pump", "sending %T to the database", &pgproto3.Sync{})
+	assert.Equal(t,
+		"client pump: sending *pgproto3.Sync to the database; "+
+			"database pump: receiving from the database; "+
+			"no message is received from the client",
+		a.String(),
+	)
+
+	a.received(&pgproto3.Sync{})
+	a.set("client pump", "exited")
+	assert.Equal(t,
+		"client pump: exited; "+
+			"database pump: receiving from the database; "+
+			`last client message: *pgproto3.Sync {"Type":"Sync"}`,
+		a.String(),
+	)
+}
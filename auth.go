@@ -0,0 +1,360 @@
+package pgsnap
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// AuthMethod is how the client is authenticated by pgsnap
+type AuthMethod string
+
+const (
+	// AuthTrust accept every client without password, it's the default
+	AuthTrust AuthMethod = ""
+
+	// AuthCleartext ask the password in clear text
+	AuthCleartext AuthMethod = "password"
+
+	// AuthMD5 ask the md5 hash of the password, with random salt
+	AuthMD5 AuthMethod = "md5"
+
+	// AuthSCRAMSHA256 authenticate with SCRAM-SHA-256, like the default of
+	// postgres 14
+	AuthSCRAMSHA256 AuthMethod = "scram-sha-256"
+)
+
+// scramIterations is the iteration count sent to the client, same as postgres
+const scramIterations = 4096
+
+// errAuthFailed is returned when the client send wrong user or password
+var errAuthFailed = errors.New("password authentication failed")
+
+// Auth is the user and password that required by the fake server and the
+// proxy, both when recording and replaying. The upstream database still uses
+// the credential in the postgres url
+type Auth struct {
+	Method   AuthMethod
+	User     string
+	Password string
+}
+
+// authAttempt is the result of one authentication, it's saved in the
+// snapshot as "A <json>" line. The salt, the nonce and the password are not
+// saved
+type authAttempt struct {
+	Method AuthMethod
+	User   string
+	OK     bool
+}
+
+func (a authAttempt) String() string {
+	result := "succeeded"
+	if !a.OK {
+		result = "failed"
+	}
+	return fmt.Sprintf("%s authentication of user %q %s", a.Method, a.User, result)
+}
+
+// authenticate receives the startup message and authenticates the client.
+// On success AuthenticationOk is sent, and the rest of the startup is up to
+// the caller. On failure the client get FATAL 28P01 error, like postgres.
+// The user is returned when the startup message is received
+func (a Auth) authenticate(be *pgproto3.Backend) (string, error) {
+	msg, err := be.ReceiveStartupMessage()
+	if err != nil {
+		return "", err
+	}
+
+	startup, ok := msg.(*pgproto3.StartupMessage)
+	if !ok {
+		return "", fmt.Errorf("expect *pgproto3.StartupMessage, got %T", msg)
+	}
+	user := startup.Parameters["user"]
+
+	switch a.Method {
+	case AuthTrust:
+		err = nil
+	case AuthCleartext:
+		err = a.cleartext(be, user)
+	case AuthMD5:
+		err = a.md5(be, user)
+	case AuthSCRAMSHA256:
+		err = a.scram(be, user)
+	default:
+		err = fmt.Errorf("unknown auth method %q", a.Method)
+	}
+
+	if errors.Is(err, errAuthFailed) {
+		_ = be.Send(&pgproto3.ErrorResponse{
+			Severity:            "FATAL",
+			SeverityUnlocalized: "FATAL",
+			Code:                "28P01",
+			Message:             fmt.Sprintf("password authentication failed for user \"%s\"", user),
+		})
+		return user, fmt.Errorf("%w for user \"%s\"", errAuthFailed, user)
+	}
+	if err != nil {
+		return user, err
+	}
+
+	return user, be.Send(&pgproto3.AuthenticationOk{})
+}
+
+func (a Auth) cleartext(be *pgproto3.Backend, user string) error {
+	if err := be.Send(&pgproto3.AuthenticationCleartextPassword{}); err != nil {
+		return err
+	}
+
+	password, err := receivePassword(be)
+	if err != nil {
+		return err
+	}
+
+	return a.check(user, password == a.Password)
+}
+
+func (a Auth) md5(be *pgproto3.Backend, user string) error {
+	var salt [4]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return err
+	}
+
+	if err := be.Send(&pgproto3.AuthenticationMD5Password{Salt: salt}); err != nil {
+		return err
+	}
+
+	password, err := receivePassword(be)
+	if err != nil {
+		return err
+	}
+
+	return a.check(user, password == md5Password(a.User, a.Password, salt))
+}
+
+// md5Password returns the password sent by the client in md5 method
+func md5Password(user, password string, salt [4]byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt[:]...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+func (a Auth) scram(be *pgproto3.Backend, user string) error {
+	err := be.Send(&pgproto3.AuthenticationSASL{AuthMechanisms: []string{"SCRAM-SHA-256"}})
+	if err != nil {
+		return err
+	}
+
+	_ = be.SetAuthType(pgproto3.AuthTypeSASL)
+	msg, err := be.Receive()
+	if err != nil {
+		return err
+	}
+	initial, ok := msg.(*pgproto3.SASLInitialResponse)
+	if !ok {
+		return fmt.Errorf("expect *pgproto3.SASLInitialResponse, got %T", msg)
+	}
+	if initial.AuthMechanism != "SCRAM-SHA-256" {
+		return fmt.Errorf("unsupported SASL mechanism %q", initial.AuthMechanism)
+	}
+
+	gs2Header, clientFirstBare, err := splitClientFirst(string(initial.Data))
+	if err != nil {
+		return err
+	}
+	clientNonce := scramAttribute(clientFirstBare, 'r')
+	if clientNonce == "" {
+		return errors.New("SCRAM client-first-message has no nonce")
+	}
+
+	salt, err := randomBytes(16)
+	if err != nil {
+		return err
+	}
+	serverNonce, err := randomBytes(18)
+	if err != nil {
+		return err
+	}
+
+	nonce := clientNonce + base64.StdEncoding.EncodeToString(serverNonce)
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(salt), scramIterations)
+	if err := be.Send(&pgproto3.AuthenticationSASLContinue{Data: []byte(serverFirst)}); err != nil {
+		return err
+	}
+
+	_ = be.SetAuthType(pgproto3.AuthTypeSASLContinue)
+	msg, err = be.Receive()
+	if err != nil {
+		return err
+	}
+	response, ok := msg.(*pgproto3.SASLResponse)
+	if !ok {
+		return fmt.Errorf("expect *pgproto3.SASLResponse, got %T", msg)
+	}
+
+	clientFinal := string(response.Data)
+	i := strings.LastIndex(clientFinal, ",p=")
+	if i < 0 {
+		return errors.New("SCRAM client-final-message has no proof")
+	}
+	clientFinalWithoutProof := clientFinal[:i]
+
+	if scramAttribute(clientFinalWithoutProof, 'c') != base64.StdEncoding.EncodeToString([]byte(gs2Header)) ||
+		scramAttribute(clientFinalWithoutProof, 'r') != nonce {
+		return errors.New("SCRAM client-final-message doesn't match the previous messages")
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[i+len(",p="):])
+	if err != nil {
+		return fmt.Errorf("SCRAM client proof: %w", err)
+	}
+
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	saltedPassword := pbkdf2SHA256([]byte(a.Password), salt, scramIterations)
+
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := hmacSHA256(storedKey[:], []byte(authMessage))
+
+	// the client key is recovered from the proof, and it's valid when the
+	// hash is the stored key
+	valid := len(proof) == len(clientSignature)
+	if valid {
+		recovered := make([]byte, len(proof))
+		for j := range proof {
+			recovered[j] = proof[j] ^ clientSignature[j]
+		}
+		recoveredKey := sha256.Sum256(recovered)
+		valid = hmac.Equal(recoveredKey[:], storedKey[:])
+	}
+	if err := a.check(user, valid); err != nil {
+		return err
+	}
+
+	serverKey := hmacSHA256(saltedPassword, []byte("Server Key"))
+	serverSignature := hmacSHA256(serverKey, []byte(authMessage))
+	return be.Send(&pgproto3.AuthenticationSASLFinal{
+		Data: []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)),
+	})
+}
+
+// check returns errAuthFailed when the user or the password is wrong
+func (a Auth) check(user string, validPassword bool) error {
+	if user != a.User || !validPassword {
+		return errAuthFailed
+	}
+	return nil
+}
+
+func receivePassword(be *pgproto3.Backend) (string, error) {
+	msg, err := be.Receive()
+	if err != nil {
+		return "", err
+	}
+
+	password, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return "", fmt.Errorf("expect *pgproto3.PasswordMessage, got %T", msg)
+	}
+	return password.Password, nil
+}
+
+// splitClientFirst split the SCRAM client-first-message into the gs2 header
+// and the bare message. Channel binding is not supported
+func splitClientFirst(msg string) (gs2Header, bare string, err error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("invalid SCRAM client-first-message %q", msg)
+	}
+	if parts[0] != "n" && parts[0] != "y" {
+		return "", "", errors.New("SCRAM channel binding is not supported")
+	}
+	return parts[0] + "," + parts[1] + ",", parts[2], nil
+}
+
+// scramAttribute returns the value of the attribute in SCRAM message
+func scramAttribute(msg string, name byte) string {
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) >= 2 && attr[0] == name && attr[1] == '=' {
+			return attr[2:]
+		}
+	}
+	return ""
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 is PBKDF2 with HMAC-SHA256, for one block of key (32 bytes)
+// that used by SCRAM-SHA-256
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// acceptClient accepts the client connection and authenticates it until
+// AuthenticationOk is sent. The client that failed the authentication is
+// closed and the next one is accepted, so the test can retry with the right
+// password. own is called for every accepted connection, the returned
+// connection is nil when it returns false. attempt is called for every
+// finished authentication, except in AuthTrust
+func acceptClient(
+	l net.Listener,
+	auth Auth,
+	own func(net.Conn) bool,
+	attempt func(authAttempt),
+	logf func(string, ...interface{}),
+) (net.Conn, *pgproto3.Backend, error) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !own(conn) {
+			return nil, nil, nil
+		}
+
+		be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+		user, err := auth.authenticate(be)
+		if auth.Method != AuthTrust && (err == nil || errors.Is(err, errAuthFailed)) {
+			attempt(authAttempt{Method: auth.Method, User: user, OK: err == nil})
+		}
+		if err == nil {
+			return conn, be, nil
+		}
+
+		logf("server: client is not authenticated: %v", err)
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,189 @@
+package pgsnap
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnap_auth(t *testing.T) {
+	for _, method := range []AuthMethod{AuthCleartext, AuthMD5, AuthSCRAMSHA256} {
+		t.Run(string(method), func(t *testing.T) {
+			cfg := ConfigFromEnv()
+			cfg.Auth = Auth{Method: method, User: "app", Password: "secret"}
+
+			tb := authSnapshot(t, "TestSnap_runScript_pgx",
+				authAttempt{Method: method, User: "app", OK: false},
+				authAttempt{Method: method, User: "app", OK: true},
+			)
+			s := NewSnapWithConfig(tb, addr, cfg)
+
+			// the client with wrong password is rejected, and then it
+			// can retry with the right one
+			_, err := pgconn.Connect(context.Background(), strings.Replace(s.Addr(), "secret", "wrong", 1))
+			var pgErr *pgconn.PgError
+			require.True(t, errors.As(err, &pgErr), "got %v", err)
+			assert.Equal(t, "28P01", pgErr.Code)
+			assert.Equal(t, `password authentication failed for user "app"`, pgErr.Message)
+
+			runPGX(t, s.Addr())
+			assert.NoError(t, s.Finish())
+		})
+	}
+}
+
+func TestSnap_auth_wrongUser(t *testing.T) {
+	cfg := ConfigFromEnv()
+	cfg.Auth = Auth{Method: AuthMD5, User: "app", Password: "secret"}
+
+	tb := authSnapshot(t, "TestSnap_runScript_pq",
+		authAttempt{Method: AuthMD5, User: "other", OK: false},
+		authAttempt{Method: AuthMD5, User: "app", OK: true},
+	)
+	db, s := NewDBWithConfig(tb, addr, cfg)
+	defer db.Close()
+
+	other, err := sql.Open("postgres", strings.Replace(s.Addr(), "app:", "other:", 1))
+	require.NoError(t, err)
+	err = other.Ping()
+	require.IsType(t, &pq.Error{}, err)
+	assert.Equal(t, pq.ErrorCode("28P01"), err.(*pq.Error).Code)
+	_ = other.Close()
+
+	runPQ(t, db)
+	require.NoError(t, db.Close())
+	assert.NoError(t, s.Finish())
+}
+
+// the authentication is compared with the snapshot, like the messages
+func TestSnap_auth_replayMismatch(t *testing.T) {
+	md5OK := authAttempt{Method: AuthMD5, User: "app", OK: true}
+
+	tests := []struct {
+		name     string
+		recorded []authAttempt
+		auth     Auth
+		wantErr  string
+	}{
+		{
+			name:     "different method",
+			recorded: []authAttempt{md5OK},
+			auth:     Auth{Method: AuthSCRAMSHA256, User: "app", Password: "secret"},
+			wantErr: `server: scram-sha-256 authentication of user "app" succeeded, ` +
+				`but the snapshot has md5 authentication of user "app" succeeded`,
+		},
+		{
+			name:     "not authenticated",
+			recorded: []authAttempt{md5OK},
+			wantErr:  `server: md5 authentication of user "app" succeeded in the snapshot, but the client is accepted before it`,
+		},
+		{
+			name:    "not recorded",
+			auth:    Auth{Method: AuthMD5, User: "app", Password: "secret"},
+			wantErr: `server: md5 authentication of user "app" succeeded, but it's not in the snapshot`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := newFakeTB(authSnapshot(t, "TestSnap_runScript_pgx", tt.recorded...))
+			s := NewSnapWithConfig(tb, addr, Config{Auth: tt.auth})
+
+			runPGX(t, s.Addr())
+
+			err := s.Finish()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+// authSnapshot returns the test that replays the snapshot of the other test,
+// with the authentications in the head of it
+func authSnapshot(t *testing.T, snapshot string, attempts ...authAttempt) *namedTB {
+	src, err := os.ReadFile(newScript(&namedTB{TB: t, name: snapshot}).getFilename())
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	for _, a := range attempts {
+		line, err := json.Marshal(a)
+		require.NoError(t, err)
+		fmt.Fprintf(&b, "A %s\n", line)
+	}
+	b.Write(src)
+
+	tb := &namedTB{TB: t, name: t.Name() + "_auth"}
+	filename := newScript(tb).getFilename()
+	require.NoError(t, os.WriteFile(filename, b.Bytes(), 0644))
+	t.Cleanup(func() { _ = os.Remove(filename) })
+
+	return tb
+}
+
+func TestSnap_auth_proxy(t *testing.T) {
+	// the fake server is used as the database, the proxy ping it before the
+	// client send the query
+	upstream := NewSnapWithConfig(&namedTB{TB: t, name: "TestSnap_runScript_pq"}, addr, Config{})
+
+	tb := &namedTB{TB: t, name: "TestSnap_auth_proxy"}
+	cfg := Config{Auth: Auth{Method: AuthSCRAMSHA256, User: "app", Password: "secret"}}
+
+	run := func(s *Snap) {
+		_, err := pgconn.Connect(context.Background(), strings.Replace(s.Addr(), "secret", "wrong", 1))
+		var pgErr *pgconn.PgError
+		require.True(t, errors.As(err, &pgErr), "got %v", err)
+		assert.Equal(t, "28P01", pgErr.Code)
+
+		db, err := sql.Open("postgres", s.Addr())
+		require.NoError(t, err)
+		rows, err := db.Query("select id from mytable limit $1", 7)
+		require.NoError(t, err)
+		require.NoError(t, rows.Close())
+		require.NoError(t, db.Close())
+
+		assert.NoError(t, s.Finish())
+	}
+
+	record := cfg
+	record.ForceWrite = true
+	s := NewSnapWithConfig(tb, upstream.Addr(), record)
+	t.Cleanup(func() { _ = os.Remove(s.script.getFilename()) })
+
+	run(s)
+	assert.NoError(t, upstream.Finish())
+
+	// the method and the result are recorded, without the salt and the nonce
+	recorded, err := os.ReadFile(s.script.getFilename())
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(recorded),
+		`A {"Method":"scram-sha-256","User":"app","OK":false}`+"\n"+
+			`A {"Method":"scram-sha-256","User":"app","OK":true}`+"\n"), string(recorded))
+
+	// and replayed
+	run(NewSnapWithConfig(tb, addr, cfg))
+}
+
+func Test_pbkdf2SHA256(t *testing.T) {
+	// RFC 7914, section 11
+	got := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1)
+	assert.Equal(t, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc", hex.EncodeToString(got))
+}
+
+func Test_md5Password(t *testing.T) {
+	// "md5" + md5(md5(password + user) + salt), like lib/pq and pgconn
+	// compute it
+	assert.Equal(t, "md5911f527656472583a006e7727877b33e", md5Password("app", "secret", [4]byte{1, 2, 3, 4}))
+	assert.NotEqual(t, md5Password("app", "secret", [4]byte{1, 2, 3, 4}), md5Password("app", "secret", [4]byte{4, 3, 2, 1}))
+}
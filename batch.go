@@ -0,0 +1,137 @@
+package pgsnap
+
+import (
+	"io"
+
+	"github.com/jackc/pgmock"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// endsBatch returns true when the client waits for the response after msg.
+// The extended protocol messages are sent in batch until Sync or Flush, like
+// pgx SendBatch, and the database doesn't have to answer them before that
+func endsBatch(msg pgproto3.Message) bool {
+	switch msg.(type) {
+	case *pgproto3.Sync, *pgproto3.Flush, *pgproto3.Query, *pgproto3.CopyDone, *pgproto3.CopyFail, *pgproto3.Terminate:
+		return true
+	}
+	return false
+}
+
+// answeredByReadyForQuery returns true when the database answers msg with
+// ReadyForQuery, so the batches can be counted
+func answeredByReadyForQuery(msg pgproto3.Message) bool {
+	switch msg.(type) {
+	case *pgproto3.Sync, *pgproto3.Query:
+		return true
+	}
+	return false
+}
+
+// orderBatches moves the server messages that recorded in the middle of the
+// client batch to the end of the batch. The database might flush the
+// response of the first messages before the rest of the batch is received,
+// so the order in the snapshot depends on the buffering. The client doesn't
+// wait for them until the end of the batch, so the replay receives the whole
+// batch first, and then sends the responses in the recorded order
+func orderBatches(steps []pgmock.Step) []pgmock.Step {
+	ordered := make([]pgmock.Step, 0, len(steps))
+	var deferred []pgmock.Step
+	inBatch := false
+
+	for _, step := range steps {
+		r, ok := step.(*recordedStep)
+		if !ok {
+			ordered = append(ordered, step)
+			continue
+		}
+
+		if !r.client {
+			if inBatch {
+				deferred = append(deferred, step)
+			} else {
+				ordered = append(ordered, step)
+			}
+			continue
+		}
+
+		ordered = append(ordered, step)
+		inBatch = !endsBatch(r.msg)
+		if !inBatch {
+			ordered = append(ordered, deferred...)
+			deferred = nil
+		}
+	}
+
+	// the client didn't finish the last batch
+	return append(ordered, deferred...)
+}
+
+// readyForQuery returns the index of the nth recorded ReadyForQuery, or
+// len(steps) when it's not found. n starts from 1
+func readyForQuery(steps []pgmock.Step, n int) int {
+	for i, step := range steps {
+		r, ok := step.(*recordedStep)
+		if !ok || r.client {
+			continue
+		}
+		if _, ok := r.msg.(*pgproto3.ReadyForQuery); !ok {
+			continue
+		}
+		if n--; n == 0 {
+			return i
+		}
+	}
+	return len(steps)
+}
+
+// batchesBefore returns how many batches answered by ReadyForQuery that the
+// client sent before the step i
+func batchesBefore(steps []pgmock.Step, i int) int {
+	n := 0
+	for _, step := range steps[:i] {
+		if r, ok := step.(*recordedStep); ok && r.client && answeredByReadyForQuery(r.msg) {
+			n++
+		}
+	}
+	return n
+}
+
+// pendingResponses returns the responses in steps[i:] of the batches that the
+// client sent before the step i. They are sent before the error of the
+// mismatch, because the pipelining client is still waiting for them
+func pendingResponses(steps []pgmock.Step, i int) []*recordedStep {
+	n := batchesBefore(steps, i)
+	if n == 0 {
+		return nil
+	}
+
+	var pending []*recordedStep
+	end := readyForQuery(steps, n)
+	for j := i; j <= end && j < len(steps); j++ {
+		if r, ok := steps[j].(*recordedStep); ok && !r.client {
+			pending = append(pending, r)
+		}
+	}
+	return pending
+}
+
+// responseBuffer collects the server messages of the batch, so they are
+// written to the client in one write
+type responseBuffer struct {
+	conn io.Writer
+	buf  []byte
+}
+
+func (b *responseBuffer) add(msg pgproto3.BackendMessage) {
+	b.buf = msg.Encode(b.buf)
+}
+
+func (b *responseBuffer) flush() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	_, err := b.conn.Write(b.buf)
+	b.buf = b.buf[:0]
+	return err
+}
@@ -0,0 +1,160 @@
+package pgsnap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgmock"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the snapshot has the response of the first query in the middle of the
+// batch, like when the database flush it before the rest is received
+func TestSnap_batch_pgx(t *testing.T) {
+	s := NewSnapWithConfig(t, addr, ConfigFromEnv())
+	ctx := context.Background()
+
+	conn, err := pgx.Connect(ctx, s.Addr())
+	require.NoError(t, err)
+
+	b := &pgx.Batch{}
+	b.Queue("select id from mytable where id = $1", 1)
+	b.Queue("select id from mytable where id = $1", 2)
+
+	br := conn.SendBatch(ctx, b)
+	for _, want := range []int32{1, 2} {
+		var id int32
+		require.NoError(t, br.QueryRow().Scan(&id))
+		assert.Equal(t, want, id)
+	}
+	require.NoError(t, br.Close())
+	require.NoError(t, conn.Close(ctx))
+
+	assert.NoError(t, s.Finish())
+}
+
+// the client send the second query before the first one is answered, and
+// it's not in the snapshot. The first query is still answered, and the
+// replay continue after the second one
+func TestSnap_batch_pipeline(t *testing.T) {
+	tb := newFakeTB(t)
+	s := NewSnapWithConfig(tb, addr, Config{})
+
+	conn, err := net.Dial("tcp", s.l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
+	require.NoError(t, fe.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "user"},
+	}))
+	receiveTypes(t, fe, 3)
+
+	pipeline := (&pgproto3.Query{String: "select 1"}).Encode(nil)
+	pipeline = (&pgproto3.Query{String: "select 4"}).Encode(pipeline)
+	_, err = conn.Write(pipeline)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"*pgproto3.CommandComplete",
+		"*pgproto3.ReadyForQuery",
+		"*pgproto3.ErrorResponse",
+		"*pgproto3.ReadyForQuery",
+	}, receiveTypes(t, fe, 4))
+
+	require.NoError(t, fe.Send(&pgproto3.Query{String: "select 3"}))
+	assert.Equal(t, []string{
+		"*pgproto3.CommandComplete",
+		"*pgproto3.ReadyForQuery",
+	}, receiveTypes(t, fe, 2))
+
+	require.NoError(t, fe.Send(&pgproto3.Terminate{}))
+	s.Finish()
+
+	require.Len(t, tb.ErrorMessages, 1)
+	assert.Contains(t, tb.ErrorMessages[0], `String:"select 4"`)
+}
+
+// receiveTypes returns the type of the next n messages from the server
+func receiveTypes(t *testing.T, fe *pgproto3.Frontend, n int) []string {
+	t.Helper()
+
+	var types []string
+	for i := 0; i < n; i++ {
+		msg, err := fe.Receive()
+		require.NoError(t, err)
+		types = append(types, fmt.Sprintf("%T", msg))
+	}
+	return types
+}
+
+func Test_orderBatches(t *testing.T) {
+	parse := &recordedStep{msg: &pgproto3.Parse{}, client: true}
+	bind := &recordedStep{msg: &pgproto3.Bind{}, client: true}
+	flush := &recordedStep{msg: &pgproto3.Flush{}, client: true}
+	sync := &recordedStep{msg: &pgproto3.Sync{}, client: true}
+	parseComplete := &recordedStep{msg: &pgproto3.ParseComplete{}}
+	bindComplete := &recordedStep{msg: &pgproto3.BindComplete{}}
+	ready := &recordedStep{msg: &pgproto3.ReadyForQuery{TxStatus: 'I'}}
+	startup := pgmock.SendMessage(&pgproto3.AuthenticationOk{})
+
+	tests := []struct {
+		name  string
+		steps []pgmock.Step
+		want  []pgmock.Step
+	}{
+		{
+			"in order",
+			[]pgmock.Step{startup, parse, sync, parseComplete, ready},
+			[]pgmock.Step{startup, parse, sync, parseComplete, ready},
+		},
+		{
+			"response in the middle of the batch",
+			[]pgmock.Step{parse, parseComplete, bind, sync, bindComplete, ready},
+			[]pgmock.Step{parse, bind, sync, parseComplete, bindComplete, ready},
+		},
+		{
+			"flush",
+			[]pgmock.Step{parse, flush, parseComplete, bind, sync, bindComplete, ready},
+			[]pgmock.Step{parse, flush, parseComplete, bind, sync, bindComplete, ready},
+		},
+		{
+			"unfinished batch",
+			[]pgmock.Step{parse, parseComplete, bind},
+			[]pgmock.Step{parse, bind, parseComplete},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, orderBatches(tt.steps))
+		})
+	}
+}
+
+func Test_endOfBatch(t *testing.T) {
+	steps := []pgmock.Step{
+		&recordedStep{msg: &pgproto3.Query{String: "begin"}, client: true},
+		&recordedStep{msg: &pgproto3.Query{String: "select 1"}, client: true},
+		&recordedStep{msg: &pgproto3.CommandComplete{CommandTag: []byte("BEGIN")}},
+		&recordedStep{msg: &pgproto3.ReadyForQuery{TxStatus: 'T'}},
+		&recordedStep{msg: &pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")}},
+		&recordedStep{msg: &pgproto3.ReadyForQuery{TxStatus: 'T'}},
+	}
+
+	end, txStatus := endOfBatch(steps, 1)
+	assert.Equal(t, 5, end)
+	assert.Equal(t, byte('T'), txStatus)
+
+	assert.Equal(t, []*recordedStep{steps[2].(*recordedStep), steps[3].(*recordedStep)}, pendingResponses(steps, 1))
+	assert.Empty(t, pendingResponses(steps, 0))
+
+	end, txStatus = endOfBatch(steps, len(steps))
+	assert.Equal(t, len(steps), end)
+	assert.Equal(t, byte('I'), txStatus)
+}
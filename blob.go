@@ -0,0 +1,170 @@
+package pgsnap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// blobKey is the key of the object that replaces the large string in the
+// snapshot line, like {"$blob":"<sha256>"}
+const blobKey = "$blob"
+
+// blobStore saves the large string values of the snapshot lines in the
+// side directory, named by the sha256 of the content. So the snapshot file
+// stay readable and the same value is only saved once.
+type blobStore struct {
+	dir string
+
+	// threshold is the minimum length of the string that saved as blob,
+	// zero means disabled
+	threshold int
+}
+
+// externalize replaces the string values of the JSON line that longer than
+// threshold with the blob reference
+func (b *blobStore) externalize(line []byte) ([]byte, error) {
+	if b == nil || b.threshold <= 0 || len(line) <= b.threshold {
+		return line, nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(line, &v); err != nil {
+		return nil, err
+	}
+
+	var large []string
+	walkStrings(v, func(s string) {
+		if len(s) >= b.threshold {
+			large = append(large, s)
+		}
+	})
+
+	for _, s := range large {
+		// the line is marshalled by encoding/json too, so the string
+		// literal is the same
+		literal, err := json.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+
+		hash, err := b.save(s)
+		if err != nil {
+			return nil, err
+		}
+
+		line = bytes.ReplaceAll(line, literal, []byte(`{"`+blobKey+`":"`+hash+`"}`))
+	}
+
+	return line, nil
+}
+
+// resolve replaces the blob references of the JSON line with the content
+func (b *blobStore) resolve(line []byte) ([]byte, error) {
+	if !bytes.Contains(line, []byte(`"`+blobKey+`"`)) {
+		return line, nil
+	}
+
+	d := json.NewDecoder(bytes.NewReader(line))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	v, err := b.replaceRefs(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+func (b *blobStore) replaceRefs(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if hash, ok := t[blobKey].(string); ok && len(t) == 1 {
+			return b.load(hash)
+		}
+		for k, e := range t {
+			r, err := b.replaceRefs(e)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = r
+		}
+	case []interface{}:
+		for i, e := range t {
+			r, err := b.replaceRefs(e)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = r
+		}
+	}
+	return v, nil
+}
+
+func (b *blobStore) save(s string) (string, error) {
+	sum := sha256.Sum256([]byte(s))
+	hash := hex.EncodeToString(sum[:])
+
+	path := filepath.Join(b.dir, hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+
+	if err := os.MkdirAll(b.dir, 0o755); err != nil {
+		return "", fmt.Errorf("cannot create blob directory %s: %w", b.dir, err)
+	}
+
+	if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+		return "", fmt.Errorf("cannot write blob %s: %w", path, err)
+	}
+
+	return hash, nil
+}
+
+func (b *blobStore) load(hash string) (string, error) {
+	path := filepath.Join(b.dir, filepath.Base(hash))
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read blob: %w", err)
+	}
+
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) != hash {
+		return "", fmt.Errorf("blob %s is modified, the content does not match the hash", path)
+	}
+
+	return string(content), nil
+}
+
+// clear removes the blobs of the previous recording
+func (b *blobStore) clear() error {
+	if b == nil || b.threshold <= 0 {
+		return nil
+	}
+	return os.RemoveAll(b.dir)
+}
+
+func walkStrings(v interface{}, f func(string)) {
+	switch t := v.(type) {
+	case string:
+		f(t)
+	case map[string]interface{}:
+		for _, e := range t {
+			walkStrings(e, f)
+		}
+	case []interface{}:
+		for _, e := range t {
+			walkStrings(e, f)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package pgsnap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_blobStore(t *testing.T) {
+	b := &blobStore{dir: filepath.Join(t.TempDir(), "pgsnap_test.blobs"), threshold: 100}
+
+	large := strings.Repeat(`{"key":"value"},`, 100)
+	msg := &pgproto3.DataRow{Values: [][]byte{[]byte("1"), []byte(large), []byte(large)}}
+
+	line, err := json.Marshal(msg)
+	require.NoError(t, err)
+
+	externalized, err := b.externalize(line)
+	require.NoError(t, err)
+
+	sum := sha256.Sum256([]byte(large))
+	hash := hex.EncodeToString(sum[:])
+	assert.Equal(t, `{"Type":"DataRow","Values":[{"text":"1"},{"text":{"$blob":"`+hash+`"}},{"text":{"$blob":"`+hash+`"}}]}`, string(externalized))
+
+	content, err := os.ReadFile(filepath.Join(b.dir, hash))
+	require.NoError(t, err)
+	assert.Equal(t, large, string(content))
+
+	resolved, err := b.resolve(externalized)
+	require.NoError(t, err)
+
+	got, err := (&script{}).unmarshalB(resolved)
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+
+	t.Run("small line is kept", func(t *testing.T) {
+		line := []byte(`{"Type":"DataRow","Values":[{"text":"1"}]}`)
+		got, err := b.externalize(line)
+		require.NoError(t, err)
+		assert.Equal(t, line, got)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		got, err := (&blobStore{dir: b.dir}).externalize(line)
+		require.NoError(t, err)
+		assert.Equal(t, line, got)
+	})
+
+	t.Run("modified blob", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(b.dir, hash), []byte("modified"), 0o644))
+
+		_, err := b.resolve(externalized)
+		assert.EqualError(t, err, "blob "+filepath.Join(b.dir, hash)+" is modified, the content does not match the hash")
+	})
+
+	t.Run("missing blob", func(t *testing.T) {
+		require.NoError(t, b.clear())
+
+		_, err := b.resolve(externalized)
+		assert.Error(t, err)
+	})
+}
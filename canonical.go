@@ -0,0 +1,172 @@
+package pgsnap
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const (
+	// canonicalStmtPrefix is the prefix of statement name in snapshot, the
+	// statement is numbered in the order it's parsed
+	canonicalStmtPrefix = "stmt_"
+
+	// firstNormalOID is the first OID that assigned to user object, the OID
+	// below it is the same in every postgres with the same version
+	firstNormalOID = 16384
+)
+
+type (
+	// canonicalizer replaces the fields that differ between databases and
+	// runs before the message is written into snapshot, so re-recording
+	// without behaviour change produce the same snapshot:
+	//
+	//   - statement names (like lrupsc_5_0 in pgx v4) become stmt_1, stmt_2...
+	//   - table OIDs of user table become firstNormalOID, firstNormalOID+1...
+	//     in the order they are seen
+	//   - the server source location in error and notice is dropped
+	//   - backend key data is zeroed
+	//
+	// When replaying, the client names are bound to the recorded names by
+	// nameMapping. Only the snapshot is canonicalized, the messages sent to
+	// client and database are kept as is.
+	canonicalizer struct {
+		mu sync.Mutex
+
+		statements map[string]string
+		tableOIDs  map[uint32]uint32
+
+		// taken is the canonical table OIDs that are given, or used by
+		// the replayed snapshot in hybrid mode
+		taken map[uint32]bool
+
+		// lastStatement is the number of the last canonical statement name
+		lastStatement int
+	}
+)
+
+func newCanonicalizer() *canonicalizer {
+	return &canonicalizer{
+		statements: map[string]string{},
+		tableOIDs:  map[uint32]uint32{},
+		taken:      map[uint32]bool{},
+	}
+}
+
+// canonicalize returns the message that should be written into snapshot.
+// The message is copied when it's changed.
+func (c *canonicalizer) canonicalize(msg pgproto3.Message) pgproto3.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch m := msg.(type) {
+	case *pgproto3.Parse:
+		n := *m
+		n.Name = c.statement(m.Name)
+		return &n
+	case *pgproto3.Describe:
+		if m.ObjectType != 'S' {
+			return msg
+		}
+		n := *m
+		n.Name = c.statement(m.Name)
+		return &n
+	case *pgproto3.Close:
+		if m.ObjectType != 'S' {
+			return msg
+		}
+		n := *m
+		n.Name = c.statement(m.Name)
+		return &n
+	case *pgproto3.Bind:
+		n := *m
+		n.PreparedStatement = c.statement(m.PreparedStatement)
+		return &n
+	case *pgproto3.RowDescription:
+		n := &pgproto3.RowDescription{Fields: make([]pgproto3.FieldDescription, len(m.Fields))}
+		for i, f := range m.Fields {
+			f.TableOID = c.tableOID(f.TableOID)
+			n.Fields[i] = f
+		}
+		return n
+	case *pgproto3.ErrorResponse:
+		n := *m
+		n.File, n.Line, n.Routine = "", 0, ""
+		return &n
+	case *pgproto3.NoticeResponse:
+		n := *m
+		n.File, n.Line, n.Routine = "", 0, ""
+		return &n
+	case *pgproto3.BackendKeyData:
+		return &pgproto3.BackendKeyData{}
+	}
+
+	return msg
+}
+
+// replayed returns the message of the replayed snapshot, that is written
+// again in hybrid mode. Its table OIDs are canonical already, so they are
+// kept, and not given to the tables seen after it
+func (c *canonicalizer) replayed(msg pgproto3.Message) pgproto3.Message {
+	row, ok := msg.(*pgproto3.RowDescription)
+	if !ok {
+		return c.canonicalize(msg)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, f := range row.Fields {
+		if f.TableOID >= firstNormalOID {
+			c.taken[f.TableOID] = true
+		}
+	}
+	return msg
+}
+
+// statement returns the canonical name of the statement, the unnamed
+// statement is kept unnamed
+func (c *canonicalizer) statement(name string) string {
+	if name == "" {
+		return ""
+	}
+
+	if n, ok := c.statements[name]; ok {
+		return n
+	}
+
+	c.lastStatement++
+	n := canonicalStmtPrefix + strconv.Itoa(c.lastStatement)
+	c.statements[name] = n
+	return n
+}
+
+// alias makes the statement name canonicalized as the other statement name,
+// it's used when the client name is bound to the recorded name
+func (c *canonicalizer) alias(name, other string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.statements[name] = c.statement(other)
+}
+
+// tableOID returns the canonical OID of the table. The system catalog OID and
+// zero (not a table column) are kept.
+func (c *canonicalizer) tableOID(oid uint32) uint32 {
+	if oid < firstNormalOID {
+		return oid
+	}
+
+	if n, ok := c.tableOIDs[oid]; ok {
+		return n
+	}
+
+	n := uint32(firstNormalOID)
+	for c.taken[n] {
+		n++
+	}
+	c.taken[n] = true
+	c.tableOIDs[oid] = n
+	return n
+}
@@ -0,0 +1,135 @@
+package pgsnap
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_canonicalizer_canonicalize(t *testing.T) {
+	c := newCanonicalizer()
+
+	assert.Equal(t,
+		&pgproto3.Parse{Name: "stmt_1", Query: "select 1"},
+		c.canonicalize(&pgproto3.Parse{Name: "lrupsc_5_0", Query: "select 1"}),
+	)
+	assert.Equal(t,
+		&pgproto3.Describe{ObjectType: 'S', Name: "stmt_1"},
+		c.canonicalize(&pgproto3.Describe{ObjectType: 'S', Name: "lrupsc_5_0"}),
+	)
+	assert.Equal(t,
+		&pgproto3.Bind{PreparedStatement: "stmt_2"},
+		c.canonicalize(&pgproto3.Bind{PreparedStatement: "lrupsc_5_1"}),
+	)
+	assert.Equal(t,
+		&pgproto3.Close{ObjectType: 'S', Name: "stmt_1"},
+		c.canonicalize(&pgproto3.Close{ObjectType: 'S', Name: "lrupsc_5_0"}),
+	)
+
+	// unnamed statement and the portal are kept
+	assert.Equal(t, &pgproto3.Parse{Query: "select 2"}, c.canonicalize(&pgproto3.Parse{Query: "select 2"}))
+	assert.Equal(t,
+		&pgproto3.Describe{ObjectType: 'P', Name: "cursor"},
+		c.canonicalize(&pgproto3.Describe{ObjectType: 'P', Name: "cursor"}),
+	)
+
+	assert.Equal(t,
+		&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{
+			{Name: []byte("id"), TableOID: firstNormalOID},
+			{Name: []byte("relname"), TableOID: 1259},
+			{Name: []byte("name"), TableOID: firstNormalOID + 1},
+			{Name: []byte("?column?")},
+		}},
+		c.canonicalize(&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{
+			{Name: []byte("id"), TableOID: 16386},
+			{Name: []byte("relname"), TableOID: 1259},
+			{Name: []byte("name"), TableOID: 16392},
+			{Name: []byte("?column?")},
+		}}),
+	)
+
+	assert.Equal(t,
+		&pgproto3.ErrorResponse{Code: "42P01", Message: "relation does not exist"},
+		c.canonicalize(&pgproto3.ErrorResponse{
+			Code:    "42P01",
+			Message: "relation does not exist",
+			File:    "parse_relation.c",
+			Line:    1376,
+			Routine: "parserOpenTable",
+		}),
+	)
+	assert.Equal(t, &pgproto3.BackendKeyData{}, c.canonicalize(&pgproto3.BackendKeyData{ProcessID: 12, SecretKey: 34}))
+	assert.Equal(t, &pgproto3.Sync{}, c.canonicalize(&pgproto3.Sync{}))
+}
+
+// the type OIDs are sent to the client when replaying, the user defined
+// type is decoded by its real OID
+func Test_canonicalizer_keepTypeOID(t *testing.T) {
+	c := newCanonicalizer()
+
+	assert.Equal(t,
+		&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{
+			{Name: []byte("mood"), TableOID: firstNormalOID, DataTypeOID: 16390},
+		}},
+		c.canonicalize(&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{
+			{Name: []byte("mood"), TableOID: 16386, DataTypeOID: 16390},
+		}}),
+	)
+
+	params := &pgproto3.ParameterDescription{ParameterOIDs: []uint32{23, 16390}}
+	assert.Equal(t, params, c.canonicalize(params))
+
+	parse := &pgproto3.Parse{Name: "s", Query: "select $1::mood", ParameterOIDs: []uint32{16390}}
+	assert.Equal(t, []uint32{16390}, c.canonicalize(parse).(*pgproto3.Parse).ParameterOIDs)
+}
+
+func Test_canonicalizer_keepOriginal(t *testing.T) {
+	c := newCanonicalizer()
+
+	parse := &pgproto3.Parse{Name: "lrupsc_1_0"}
+	row := &pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{TableOID: 16386}}}
+	c.canonicalize(parse)
+	c.canonicalize(row)
+
+	assert.Equal(t, "lrupsc_1_0", parse.Name)
+	assert.Equal(t, uint32(16386), row.Fields[0].TableOID)
+}
+
+// recording the same conversation with the different names and OIDs produce
+// the same snapshot
+func Test_canonicalizer_stableRecording(t *testing.T) {
+	record := func(prefix string, oid uint32) string {
+		c := newCanonicalizer()
+		var out []byte
+		for _, msg := range []pgproto3.Message{
+			&pgproto3.Parse{Name: prefix + "_0", Query: "select id from mytable"},
+			&pgproto3.Describe{ObjectType: 'S', Name: prefix + "_0"},
+			&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("id"), TableOID: oid}}},
+			&pgproto3.Bind{PreparedStatement: prefix + "_0"},
+		} {
+			b, err := json.Marshal(c.canonicalize(msg))
+			require.NoError(t, err)
+			out = append(append(out, b...), '\n')
+		}
+		return string(out)
+	}
+
+	assert.Equal(t, record("lrupsc_5", 16386), record("lrupsc_2", 24601))
+}
+
+// in hybrid mode, the replayed snapshot is canonical already, so the live
+// table is not given the OID of the replayed one
+func Test_canonicalizer_replayed(t *testing.T) {
+	c := newCanonicalizer()
+	replayed := &pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("id"), TableOID: 16384}}}
+	assert.Equal(t, replayed, c.replayed(replayed))
+
+	live := &pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("id"), TableOID: 16384}}}
+	assert.Equal(t, uint32(16385), c.canonicalize(live).(*pgproto3.RowDescription).Fields[0].TableOID)
+
+	parse := c.replayed(&pgproto3.Parse{Name: "lrupsc_1_0"}).(*pgproto3.Parse)
+	assert.Equal(t, "stmt_1", parse.Name)
+}
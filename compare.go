@@ -0,0 +1,107 @@
+package pgsnap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgtype"
+)
+
+// QueryDiff is the difference of a query result between two runs of the
+// same test, like the test recorded against different postgres versions
+type QueryDiff struct {
+	// Index is the position of the query in the test
+	Index int
+
+	// SQL is the query string
+	SQL string
+
+	// Field is the different part: "sql", "error", "command tag",
+	// "columns" or "rows"
+	Field string
+
+	A string
+	B string
+}
+
+func (d QueryDiff) String() string {
+	return fmt.Sprintf("query #%d %s\n%s: %s != %s", d.Index, d.SQL, d.Field, d.A, d.B)
+}
+
+// DiffQueries compare the results of the queries in order. It stops on the
+// first different SQL, because the rest of the conversation is different.
+func DiffQueries(a, b []Query) []QueryDiff {
+	ci := pgtype.NewConnInfo()
+
+	var diffs []QueryDiff
+	for i := 0; i < len(a) || i < len(b); i++ {
+		if i >= len(a) || i >= len(b) || a[i].SQL != b[i].SQL {
+			return append(diffs, QueryDiff{
+				Index: i,
+				SQL:   querySQL(a, b, i),
+				Field: "sql",
+				A:     querySQLAt(a, i),
+				B:     querySQLAt(b, i),
+			})
+		}
+
+		fields := []struct {
+			name string
+			a, b string
+		}{
+			{"error", errorCode(a[i].Err), errorCode(b[i].Err)},
+			{"command tag", a[i].CommandTag, b[i].CommandTag},
+			{"columns", formatColumns(ci, a[i].Columns), formatColumns(ci, b[i].Columns)},
+			{"rows", fmt.Sprint(a[i].Values), fmt.Sprint(b[i].Values)},
+		}
+
+		for _, f := range fields {
+			if f.a != f.b {
+				diffs = append(diffs, QueryDiff{Index: i, SQL: a[i].SQL, Field: f.name, A: f.a, B: f.b})
+			}
+		}
+	}
+
+	return diffs
+}
+
+func querySQL(a, b []Query, i int) string {
+	if i < len(a) {
+		return a[i].SQL
+	}
+	return b[i].SQL
+}
+
+func querySQLAt(queries []Query, i int) string {
+	if i < len(queries) {
+		return queries[i].SQL
+	}
+	return "(no query)"
+}
+
+// errorCode returns the SQLSTATE of the error, the message is not compared
+// because it can be changed between versions
+func errorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	if pgErr, ok := err.(*pgconn.PgError); ok {
+		return pgErr.Code
+	}
+	return err.Error()
+}
+
+func formatColumns(ci *pgtype.ConnInfo, columns []Column) string {
+	s := make([]string, len(columns))
+	for i, c := range columns {
+		typ := strconv.FormatUint(uint64(c.DataTypeOID), 10)
+		if dt, ok := ci.DataTypeForOID(c.DataTypeOID); ok {
+			typ = dt.Name
+		}
+		s[i] = c.Name + " " + typ
+	}
+	return "(" + strings.Join(s, ", ") + ")"
+}
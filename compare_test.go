@@ -0,0 +1,75 @@
+package pgsnap
+
+import (
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffQueries(t *testing.T) {
+	base := []Query{
+		{
+			SQL:        "select id from mytable",
+			Columns:    []Column{{Name: "id", DataTypeOID: 23}},
+			Values:     [][]interface{}{{int32(1)}},
+			CommandTag: "SELECT 1",
+		},
+		{
+			SQL: "select * from notable",
+			Err: &pgconn.PgError{Code: "42P01", Message: "relation \"notable\" does not exist"},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		other []Query
+		want  []QueryDiff
+	}{
+		{
+			name:  "same",
+			other: base,
+		},
+		{
+			name: "error message is ignored",
+			other: []Query{base[0], {
+				SQL: "select * from notable",
+				Err: &pgconn.PgError{Code: "42P01", Message: "other message"},
+			}},
+		},
+		{
+			name: "different type and rows",
+			other: []Query{{
+				SQL:        "select id from mytable",
+				Columns:    []Column{{Name: "id", DataTypeOID: 20}},
+				Values:     [][]interface{}{{int64(2)}},
+				CommandTag: "SELECT 1",
+			}, base[1]},
+			want: []QueryDiff{
+				{Index: 0, SQL: "select id from mytable", Field: "columns", A: "(id int4)", B: "(id int8)"},
+				{Index: 0, SQL: "select id from mytable", Field: "rows", A: "[[1]]", B: "[[2]]"},
+			},
+		},
+		{
+			name:  "different error code",
+			other: []Query{base[0], {SQL: "select * from notable", CommandTag: "SELECT 0"}},
+			want: []QueryDiff{
+				{Index: 1, SQL: "select * from notable", Field: "error", A: "42P01", B: ""},
+				{Index: 1, SQL: "select * from notable", Field: "command tag", A: "", B: "SELECT 0"},
+			},
+		},
+		{
+			name:  "conversation stopped",
+			other: base[:1],
+			want: []QueryDiff{
+				{Index: 1, SQL: "select * from notable", Field: "sql", A: "select * from notable", B: "(no query)"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, DiffQueries(base, tt.other))
+		})
+	}
+}
@@ -7,17 +7,84 @@ import (
 	"github.com/jackc/pgproto3/v2"
 )
 
+// The expectations below compare the statement and portal names through
+// names, the client names are bound to the recorded names on Parse and Bind.
+// When names is nil, the statement names are ignored and the portal names
+// are compared as is.
 type (
 	// expectParseMessage is a custom expectation for pgx that ignore Name
-	expectParseMessage struct{ want *pgproto3.Parse }
+	expectParseMessage struct {
+		want  *pgproto3.Parse
+		names *nameMapping
+	}
 
 	// expectDescribeMessage is a custom expectation for pgx that ignore Name
-	expectDescribeMessage struct{ want *pgproto3.Describe }
+	expectDescribeMessage struct {
+		want  *pgproto3.Describe
+		names *nameMapping
+	}
 
 	// expectBindMessage is a custom expectation for pgx that ignore PreparedStatement
-	expectBindMessage struct{ want *pgproto3.Bind }
+	expectBindMessage struct {
+		want  *pgproto3.Bind
+		names *nameMapping
+	}
+
+	// expectCloseMessage is a custom expectation that ignore statement Name
+	expectCloseMessage struct {
+		want  *pgproto3.Close
+		names *nameMapping
+	}
+
+	// expectExecuteMessage is a custom expectation that map the Portal
+	expectExecuteMessage struct {
+		want  *pgproto3.Execute
+		names *nameMapping
+	}
+
+	// expectMessage is like pgmock.ExpectMessage, the message should be
+	// exactly the same
+	expectMessage struct{ want pgproto3.FrontendMessage }
+
+	// comparer is implemented by the expectations above, so the received
+	// message can be kept when it's not the expected one
+	comparer interface {
+		compare(msg pgproto3.FrontendMessage) error
+	}
+
+	// mismatchError is returned when the client send the message that
+	// different from the snapshot
+	mismatchError struct {
+		msg pgproto3.FrontendMessage
+		err error
+	}
 )
 
+func (e *mismatchError) Error() string {
+	return e.err.Error()
+}
+
+func (e *mismatchError) Unwrap() error {
+	return e.err
+}
+
+func (e *expectMessage) Step(backend *pgproto3.Backend) error {
+	msg, err := backend.Receive()
+	if err != nil {
+		return err
+	}
+
+	return e.compare(msg)
+}
+
+func (e *expectMessage) compare(msg pgproto3.FrontendMessage) error {
+	if !reflect.DeepEqual(msg, e.want) {
+		return fmt.Errorf("msg => %#v, e.want => %#v", msg, e.want)
+	}
+
+	return nil
+}
+
 func (e *expectParseMessage) Step(backend *pgproto3.Backend) error {
 	msg, err := backend.Receive()
 	if err != nil {
@@ -26,7 +93,7 @@ func (e *expectParseMessage) Step(backend *pgproto3.Backend) error {
 	return e.compare(msg)
 }
 
-// we ignore and m.Name, because it's inconsisten in pgx
+// m.Name is inconsisten in pgx, it's bound to the recorded name instead
 func (e *expectParseMessage) compare(msg pgproto3.FrontendMessage) error {
 	m, ok := msg.(*pgproto3.Parse)
 	if !ok {
@@ -41,6 +108,8 @@ func (e *expectParseMessage) compare(msg pgproto3.FrontendMessage) error {
 		return fmt.Errorf("msg => ParameterOIDs: %v, want => ParameterOIDs: %v", m.ParameterOIDs, e.want.ParameterOIDs)
 	}
 
+	e.names.bindStatement(m.Name, e.want.Name)
+
 	return nil
 }
 
@@ -52,7 +121,7 @@ func (e *expectDescribeMessage) Step(backend *pgproto3.Backend) error {
 	return e.compare(msg)
 }
 
-// we ignore and m.Name, because it's inconsisten in pgx
+// m.Name is inconsisten in pgx, it's compared with the bound name
 func (e *expectDescribeMessage) compare(msg pgproto3.FrontendMessage) error {
 	m, ok := msg.(*pgproto3.Describe)
 	if !ok {
@@ -63,7 +132,7 @@ func (e *expectDescribeMessage) compare(msg pgproto3.FrontendMessage) error {
 		return fmt.Errorf("msg => ObjectType: %s, want => ObjectType: %s", string(m.ObjectType), string(e.want.ObjectType))
 	}
 
-	return nil
+	return e.names.check(m.ObjectType, m.Name, e.want.Name)
 }
 
 func (e *expectBindMessage) Step(backend *pgproto3.Backend) error {
@@ -81,8 +150,14 @@ func (e *expectBindMessage) compare(msg pgproto3.FrontendMessage) error {
 		return fmt.Errorf("msg => %T, want => %T", msg, e.want)
 	}
 
-	// we ignore and m.Name, because it's inconsisten in pgx
-	if m.DestinationPortal != e.want.DestinationPortal {
+	// m.PreparedStatement is inconsisten in pgx, it's compared with the
+	// bound name
+	if err := e.names.checkStatement(m.PreparedStatement, e.want.PreparedStatement); err != nil {
+		return err
+	}
+
+	// the portal is bound when there is no mapping, or it's compared as is
+	if e.names == nil && m.DestinationPortal != e.want.DestinationPortal {
 		return fmt.Errorf(
 			"msg => DestinationPortal: %s, want => DestinationPortal: %s",
 			m.DestinationPortal,
@@ -106,11 +181,7 @@ func (e *expectBindMessage) compare(msg pgproto3.FrontendMessage) error {
 		)
 	}
 
-	if !reflect.DeepEqual(m.Parameters, e.want.Parameters) {
-		if len(m.Parameters) == 0 && len(e.want.Parameters) == 0 {
-			return nil
-		}
-
+	if !reflect.DeepEqual(m.Parameters, e.want.Parameters) && (len(m.Parameters) > 0 || len(e.want.Parameters) > 0) {
 		return fmt.Errorf(
 			"msg => Parameters: %v, want => Parameters: %v",
 			m.Parameters,
@@ -118,5 +189,63 @@ func (e *expectBindMessage) compare(msg pgproto3.FrontendMessage) error {
 		)
 	}
 
+	e.names.bindPortal(m.DestinationPortal, e.want.DestinationPortal)
+
+	return nil
+}
+
+func (e *expectCloseMessage) Step(backend *pgproto3.Backend) error {
+	msg, err := backend.Receive()
+	if err != nil {
+		return err
+	}
+
+	return e.compare(msg)
+}
+
+// the statement and the portal are unbound after closed, so the driver can
+// reuse the name for the other statement
+func (e *expectCloseMessage) compare(msg pgproto3.FrontendMessage) error {
+	m, ok := msg.(*pgproto3.Close)
+	if !ok {
+		return fmt.Errorf("msg => %T, want => %T", msg, e.want)
+	}
+
+	if m.ObjectType != e.want.ObjectType {
+		return fmt.Errorf("msg => ObjectType: %s, want => ObjectType: %s", string(m.ObjectType), string(e.want.ObjectType))
+	}
+
+	if err := e.names.check(m.ObjectType, m.Name, e.want.Name); err != nil {
+		return err
+	}
+
+	e.names.close(m.ObjectType, m.Name)
+
+	return nil
+}
+
+func (e *expectExecuteMessage) Step(backend *pgproto3.Backend) error {
+	msg, err := backend.Receive()
+	if err != nil {
+		return err
+	}
+
+	return e.compare(msg)
+}
+
+func (e *expectExecuteMessage) compare(msg pgproto3.FrontendMessage) error {
+	m, ok := msg.(*pgproto3.Execute)
+	if !ok {
+		return fmt.Errorf("msg => %T, want => %T", msg, e.want)
+	}
+
+	if err := e.names.checkPortal(m.Portal, e.want.Portal); err != nil {
+		return err
+	}
+
+	if m.MaxRows != e.want.MaxRows {
+		return fmt.Errorf("msg => MaxRows: %d, want => MaxRows: %d", m.MaxRows, e.want.MaxRows)
+	}
+
 	return nil
 }
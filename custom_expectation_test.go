@@ -163,6 +163,47 @@ func Test_expectBindMessage_compare(t *testing.T) {
 	}
 }
 
+func Test_expectCloseMessage_compare(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   *pgproto3.Close
+		arg     pgproto3.FrontendMessage
+		wantErr error
+	}{
+		{
+			name:    "success with different statement name",
+			field:   &pgproto3.Close{ObjectType: 'S', Name: "stmt_1"},
+			arg:     &pgproto3.Close{ObjectType: 'S', Name: "lrupsc_1_0"},
+			wantErr: nil,
+		},
+		{
+			name:    "different in type",
+			field:   &pgproto3.Close{},
+			arg:     &pgproto3.Sync{},
+			wantErr: errors.New("msg => *pgproto3.Sync, want => *pgproto3.Close"),
+		},
+		{
+			name:    "different in ObjectType",
+			field:   &pgproto3.Close{ObjectType: 'S'},
+			arg:     &pgproto3.Close{ObjectType: 'P'},
+			wantErr: errors.New("msg => ObjectType: P, want => ObjectType: S"),
+		},
+		{
+			name:    "different in portal name",
+			field:   &pgproto3.Close{ObjectType: 'P', Name: "cursor_1"},
+			arg:     &pgproto3.Close{ObjectType: 'P', Name: "cursor_2"},
+			wantErr: errors.New("msg => portal: cursor_2, want => portal: cursor_1"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &expectCloseMessage{want: tt.field}
+			err := e.compare(tt.arg)
+			assert.Equal(t, tt.wantErr, err)
+		})
+	}
+}
+
 func Test_customExpectation_BackendError(t *testing.T) {
 	r := strings.NewReader("")
 	w := &strings.Builder{}
@@ -0,0 +1,105 @@
+package docker
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// extensionTimeout is how long to wait for the extensions to be available
+const extensionTimeout = 30 * time.Second
+
+// prepareDatabase create the extensions, then run the Migrator
+func prepareDatabase(addr string, extensions []string, m Migrator) error {
+	if err := createExtensions(addr, extensions, extensionTimeout); err != nil {
+		return err
+	}
+
+	if m == nil {
+		return nil
+	}
+
+	return runMigrator(addr, m)
+}
+
+// createExtensions wait until the extensions are available, because some
+// images install them on the first start, then create them
+func createExtensions(addr string, extensions []string, timeout time.Duration) error {
+	if len(extensions) == 0 {
+		return nil
+	}
+
+	db, err := sql.Open("postgres", addr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		missing, err := missingExtensions(db, extensions)
+		if err != nil {
+			return err
+		}
+
+		if len(missing) == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("extensions are not available after %v: %s", timeout, strings.Join(missing, ", "))
+		}
+
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	for _, e := range extensions {
+		if _, err := db.Exec("CREATE EXTENSION IF NOT EXISTS " + pq.QuoteIdentifier(e)); err != nil {
+			return fmt.Errorf("cannot create extension %s: %w", e, err)
+		}
+	}
+
+	return nil
+}
+
+func missingExtensions(db *sql.DB, extensions []string) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM pg_available_extensions WHERE name = ANY($1)", pq.Array(extensions))
+	if err != nil {
+		return nil, fmt.Errorf("cannot check available extensions: %w", err)
+	}
+	defer rows.Close()
+
+	available := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		available[name] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, e := range extensions {
+		if !available[e] {
+			missing = append(missing, e)
+		}
+	}
+	return missing, nil
+}
+
+// splitImage split "repository:tag" image, the port of registry host is
+// not the tag
+func splitImage(image string) (string, string) {
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return image, ""
+	}
+	return image[:i], image[i+1:]
+}
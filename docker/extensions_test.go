@@ -0,0 +1,56 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_splitImage(t *testing.T) {
+	tests := []struct {
+		image      string
+		repository string
+		tag        string
+	}{
+		{"postgres", "postgres", ""},
+		{"postgis/postgis:15-3.4", "postgis/postgis", "15-3.4"},
+		{"timescale/timescaledb:latest-pg15", "timescale/timescaledb", "latest-pg15"},
+		{"registry.local:5000/postgres", "registry.local:5000/postgres", ""},
+		{"registry.local:5000/postgres:15", "registry.local:5000/postgres", "15"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			repository, tag := splitImage(tt.image)
+			assert.Equal(t, tt.repository, repository)
+			assert.Equal(t, tt.tag, tag)
+		})
+	}
+}
+
+func Test_postgresSettings(t *testing.T) {
+	assert.Equal(t, map[string]string{"log_line_prefix": logLinePrefix}, postgresSettings(PostgresConfig{}))
+	assert.Equal(t, "all", postgresSettings(PostgresConfig{LogStatements: true})["log_statement"])
+
+	cfg := PostgresConfig{
+		Settings:               map[string]string{"fsync": "off"},
+		SharedPreloadLibraries: []string{"timescaledb", "pg_stat_statements"},
+	}
+	assert.Equal(t, map[string]string{
+		"fsync":                    "off",
+		"log_line_prefix":          logLinePrefix,
+		"shared_preload_libraries": "timescaledb,pg_stat_statements",
+	}, postgresSettings(cfg))
+
+	// the config itself is not changed
+	assert.Len(t, cfg.Settings, 1)
+}
+
+func Test_sharedKey_extensions(t *testing.T) {
+	cfg := PostgresConfig{MigrationPath: "./sqlschema"}
+	withExtension := PostgresConfig{MigrationPath: "./sqlschema", Extensions: []string{"postgis"}}
+	withPreload := PostgresConfig{MigrationPath: "./sqlschema", SharedPreloadLibraries: []string{"pg_stat_statements"}}
+
+	assert.NotEqual(t, sharedKey(cfg), sharedKey(withExtension))
+	assert.NotEqual(t, sharedKey(cfg), sharedKey(withPreload))
+}
@@ -0,0 +1,101 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SchemaMetadataKey is the snapshot metadata key of the migration fingerprint
+const SchemaMetadataKey = "schema"
+
+// MigrationFingerprint returns sha256 hash of the files inside the migration
+// path. The file names are included, so renaming (reordering) the migration
+// also change the fingerprint. Hidden files are ignored.
+func MigrationFingerprint(path string) (string, error) {
+	var files []string
+
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(d.Name(), ".") && p != path {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.Type().IsRegular() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, f := range files {
+		rel, err := filepath.Rel(path, f)
+		if err != nil {
+			return "", err
+		}
+
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+
+		h.Write([]byte(filepath.ToSlash(rel)))
+		h.Write([]byte{0})
+		h.Write(b)
+		h.Write([]byte{0})
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fingerprinter is implemented by Migrator that know its fingerprint
+type fingerprinter interface {
+	Fingerprint() (string, error)
+}
+
+// schemaMetadata returns the snapshot metadata that contains fingerprint of
+// the migration. It returns nil when the migration path is not exists, or
+// the Migrator does not have fingerprint.
+func schemaMetadata(cfg PostgresConfig) map[string]string {
+	fingerprint, ok := migrationFingerprint(cfg)
+	if !ok {
+		return nil
+	}
+
+	return map[string]string{SchemaMetadataKey: fingerprint}
+}
+
+func migrationFingerprint(cfg PostgresConfig) (string, bool) {
+	if cfg.Migrator != nil {
+		f, ok := cfg.Migrator.(fingerprinter)
+		if !ok {
+			return "", false
+		}
+
+		fingerprint, err := f.Fingerprint()
+		return fingerprint, err == nil
+	}
+
+	path := getMigrationPath(cfg)
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return "", false
+	}
+
+	fingerprint, err := MigrationFingerprint(path)
+	return fingerprint, err == nil
+}
@@ -0,0 +1,37 @@
+package docker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "001_init.sql"), []byte("CREATE TABLE a (id int);"), 0o644))
+
+	first, err := MigrationFingerprint(dir)
+	require.NoError(t, err)
+	assert.Contains(t, first, "sha256:")
+
+	// hidden file is ignored
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".DS_Store"), []byte("junk"), 0o644))
+	same, err := MigrationFingerprint(dir)
+	require.NoError(t, err)
+	assert.Equal(t, first, same)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "002_add.sql"), []byte("ALTER TABLE a ADD name text;"), 0o644))
+	changed, err := MigrationFingerprint(dir)
+	require.NoError(t, err)
+	assert.NotEqual(t, first, changed)
+}
+
+func Test_schemaMetadata(t *testing.T) {
+	assert.Nil(t, schemaMetadata(PostgresConfig{MigrationPath: "./not_exists"}))
+
+	metadata := schemaMetadata(PostgresConfig{MigrationPath: "./sqlschema"})
+	assert.Contains(t, metadata[SchemaMetadataKey], "sha256:")
+}
@@ -0,0 +1,245 @@
+package docker
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+type (
+	// postgreInLocal runs the postgres binaries installed in the machine,
+	// for the environment that cannot run docker
+	postgreInLocal struct {
+		isDebug    bool
+		addr       string
+		dataDir    string
+		cmd        *exec.Cmd
+		exited     chan struct{}
+		logs       *logBuffer
+		migrator   Migrator
+		extensions []string
+		prepared   bool
+	}
+)
+
+// localReadyTimeout is how long WaitUntilReady waits for local postgres
+const localReadyTimeout = 30 * time.Second
+
+// NewPostgreInLocal runs initdb and postgres from cfg.LocalBinDir or PATH
+// into temporary data directory on a free port. The migration is applied
+// by cfg.Migrator, or the .sql files in the migration path when it's not
+// set. Like postgres itself, it cannot be run as root.
+func NewPostgreInLocal(cfg PostgresConfig) (PostgreInDocker, error) {
+	p := &postgreInLocal{
+		isDebug:    cfg.DebugMode,
+		logs:       newLogBuffer(cfg.LogLimit),
+		exited:     make(chan struct{}),
+		migrator:   cfg.Migrator,
+		extensions: cfg.Extensions,
+	}
+
+	if p.migrator == nil {
+		p.migrator = SQLFiles(getMigrationPath(cfg))
+	}
+
+	initdb, err := findBinary(cfg.LocalBinDir, "initdb")
+	if err != nil {
+		return p, err
+	}
+
+	postgres, err := findBinary(cfg.LocalBinDir, "postgres")
+	if err != nil {
+		return p, err
+	}
+
+	p.dataDir, err = os.MkdirTemp("", "pgsnap_")
+	if err != nil {
+		return p, fmt.Errorf("cannot create data dir: %w", err)
+	}
+
+	args := append([]string{
+		"-D", p.dataDir,
+		"-U", "postgres",
+		"--auth=trust",
+		"--no-sync",
+		"-E", "UTF8",
+	}, cfg.InitdbArgs...)
+
+	out, err := exec.Command(initdb, args...).CombinedOutput()
+	if err != nil {
+		_ = os.RemoveAll(p.dataDir)
+		return p, fmt.Errorf("initdb failed: %w\n%s", err, out)
+	}
+
+	port, err := freePort()
+	if err != nil {
+		_ = os.RemoveAll(p.dataDir)
+		return p, err
+	}
+	p.addr = fmt.Sprintf(addrTmpl, strconv.Itoa(port))
+
+	if p.isDebug {
+		log.Println("run local postgres in:", p.dataDir, "addr:", p.addr)
+	}
+
+	// the socket is put in data dir, because the default one might not be
+	// writable by the user
+	args = append([]string{
+		"-D", p.dataDir,
+		"-p", strconv.Itoa(port),
+		"-h", "127.0.0.1",
+		"-k", p.dataDir,
+		"-F",
+	}, settingArgs(postgresSettings(cfg))...)
+
+	p.cmd = exec.Command(postgres, args...)
+	p.cmd.Stdout = p.logs
+	p.cmd.Stderr = p.logs
+
+	if err := p.cmd.Start(); err != nil {
+		_ = os.RemoveAll(p.dataDir)
+		return p, fmt.Errorf("cannot start postgres: %w", err)
+	}
+
+	go func() {
+		_ = p.cmd.Wait()
+		close(p.exited)
+	}()
+
+	if !cfg.ExplicitWait {
+		if err := p.WaitUntilReady(); err != nil {
+			_ = p.Finish()
+			return p, fmt.Errorf("waiting aborted: %w", err)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *postgreInLocal) GetAddr() string {
+	return p.addr
+}
+
+func (p *postgreInLocal) GetLogs() string {
+	return p.logs.String()
+}
+
+func (p *postgreInLocal) logBuffer() *logBuffer {
+	return p.logs
+}
+
+func (p *postgreInLocal) WaitUntilReady() error {
+	deadline := time.Now().Add(localReadyTimeout)
+
+	for {
+		select {
+		case <-p.exited:
+			return fmt.Errorf("postgres exited: logs:\n %s", p.logs)
+		default:
+		}
+
+		err := ping(p.addr)
+		if err == nil {
+			break
+		}
+
+		if p.isDebug {
+			log.Printf("ping err is %v\n", err)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("postgres is not ready after %v: %w", localReadyTimeout, err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if p.prepared {
+		return nil
+	}
+
+	if err := prepareDatabase(p.addr, p.extensions, p.migrator); err != nil {
+		return err
+	}
+
+	p.prepared = true
+	return nil
+}
+
+func (p *postgreInLocal) Finish() error {
+	if p.isDebug {
+		log.Printf("postgres logs:\n%s\n", p.logs.String())
+	}
+
+	if p.cmd != nil && p.cmd.Process != nil {
+		// SIGINT is the fast shutdown of postgres
+		if err := p.cmd.Process.Signal(os.Interrupt); err != nil {
+			_ = p.cmd.Process.Kill()
+		}
+
+		select {
+		case <-p.exited:
+		case <-time.After(10 * time.Second):
+			_ = p.cmd.Process.Kill()
+			<-p.exited
+		}
+	}
+
+	if p.dataDir == "" {
+		return nil
+	}
+
+	return os.RemoveAll(p.dataDir)
+}
+
+// findBinary returns the path of the binary inside dir, or in PATH when dir
+// is empty
+func findBinary(dir, name string) (string, error) {
+	if dir == "" {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return "", fmt.Errorf("cannot find %s in PATH, set LocalBinDir: %w", name, err)
+		}
+		return path, nil
+	}
+
+	path := filepath.Join(dir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot find %s in %s: %w", name, dir, err)
+	}
+
+	if info.IsDir() {
+		return "", errors.New(path + " is a directory")
+	}
+
+	return path, nil
+}
+
+// freePort ask the kernel for a free port
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("cannot find free port: %w", err)
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func ping(addr string) error {
+	db, err := sql.Open("postgres", addr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Ping()
+}
@@ -0,0 +1,64 @@
+package docker
+
+import (
+	"database/sql"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_findBinary(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "initdb"), []byte{}, 0o755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "postgres"), 0o755))
+
+	path, err := findBinary(dir, "initdb")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "initdb"), path)
+
+	_, err = findBinary(dir, "postgres")
+	assert.Error(t, err)
+
+	_, err = findBinary(dir, "pg_ctl")
+	assert.Error(t, err)
+
+	_, err = findBinary("", "pgsnap-binary-that-not-exists")
+	assert.Error(t, err)
+}
+
+func Test_freePort(t *testing.T) {
+	port, err := freePort()
+	require.NoError(t, err)
+	assert.NotZero(t, port)
+}
+
+func TestNewPostgreInLocal(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip need postgres test")
+	}
+
+	if _, err := exec.LookPath("initdb"); err != nil || os.Getuid() == 0 {
+		t.Skip("need initdb in PATH, and not running as root")
+	}
+
+	p, err := NewPostgreInLocal(PostgresConfig{MigrationPath: "./sqlschema"})
+	require.NoError(t, err)
+
+	db, err := sql.Open("postgres", p.GetAddr())
+	require.NoError(t, err)
+
+	var count int
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM mytable").Scan(&count))
+	assert.Equal(t, 3, count)
+	_ = db.Close()
+
+	dataDir := p.(*postgreInLocal).dataDir
+	require.NoError(t, p.Finish())
+
+	_, err = os.Stat(dataDir)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,197 @@
+package docker
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// defaultLogLimit is the default maximum size of the kept logs
+	defaultLogLimit = 1 << 20
+
+	// logLinePrefix is the log_line_prefix of postgres, the database name
+	// is used to find the logs of a test in the shared container
+	logLinePrefix = "%m [%p] %d "
+)
+
+// logEntryStart match the start of postgres log entry, which begin with the
+// timestamp of logLinePrefix
+var logEntryStart = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}`)
+
+type (
+	// logBuffer keeps the last limit bytes of the postgres logs. It's safe
+	// to be written by the log stream while it's read.
+	logBuffer struct {
+		mu      sync.Mutex
+		buf     []byte
+		limit   int
+		dropped int64
+	}
+
+	// logSource is implemented by postgres that keep the logs in logBuffer
+	logSource interface {
+		logBuffer() *logBuffer
+	}
+)
+
+func newLogBuffer(limit int) *logBuffer {
+	if limit <= 0 {
+		limit = defaultLogLimit
+	}
+	return &logBuffer{limit: limit}
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.limit; over > 0 {
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+		b.dropped += int64(over)
+	}
+
+	return len(p), nil
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
+
+// Offset returns the number of bytes ever written, it's used to get the
+// logs since the test is started
+func (b *logBuffer) Offset() int64 {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped + int64(len(b.buf))
+}
+
+// Since returns the kept logs that written after the offset
+func (b *logBuffer) Since(offset int64) string {
+	if b == nil {
+		return ""
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	start := offset - b.dropped
+	if start < 0 {
+		start = 0
+	}
+	if start > int64(len(b.buf)) {
+		return ""
+	}
+	return string(b.buf[start:])
+}
+
+// logEntries split the logs into entries, the continuation lines (like the
+// multiline statement) are joined into the entry. The lines before the first
+// entry are ignored
+func logEntries(logs string) []string {
+	var entries []string
+	for _, line := range strings.SplitAfter(logs, "\n") {
+		if line == "" {
+			continue
+		}
+
+		if logEntryStart.MatchString(line) {
+			entries = append(entries, line)
+			continue
+		}
+
+		if len(entries) > 0 {
+			entries[len(entries)-1] += line
+		}
+	}
+	return entries
+}
+
+// filterDatabase returns the log entries of the database
+func filterDatabase(logs, database string) string {
+	b := &strings.Builder{}
+	for _, e := range logEntries(logs) {
+		if strings.Contains(firstLine(e), "] "+database+" ") {
+			b.WriteString(e)
+		}
+	}
+	return b.String()
+}
+
+// correlateQuery returns the log entries produced by the query: the entry
+// that contains the statement, and the ERROR, DETAIL and HINT entries of the
+// same process before it
+func correlateQuery(logs, sql string) []string {
+	sql = strings.TrimSpace(sql)
+	if sql == "" {
+		return nil
+	}
+
+	entries := logEntries(logs)
+	included := make([]bool, len(entries))
+
+	for i, e := range entries {
+		if !strings.Contains(e, sql) {
+			continue
+		}
+		included[i] = true
+
+		pid := logPID(e)
+		for j := i - 1; j >= 0 && logPID(entries[j]) == pid && isErrorEntry(entries[j]); j-- {
+			included[j] = true
+		}
+	}
+
+	var result []string
+	for i, e := range entries {
+		if included[i] {
+			result = append(result, strings.TrimRight(e, "\n"))
+		}
+	}
+	return result
+}
+
+func isErrorEntry(entry string) bool {
+	line := firstLine(entry)
+	for _, level := range []string{"ERROR:", "FATAL:", "DETAIL:", "HINT:", "CONTEXT:"} {
+		if strings.Contains(line, level) {
+			return true
+		}
+	}
+	return false
+}
+
+// logPID returns the [pid] part of logLinePrefix
+func logPID(entry string) string {
+	line := firstLine(entry)
+	start := strings.Index(line, "[")
+	end := strings.Index(line, "]")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start : end+1]
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// databaseName returns the database in postgres address
+func databaseName(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(u.Path, "/")
+}
@@ -0,0 +1,61 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testLogs = `PostgreSQL init process complete; ready for start up.
+2023-01-02 03:04:05.678 UTC [42] pgsnap_1_1 LOG:  statement: select id from mytable limit 7
+2023-01-02 03:04:05.679 UTC [43] pgsnap_1_2 LOG:  statement: BEGIN
+2023-01-02 03:04:05.680 UTC [42] pgsnap_1_1 ERROR:  relation "notable" does not exist at character 15
+2023-01-02 03:04:05.680 UTC [42] pgsnap_1_1 STATEMENT:  select id from notable
+	where id = $1
+2023-01-02 03:04:05.681 UTC [43] pgsnap_1_2 LOG:  statement: COMMIT
+`
+
+func Test_logBuffer(t *testing.T) {
+	b := newLogBuffer(10)
+
+	_, _ = b.Write([]byte("12345"))
+	offset := b.Offset()
+	_, _ = b.Write([]byte("6789"))
+
+	assert.Equal(t, "123456789", b.String())
+	assert.Equal(t, "6789", b.Since(offset))
+
+	_, _ = b.Write([]byte("abcdef"))
+	assert.Equal(t, "6789abcdef", b.String())
+	assert.Equal(t, int64(15), b.Offset())
+	assert.Equal(t, "6789abcdef", b.Since(offset))
+	assert.Equal(t, "cdef", b.Since(11))
+	assert.Equal(t, "", b.Since(20))
+
+	var nilBuffer *logBuffer
+	assert.Equal(t, int64(0), nilBuffer.Offset())
+	assert.Equal(t, "", nilBuffer.Since(0))
+}
+
+func Test_filterDatabase(t *testing.T) {
+	assert.Equal(t,
+		"2023-01-02 03:04:05.679 UTC [43] pgsnap_1_2 LOG:  statement: BEGIN\n"+
+			"2023-01-02 03:04:05.681 UTC [43] pgsnap_1_2 LOG:  statement: COMMIT\n",
+		filterDatabase(testLogs, "pgsnap_1_2"),
+	)
+	assert.Equal(t, "", filterDatabase(testLogs, "pgsnap_1"))
+}
+
+func Test_correlateQuery(t *testing.T) {
+	assert.Equal(t, []string{
+		`2023-01-02 03:04:05.680 UTC [42] pgsnap_1_1 ERROR:  relation "notable" does not exist at character 15`,
+		"2023-01-02 03:04:05.680 UTC [42] pgsnap_1_1 STATEMENT:  select id from notable\n\twhere id = $1",
+	}, correlateQuery(testLogs, "select id from notable\n\twhere id = $1"))
+
+	assert.Nil(t, correlateQuery(testLogs, "select 1"))
+	assert.Nil(t, correlateQuery(testLogs, " "))
+}
+
+func Test_databaseName(t *testing.T) {
+	assert.Equal(t, "pgsnap_1_2", databaseName("postgres://postgres@127.0.0.1:5432/pgsnap_1_2?sslmode=disable"))
+}
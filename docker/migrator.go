@@ -0,0 +1,256 @@
+package docker
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	// Migrator apply the migrations over the connection after postgres is
+	// ready. When Migrator is set, the migration path is not mounted into
+	// /docker-entrypoint-initdb.d/, so it also works with remote docker
+	// daemon.
+	Migrator interface {
+		Migrate(ctx context.Context, db *sql.DB) error
+	}
+
+	// migrationFormat is the file convention of a migration tool
+	migrationFormat int
+
+	// fileMigrator run the up migration files in a directory
+	fileMigrator struct {
+		dir    string
+		format migrationFormat
+	}
+
+	// migration is a single up migration
+	migration struct {
+		version int64
+		name    string
+		sql     string
+	}
+)
+
+const (
+	formatSQL migrationFormat = iota
+	formatGolangMigrate
+	formatGoose
+)
+
+// SQLFiles returns Migrator that run every .sql file in the dir ordered by
+// the file name, the same order as /docker-entrypoint-initdb.d/. Files that
+// ends with .down.sql are skipped. It's also the format of atlas versioned
+// migration.
+func SQLFiles(dir string) Migrator {
+	return &fileMigrator{dir: dir, format: formatSQL}
+}
+
+// GolangMigrate returns Migrator that run {version}_{title}.up.sql files in
+// the dir ordered by the version, and set the schema_migrations table like
+// golang-migrate does.
+func GolangMigrate(dir string) Migrator {
+	return &fileMigrator{dir: dir, format: formatGolangMigrate}
+}
+
+// Goose returns Migrator that run the "-- +goose Up" section of
+// {version}_{name}.sql files in the dir ordered by the version, and fill the
+// goose_db_version table like goose does. Go migrations are not supported.
+func Goose(dir string) Migrator {
+	return &fileMigrator{dir: dir, format: formatGoose}
+}
+
+func (m *fileMigrator) Migrate(ctx context.Context, db *sql.DB) error {
+	migrations, err := loadMigrations(m.dir, m.format)
+	if err != nil {
+		return err
+	}
+
+	for _, mg := range migrations {
+		if strings.TrimSpace(mg.sql) == "" {
+			continue
+		}
+
+		// run the whole file in one simple query, like psql -f does
+		if _, err := db.ExecContext(ctx, mg.sql); err != nil {
+			return fmt.Errorf("migration %s failed: %w", mg.name, err)
+		}
+	}
+
+	return m.recordVersion(ctx, db, migrations)
+}
+
+// Fingerprint returns the fingerprint of the migration directory, it's used
+// to detect stale snapshot and to decide whether the shared container can be
+// used
+func (m *fileMigrator) Fingerprint() (string, error) {
+	return MigrationFingerprint(m.dir)
+}
+
+// recordVersion fill the version table of the migration tool, so the
+// application that check it on start does not run the migration again
+func (m *fileMigrator) recordVersion(ctx context.Context, db *sql.DB, migrations []migration) error {
+	var queries []string
+	var args [][]interface{}
+
+	switch m.format {
+	case formatGolangMigrate:
+		if len(migrations) == 0 {
+			return nil
+		}
+		queries = append(queries,
+			"CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)",
+			"TRUNCATE schema_migrations",
+			"INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)",
+		)
+		args = append(args, nil, nil, []interface{}{migrations[len(migrations)-1].version})
+
+	case formatGoose:
+		queries = append(queries,
+			"CREATE TABLE IF NOT EXISTS goose_db_version (id serial NOT NULL PRIMARY KEY, version_id bigint NOT NULL, is_applied boolean NOT NULL, tstamp timestamp DEFAULT now())",
+			"INSERT INTO goose_db_version (version_id, is_applied) VALUES (0, true)",
+		)
+		args = append(args, nil, nil)
+		for _, mg := range migrations {
+			queries = append(queries, "INSERT INTO goose_db_version (version_id, is_applied) VALUES ($1, true)")
+			args = append(args, []interface{}{mg.version})
+		}
+	}
+
+	for i, q := range queries {
+		if _, err := db.ExecContext(ctx, q, args[i]...); err != nil {
+			return fmt.Errorf("cannot record migration version: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// runMigrator connect to addr and run the Migrator
+func runMigrator(addr string, m Migrator) error {
+	db, err := sql.Open("postgres", addr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := m.Migrate(context.Background(), db); err != nil {
+		return fmt.Errorf("cannot migrate: %w", err)
+	}
+
+	return nil
+}
+
+// loadMigrations read the up migrations in the dir, ordered as the
+// migration tool would run it
+func loadMigrations(dir string, format migrationFormat) ([]migration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read migration dir: %w", err)
+	}
+
+	var migrations []migration
+	versions := map[int64]string{}
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !isUpMigration(name, format) {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		mg := migration{name: name, sql: string(b)}
+
+		if format != formatSQL {
+			mg.version, err = parseVersion(name)
+			if err != nil {
+				return nil, err
+			}
+
+			if other, ok := versions[mg.version]; ok {
+				return nil, fmt.Errorf("duplicate migration version %d: %s and %s", mg.version, other, name)
+			}
+			versions[mg.version] = name
+		}
+
+		if format == formatGoose {
+			mg.sql, err = gooseUp(mg.sql)
+			if err != nil {
+				return nil, fmt.Errorf("invalid goose migration %s: %w", name, err)
+			}
+		}
+
+		migrations = append(migrations, mg)
+	}
+
+	// os.ReadDir already sorted by name, version need numeric order
+	if format != formatSQL {
+		sort.Slice(migrations, func(i, j int) bool {
+			return migrations[i].version < migrations[j].version
+		})
+	}
+
+	return migrations, nil
+}
+
+func isUpMigration(name string, format migrationFormat) bool {
+	switch format {
+	case formatGolangMigrate:
+		return strings.HasSuffix(name, ".up.sql")
+	default:
+		return strings.HasSuffix(name, ".sql") && !strings.HasSuffix(name, ".down.sql")
+	}
+}
+
+// parseVersion returns the number before the first '_' of the file name
+func parseVersion(name string) (int64, error) {
+	i := strings.IndexByte(name, '_')
+	if i <= 0 {
+		return 0, fmt.Errorf("migration %s has no version prefix", name)
+	}
+
+	version, err := strconv.ParseInt(name[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("migration %s has invalid version: %w", name, err)
+	}
+
+	return version, nil
+}
+
+// gooseUp returns the statements between "-- +goose Up" and "-- +goose Down"
+func gooseUp(src string) (string, error) {
+	var b strings.Builder
+	inUp, foundUp := false, false
+
+	for _, line := range strings.SplitAfter(src, "\n") {
+		annotation := strings.TrimSpace(line)
+		if strings.HasPrefix(annotation, "-- +goose ") {
+			switch strings.TrimSpace(strings.TrimPrefix(annotation, "-- +goose ")) {
+			case "Up":
+				inUp, foundUp = true, true
+			case "Down":
+				inUp = false
+			}
+			continue
+		}
+
+		if inUp {
+			b.WriteString(line)
+		}
+	}
+
+	if !foundUp {
+		return "", fmt.Errorf("no -- +goose Up annotation")
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,158 @@
+package docker
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeMigrations(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	return dir
+}
+
+func migrationNames(migrations []migration) []string {
+	names := make([]string, len(migrations))
+	for i, m := range migrations {
+		names[i] = m.name
+	}
+	return names
+}
+
+func Test_loadMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  migrationFormat
+		files   map[string]string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:   "sql files ordered by name",
+			format: formatSQL,
+			files: map[string]string{
+				"02-data.sql":        "INSERT",
+				"01-schema.sql":      "CREATE",
+				"01-schema.down.sql": "DROP",
+				"readme.md":          "",
+			},
+			want: []string{"01-schema.sql", "02-data.sql"},
+		},
+		{
+			name:   "golang-migrate ordered by version",
+			format: formatGolangMigrate,
+			files: map[string]string{
+				"10_add_index.up.sql":      "CREATE INDEX",
+				"10_add_index.down.sql":    "DROP INDEX",
+				"2_create_table.up.sql":    "CREATE TABLE",
+				"2_create_table.down.sql":  "DROP TABLE",
+				"1_create_schema.up.sql":   "CREATE SCHEMA",
+				"1_create_schema.down.sql": "DROP SCHEMA",
+			},
+			want: []string{"1_create_schema.up.sql", "2_create_table.up.sql", "10_add_index.up.sql"},
+		},
+		{
+			name:   "golang-migrate duplicate version",
+			format: formatGolangMigrate,
+			files: map[string]string{
+				"1_a.up.sql": "",
+				"1_b.up.sql": "",
+			},
+			wantErr: "duplicate migration version 1",
+		},
+		{
+			name:   "goose without version",
+			format: formatGoose,
+			files: map[string]string{
+				"schema.sql": "-- +goose Up\n",
+			},
+			wantErr: "no version prefix",
+		},
+		{
+			name:   "goose without annotation",
+			format: formatGoose,
+			files: map[string]string{
+				"20230101000000_schema.sql": "CREATE TABLE mytable (id int);",
+			},
+			wantErr: "no -- +goose Up annotation",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadMigrations(writeMigrations(t, tt.files), tt.format)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, migrationNames(got))
+		})
+	}
+}
+
+func Test_gooseUp(t *testing.T) {
+	src := `-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE mytable (id int);
+-- +goose StatementEnd
+
+-- +goose Down
+DROP TABLE mytable;
+`
+	got, err := gooseUp(src)
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE mytable (id int);\n\n", got)
+}
+
+func Test_fileMigrator_Fingerprint(t *testing.T) {
+	dir := writeMigrations(t, map[string]string{"1_a.up.sql": "CREATE TABLE a (id int);"})
+
+	cfg := PostgresConfig{Migrator: GolangMigrate(dir)}
+	metadata := schemaMetadata(cfg)
+
+	want, err := MigrationFingerprint(dir)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{SchemaMetadataKey: want}, metadata)
+}
+
+func TestNewPostgreInDocker_migrator(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip need docker test")
+	}
+
+	dir := writeMigrations(t, map[string]string{
+		"1_create_table.up.sql":   "CREATE TABLE mytable (id serial, name varchar);",
+		"1_create_table.down.sql": "DROP TABLE mytable;",
+		"2_insert.up.sql":         "INSERT INTO mytable(name) VALUES ('Adrian');",
+	})
+
+	p, err := NewPostgreInDocker(PostgresConfig{
+		Migrator:            GolangMigrate(dir),
+		ContainerNameSuffix: t.Name(),
+	})
+	require.NoError(t, err)
+	defer p.Finish()
+
+	db, err := sql.Open("postgres", p.GetAddr())
+	require.NoError(t, err)
+	defer db.Close()
+
+	var count, version int
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM mytable").Scan(&count))
+	require.NoError(t, db.QueryRow("SELECT version FROM schema_migrations").Scan(&version))
+
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 2, version)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/cenkalti/backoff/v4"
@@ -33,17 +34,25 @@ type (
 	}
 
 	postgreInDocker struct {
-		pool     *dockertest.Pool
-		resource *dockertest.Resource
-		isDebug  bool
-		addr     string
-		logs     *strings.Builder
+		pool       *dockertest.Pool
+		resource   *dockertest.Resource
+		isDebug    bool
+		addr       string
+		logs       *logBuffer
+		migrator   Migrator
+		extensions []string
+		prepared   bool
 	}
 )
 
 func NewPostgreInDocker(cfg PostgresConfig) (PostgreInDocker, error) {
 	var err error
-	p := &postgreInDocker{isDebug: cfg.DebugMode, logs: &strings.Builder{}}
+	p := &postgreInDocker{
+		isDebug:    cfg.DebugMode,
+		logs:       newLogBuffer(cfg.LogLimit),
+		migrator:   cfg.Migrator,
+		extensions: cfg.Extensions,
+	}
 
 	p.pool, err = dockertest.NewPool(cfg.DockerEndpoint)
 	if err != nil {
@@ -53,6 +62,13 @@ func NewPostgreInDocker(cfg PostgresConfig) (PostgreInDocker, error) {
 	option := p.generatePostgreOption(cfg)
 	p.resource, err = p.pool.RunWithOptions(option, func(dcfg *docker.HostConfig) {
 		dcfg.AutoRemove = !cfg.KeepContainer
+		dcfg.Memory = cfg.Memory
+		dcfg.ShmSize = cfg.ShmSize
+		if cfg.CPUs > 0 {
+			// the same as docker run --cpus
+			dcfg.CPUPeriod = 100000
+			dcfg.CPUQuota = int64(cfg.CPUs * 100000)
+		}
 	})
 	if err != nil {
 		// TODO when are the best thing to remove some container
@@ -74,7 +90,7 @@ func NewPostgreInDocker(cfg PostgresConfig) (PostgreInDocker, error) {
 	_, err = p.pool.Client.AttachToContainerNonBlocking(docker.AttachToContainerOptions{
 		Container:    p.resource.Container.ID,
 		Stdout:       true,
-		Stderr:       false,
+		Stderr:       true,
 		Stream:       true,
 		Logs:         true,
 		OutputStream: p.logs,
@@ -126,6 +142,10 @@ func (p *postgreInDocker) GetLogs() string {
 	return p.logs.String()
 }
 
+func (p *postgreInDocker) logBuffer() *logBuffer {
+	return p.logs
+}
+
 func (p *postgreInDocker) WaitUntilReady() error {
 	// exponential backoff-retry, because the application in the container might not be ready to accept connections yet
 	retryNum := 0
@@ -175,11 +195,51 @@ func (p *postgreInDocker) WaitUntilReady() error {
 		return fmt.Errorf("trial aborted after %d times: %w", retryNum, err)
 	}
 
+	if p.prepared {
+		return nil
+	}
+
+	if err := prepareDatabase(p.addr, p.extensions, p.migrator); err != nil {
+		return err
+	}
+
+	p.prepared = true
 	return nil
 }
 
 func (p *postgreInDocker) generatePostgreOption(cfg PostgresConfig) *dockertest.RunOptions {
-	migrationPath := p.getMigrationPath(cfg)
+	repository := cfg.Repository
+	if repository == "" {
+		repository = "postgres"
+	}
+
+	env := []string{"POSTGRES_HOST_AUTH_METHOD=trust"}
+	if len(cfg.InitdbArgs) > 0 {
+		env = append(env, "POSTGRES_INITDB_ARGS="+strings.Join(cfg.InitdbArgs, " "))
+	}
+
+	var cmd []string
+	if settings := postgresSettings(cfg); len(settings) > 0 {
+		// the image entrypoint pass the arguments into postgres
+		cmd = append([]string{"postgres"}, settingArgs(settings)...)
+	}
+
+	// postgres with latest tags
+	option := &dockertest.RunOptions{
+		Repository: repository,
+		Env:        append(env, cfg.Env...),
+		Cmd:        cmd,
+		Labels:     cfg.Labels,
+		Name:       p.getContainerName(cfg),
+		Tag:        cfg.PostgresVersion,
+	}
+
+	// the Migrator run the migration after the container ready
+	if cfg.Migrator != nil {
+		return option
+	}
+
+	migrationPath := getMigrationPath(cfg)
 
 	if p.isDebug {
 		log.Println("use migration path in:", migrationPath)
@@ -195,18 +255,44 @@ func (p *postgreInDocker) generatePostgreOption(cfg PostgresConfig) *dockertest.
 	}
 
 	mount := sqlMigrationPath + ":/docker-entrypoint-initdb.d/"
+	option.Mounts = []string{mount}
 
-	// postgres with latest tags
-	return &dockertest.RunOptions{
-		Repository: "postgres",
-		Env:        []string{"POSTGRES_HOST_AUTH_METHOD=trust"},
-		Mounts:     []string{mount},
-		Name:       p.getContainerName(cfg),
-		Tag:        cfg.PostgresVersion,
+	return option
+}
+
+// postgresSettings returns the Settings with log_line_prefix, log_statement
+// and shared_preload_libraries
+func postgresSettings(cfg PostgresConfig) map[string]string {
+	settings := map[string]string{"log_line_prefix": logLinePrefix}
+	if cfg.LogStatements {
+		settings["log_statement"] = "all"
+	}
+	if len(cfg.SharedPreloadLibraries) > 0 {
+		settings["shared_preload_libraries"] = strings.Join(cfg.SharedPreloadLibraries, ",")
+	}
+
+	for k, v := range cfg.Settings {
+		settings[k] = v
+	}
+	return settings
+}
+
+// settingArgs returns -c key=value arguments of postgres, sorted by key
+func settingArgs(settings map[string]string) []string {
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+
+	args := make([]string, 0, len(keys)*2)
+	for _, k := range keys {
+		args = append(args, "-c", k+"="+settings[k])
+	}
+	return args
 }
 
-func (p *postgreInDocker) getMigrationPath(cfg PostgresConfig) string {
+func getMigrationPath(cfg PostgresConfig) string {
 	if cfg.MigrationPath != "" {
 		return cfg.MigrationPath
 	}
@@ -218,6 +304,19 @@ func (p *postgreInDocker) getMigrationPath(cfg PostgresConfig) string {
 	return "."
 }
 
+// absMigrationPath returns absolute path of migration path, it's used to
+// compare the migration of two config
+func absMigrationPath(cfg PostgresConfig) string {
+	path := getMigrationPath(cfg)
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+
+	return abs
+}
+
 func (p *postgreInDocker) getContainerName(cfg PostgresConfig) string {
 	return "pgsnap_test" + cfg.ContainerNameSuffix
 }
@@ -26,6 +26,71 @@ type (
 
 		// KeepContainer will keep the container when the container stop
 		KeepContainer bool
+
+		// Migrator apply the migration over connection instead of mounting
+		// MigrationPath into the container
+		Migrator Migrator
+
+		// Local use the postgres binaries installed in the machine instead
+		// of docker. It's also enabled by PGSNAP_LOCAL_POSTGRES=true
+		Local bool
+
+		// LocalBinDir is the directory of initdb and postgres binaries.
+		// Default is to find them in PATH
+		LocalBinDir string
+
+		// Repository is the docker image repository. Default "postgres"
+		Repository string
+
+		// Env is the extra environment variables of the container, like
+		// "POSTGRES_DB=mydb". Ignored by local postgres
+		Env []string
+
+		// InitdbArgs is the extra arguments of initdb, like "--locale=C"
+		InitdbArgs []string
+
+		// Settings is the postgres configuration that passed as -c
+		// key=value, like "max_connections": "200"
+		Settings map[string]string
+
+		// Memory is the memory limit of the container in bytes. Ignored by
+		// local postgres
+		Memory int64
+
+		// CPUs is the number of CPUs the container can use. Ignored by local
+		// postgres
+		CPUs float64
+
+		// ShmSize is the size of /dev/shm of the container in bytes. Ignored
+		// by local postgres
+		ShmSize int64
+
+		// Extensions is created by CREATE EXTENSION after postgres is ready,
+		// before the Migrator. It waits until the extensions are available
+		Extensions []string
+
+		// SharedPreloadLibraries is the shared_preload_libraries setting,
+		// needed by extensions like timescaledb or pg_stat_statements
+		SharedPreloadLibraries []string
+
+		// LogStatements set log_statement=all, so the logs contains every
+		// executed statement
+		LogStatements bool
+
+		// LogLimit is the maximum bytes of postgres logs that kept in memory.
+		// Default 1MB
+		LogLimit int
+
+		// Labels is the labels of the container
+		Labels map[string]string
+
+		// Versions is the postgres versions used by RunVersionMatrix
+		Versions []string
+
+		// Reuse keep the container after the test, and reuse it from other
+		// test binaries with the same setup and migration. Every test get
+		// its own database. It's also enabled by PGSNAP_REUSE=true
+		Reuse bool
 	}
 
 	Config struct {
@@ -36,6 +101,19 @@ type (
 	Options func(cfg *Config)
 )
 
+// newConfig returns the config of the test, with options applied
+func newConfig(name string, options ...Options) Config {
+	var cfg Config
+	cfg.Config = pgsnap.ConfigFromEnv()
+	cfg.ContainerNameSuffix = name
+
+	for _, o := range options {
+		o(&cfg)
+	}
+
+	return cfg
+}
+
 func WithDebug() Options {
 	return func(cfg *Config) {
 		cfg.PostgresConfig.DebugMode = true
@@ -48,3 +126,180 @@ func WithMigrationPath(path string) Options {
 		cfg.MigrationPath = path
 	}
 }
+
+// WithDockerEndpoint set the endpoint to connect to docker
+func WithDockerEndpoint(endpoint string) Options {
+	return func(cfg *Config) {
+		cfg.DockerEndpoint = endpoint
+	}
+}
+
+// WithPostgresVersion set the version (image tag) of postgres
+func WithPostgresVersion(version string) Options {
+	return func(cfg *Config) {
+		cfg.PostgresVersion = version
+	}
+}
+
+// WithRepository set the docker image repository, like "postgis/postgis"
+func WithRepository(repository string) Options {
+	return func(cfg *Config) {
+		cfg.Repository = repository
+	}
+}
+
+// WithImage set the repository and the tag of the docker image, like
+// "postgis/postgis:15-3.4" or "timescale/timescaledb:latest-pg15"
+func WithImage(image string) Options {
+	return func(cfg *Config) {
+		cfg.Repository, cfg.PostgresVersion = splitImage(image)
+	}
+}
+
+// WithExtensions create the extensions after postgres is ready
+func WithExtensions(extensions ...string) Options {
+	return func(cfg *Config) {
+		cfg.Extensions = append(cfg.Extensions, extensions...)
+	}
+}
+
+// WithSharedPreloadLibraries add libraries into shared_preload_libraries
+func WithSharedPreloadLibraries(libraries ...string) Options {
+	return func(cfg *Config) {
+		cfg.SharedPreloadLibraries = append(cfg.SharedPreloadLibraries, libraries...)
+	}
+}
+
+// WithLogStatements log every statement in postgres logs, the logs are
+// shown when the test failed
+func WithLogStatements() Options {
+	return func(cfg *Config) {
+		cfg.LogStatements = true
+	}
+}
+
+// WithKeepContainer keep the container when it's stopped
+func WithKeepContainer() Options {
+	return func(cfg *Config) {
+		cfg.KeepContainer = true
+	}
+}
+
+// WithEnv add environment variables in KEY=value format into the container
+func WithEnv(env ...string) Options {
+	return func(cfg *Config) {
+		cfg.Env = append(cfg.Env, env...)
+	}
+}
+
+// WithInitdbArgs add extra arguments of initdb
+func WithInitdbArgs(args ...string) Options {
+	return func(cfg *Config) {
+		cfg.InitdbArgs = append(cfg.InitdbArgs, args...)
+	}
+}
+
+// WithSetting set postgres configuration, like WithSetting("fsync", "off")
+func WithSetting(key, value string) Options {
+	return func(cfg *Config) {
+		if cfg.Settings == nil {
+			cfg.Settings = map[string]string{}
+		}
+		cfg.Settings[key] = value
+	}
+}
+
+// WithResources limit the memory (in bytes) and the CPUs of the container.
+// Zero means unlimited
+func WithResources(memory int64, cpus float64) Options {
+	return func(cfg *Config) {
+		cfg.Memory = memory
+		cfg.CPUs = cpus
+	}
+}
+
+// WithShmSize set the size of /dev/shm of the container in bytes
+func WithShmSize(size int64) Options {
+	return func(cfg *Config) {
+		cfg.ShmSize = size
+	}
+}
+
+// WithVersions set the postgres versions of RunVersionMatrix
+func WithVersions(versions ...string) Options {
+	return func(cfg *Config) {
+		cfg.Versions = append(cfg.Versions, versions...)
+	}
+}
+
+// WithReuse reuse the container across test binaries, see
+// PostgresConfig.Reuse
+func WithReuse() Options {
+	return func(cfg *Config) {
+		cfg.Reuse = true
+	}
+}
+
+// WithMigrator set the Migrator that apply the migration, for example
+// WithMigrator(GolangMigrate("./migrations"))
+func WithMigrator(m Migrator) Options {
+	return func(cfg *Config) {
+		cfg.Migrator = m
+	}
+}
+
+// WithLocalPostgres use the postgres binaries in binDir instead of docker,
+// or in PATH when binDir is empty
+func WithLocalPostgres(binDir string) Options {
+	return func(cfg *Config) {
+		cfg.Local = true
+		cfg.LocalBinDir = binDir
+	}
+}
+
+// WithFixtures load the fixtures before recording, see pgsnap.Config.Fixtures
+func WithFixtures(paths ...string) Options {
+	return func(cfg *Config) {
+		cfg.Fixtures = append(cfg.Fixtures, paths...)
+	}
+}
+
+// WithOnStale set what to do when the snapshot is recorded with different
+// migration
+func WithOnStale(policy pgsnap.StalePolicy) Options {
+	return func(cfg *Config) {
+		cfg.OnStale = policy
+	}
+}
+
+// WithSnapshotLevel set what saved into the snapshot when recording, see
+// pgsnap.Config.Level
+func WithSnapshotLevel(level pgsnap.SnapshotLevel) Options {
+	return func(cfg *Config) {
+		cfg.Level = level
+	}
+}
+
+// WithBlobThreshold save the values larger than size bytes outside the
+// snapshot, see pgsnap.Config.BlobThreshold
+func WithBlobThreshold(size int) Options {
+	return func(cfg *Config) {
+		cfg.BlobThreshold = size
+	}
+}
+
+// WithHybrid replay the snapshot, and record the queries that are not in the
+// snapshot from the database, see pgsnap.Config.Hybrid
+func WithHybrid() Options {
+	return func(cfg *Config) {
+		cfg.Hybrid = true
+	}
+}
+
+// WithAuth require the client to authenticate with the user and password,
+// see pgsnap.Config.Auth
+func WithAuth(method pgsnap.AuthMethod, user, password string) Options {
+	return func(cfg *Config) {
+		cfg.Auth = pgsnap.Auth{Method: method, User: user, Password: password}
+	}
+}
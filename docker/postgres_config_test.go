@@ -0,0 +1,73 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newConfig(t *testing.T) {
+	cfg := newConfig("TestSomething",
+		WithPostgresVersion("14"),
+		WithRepository("postgis/postgis"),
+		WithEnv("POSTGRES_DB=mydb"),
+		WithInitdbArgs("--locale=C"),
+		WithSetting("fsync", "off"),
+		WithSetting("max_connections", "200"),
+		WithResources(1<<30, 1.5),
+		WithFixtures("a.sql"),
+	)
+
+	assert.Equal(t, "TestSomething", cfg.ContainerNameSuffix)
+	assert.Equal(t, "14", cfg.PostgresVersion)
+	assert.Equal(t, "postgis/postgis", cfg.Repository)
+	assert.Equal(t, []string{"POSTGRES_DB=mydb"}, cfg.Env)
+	assert.Equal(t, []string{"--locale=C"}, cfg.InitdbArgs)
+	assert.Equal(t, map[string]string{"fsync": "off", "max_connections": "200"}, cfg.Settings)
+	assert.Equal(t, int64(1<<30), cfg.Memory)
+	assert.Equal(t, 1.5, cfg.CPUs)
+	assert.Equal(t, []string{"a.sql"}, cfg.Fixtures)
+
+	cfg = newConfig("TestSomething",
+		WithImage("timescale/timescaledb:latest-pg15"),
+		WithExtensions("timescaledb"),
+		WithSharedPreloadLibraries("timescaledb"),
+	)
+
+	assert.Equal(t, "timescale/timescaledb", cfg.Repository)
+	assert.Equal(t, "latest-pg15", cfg.PostgresVersion)
+	assert.Equal(t, []string{"timescaledb"}, cfg.Extensions)
+	assert.Equal(t, []string{"timescaledb"}, cfg.SharedPreloadLibraries)
+}
+
+func Test_generatePostgreOption(t *testing.T) {
+	p := &postgreInDocker{}
+	option := p.generatePostgreOption(PostgresConfig{
+		Repository:      "postgis/postgis",
+		PostgresVersion: "14-3.3",
+		Env:             []string{"POSTGRES_DB=mydb"},
+		InitdbArgs:      []string{"--locale=C", "--data-checksums"},
+		Settings:        map[string]string{"max_connections": "200", "fsync": "off"},
+		Migrator:        SQLFiles("./sqlschema"),
+	})
+
+	assert.Equal(t, "postgis/postgis", option.Repository)
+	assert.Equal(t, "14-3.3", option.Tag)
+	assert.Equal(t, []string{
+		"POSTGRES_HOST_AUTH_METHOD=trust",
+		"POSTGRES_INITDB_ARGS=--locale=C --data-checksums",
+		"POSTGRES_DB=mydb",
+	}, option.Env)
+	assert.Equal(t, []string{
+		"postgres",
+		"-c", "fsync=off",
+		"-c", "log_line_prefix=" + logLinePrefix,
+		"-c", "max_connections=200",
+	}, option.Cmd)
+	assert.Empty(t, option.Mounts)
+
+	option = p.generatePostgreOption(PostgresConfig{MigrationPath: "./sqlschema"})
+	assert.Equal(t, "postgres", option.Repository)
+	assert.Equal(t, []string{"postgres", "-c", "log_line_prefix=" + logLinePrefix}, option.Cmd)
+	assert.Len(t, option.Mounts, 1)
+}
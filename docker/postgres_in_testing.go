@@ -4,6 +4,7 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/egon12/pgsnap"
@@ -15,19 +16,41 @@ func GetAddr() string {
 	return addrInM
 }
 
-func RunPostgreInM(m *testing.M) {
+// RunPostgreInM run a postgres that shared by the tests in the package.
+// The tests that use RunPostgreInT or NewSnapWithDocker with the same
+// migration and postgres setup get a database cloned from it.
+func RunPostgreInM(m *testing.M, options ...Options) {
 	flag.Parse()
 	if testing.Short() {
 		os.Exit(m.Run())
 	}
 
-	p, err := NewPostgreInDocker(PostgresConfig{DebugMode: false})
+	cfg := newConfig("", options...)
+
+	if reuseEnabled(cfg.PostgresConfig) {
+		d, err := reusedTemplate(cfg.PostgresConfig)
+		if err == nil {
+			runInReusedContainer(m, d)
+			return
+		}
+		log.Printf("cannot reuse container, create new one: %v", err)
+	}
+
+	p, err := newPostgres(cfg.PostgresConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer p.Finish()
 	addrInM = p.GetAddr()
 
+	shared, err = newTemplateDatabase(addrInM, sharedKey(cfg.PostgresConfig))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ls, ok := p.(logSource); ok {
+		shared.logs = ls.logBuffer()
+	}
+
 	code := m.Run()
 
 	err = p.Finish()
@@ -38,51 +61,99 @@ func RunPostgreInM(m *testing.M) {
 	os.Exit(code)
 }
 
+// runInReusedContainer run the tests with the reused container, the package
+// get its own database that dropped after the tests
+func runInReusedContainer(m *testing.M, d *templateDatabase) {
+	shared = d
+
+	addr, drop, err := shared.NewDatabase()
+	if err != nil {
+		log.Fatal(err)
+	}
+	addrInM = addr
+
+	code := m.Run()
+
+	if err := drop(); err != nil {
+		log.Fatal(err)
+	}
+
+	os.Exit(code)
+}
+
+// RunPostgreInT returns address of postgres that can be used in the test.
+// When RunPostgreInM is used, it will be a new database cloned from the
+// migrated template in the shared container. Otherwise it will create a new
+// container for the test.
 func RunPostgreInT(t *testing.T, options ...Options) (string, func() error, error) {
 	if testing.Short() {
 		t.Skip("skip need docker test")
 	}
 
-	p, err := NewPostgreInDocker(PostgresConfig{
-		DebugMode:           false,
-		ContainerNameSuffix: t.Name(),
-	})
-	return p.GetAddr(), p.Finish, err
+	cfg := newConfig(t.Name(), options...)
+
+	db, err := newDatabase(cfg.PostgresConfig)
+	if err != nil {
+		return "", func() error { return nil }, err
+	}
+
+	dumpLogsOnFailure(t, db, nil)
+
+	return db.addr, db.drop, nil
 }
 
 func NewSnapWithDocker(t *testing.T, options ...Options) (*pgsnap.Snap, error) {
 	t.Helper()
 
-	var addr string
-	var finish func() error
+	var db *database
+
+	cfg := newConfig(t.Name(), append([]Options{WithKeepContainer()}, options...)...)
 
-	var cfg Config
-	cfg.ContainerNameSuffix = t.Name()
-	cfg.KeepContainer = true
+	if cfg.Metadata == nil {
+		cfg.Metadata = map[string]string{}
+	}
+	for k, v := range schemaMetadata(cfg.PostgresConfig) {
+		cfg.Metadata[k] = v
+	}
 
-	for _, o := range options {
-		o(&cfg)
+	fixtures, err := pgsnap.FixturesMetadata(cfg.Fixtures)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range fixtures {
+		cfg.Metadata[k] = v
 	}
 
-	if cfg.ForceWrite || !pgsnap.IsSnapshotExists(t) {
+	rerecord := cfg.OnStale == pgsnap.StaleRerecord && pgsnap.IsSnapshotStale(t, cfg.Metadata)
+
+	if cfg.ForceWrite || rerecord || !pgsnap.IsSnapshotExists(t) {
 		if testing.Short() {
 			t.Skip("skip need docker test")
 		}
 
-		p, err := NewPostgreInDocker(cfg.PostgresConfig)
+		db, err = newDatabase(cfg.PostgresConfig)
 		if err != nil {
 			return nil, err
 		}
-		addr = p.GetAddr()
-		finish = p.Finish
 	}
 
-	snap := pgsnap.NewSnap(t, addr)
+	// in hybrid mode, the database is needed when the client send the
+	// query that is not in the snapshot
+	if db == nil && cfg.Hybrid && !testing.Short() {
+		db, err = newDatabase(cfg.PostgresConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	if finish != nil {
-		snap.AddFinishFunc(finish)
+	if db == nil {
+		return pgsnap.NewSnapWithConfig(t, "", cfg.Config), nil
 	}
 
+	snap := pgsnap.NewSnapWithConfig(t, db.addr, cfg.Config)
+	snap.AddFinishFunc(db.drop)
+	dumpLogsOnFailure(t, db, snap.Queries)
+
 	return snap, nil
 }
 
@@ -94,3 +165,75 @@ func NewPgSnapDocker(t *testing.T, options ...Options) *pgsnap.Snap {
 	}
 	return snap
 }
+
+// database is the postgres database of a test
+type database struct {
+	addr string
+	drop func() error
+
+	// logs returns the postgres logs of the database
+	logs func() string
+}
+
+// newDatabase returns a database cloned from template when the shared
+// container have the same setup, otherwise it will create new container
+func newDatabase(cfg PostgresConfig) (*database, error) {
+	if shared.matches(cfg) {
+		return shared.database()
+	}
+
+	if reuseEnabled(cfg) {
+		if d, err := reusedTemplate(cfg); err == nil {
+			return d.database()
+		} else if cfg.DebugMode {
+			log.Printf("cannot reuse container: %v", err)
+		}
+	}
+
+	p, err := newPostgres(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &database{addr: p.GetAddr(), drop: p.Finish, logs: p.GetLogs}, nil
+}
+
+// dumpLogsOnFailure show the postgres logs when the test failed. The logs
+// of the failed queries are shown first
+func dumpLogsOnFailure(t *testing.T, db *database, queries func() []pgsnap.Query) {
+	t.Cleanup(func() {
+		if !t.Failed() {
+			return
+		}
+
+		logs := db.logs()
+		if logs == "" {
+			return
+		}
+
+		if queries != nil {
+			for _, q := range queries() {
+				if q.Err == nil {
+					continue
+				}
+
+				if lines := correlateQuery(logs, q.SQL); len(lines) > 0 {
+					t.Logf("postgres logs of failed query %s:\n%s", q.SQL, strings.Join(lines, "\n"))
+				}
+			}
+		}
+
+		t.Logf("postgres logs:\n%s", logs)
+	})
+}
+
+// newPostgres run postgres in docker, or in local when it's configured
+func newPostgres(cfg PostgresConfig) (PostgreInDocker, error) {
+	if isLocal(cfg) {
+		return NewPostgreInLocal(cfg)
+	}
+	return NewPostgreInDocker(cfg)
+}
+
+func isLocal(cfg PostgresConfig) bool {
+	return cfg.Local || os.Getenv("PGSNAP_LOCAL_POSTGRES") == "true"
+}
@@ -0,0 +1,251 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	dockertest "github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+const (
+	// reuseKeyLabel is the container label that contains the reuseKey
+	reuseKeyLabel = "pgsnap.reuse.key"
+
+	// lockTimeout is how long a process wait for the other process that
+	// preparing the shared container, it includes pulling the image
+	lockTimeout = 5 * time.Minute
+
+	// lockRefresh is how often the held lock file is touched, so it's not
+	// considered stale while the container is prepared
+	lockRefresh = 10 * time.Second
+
+	// lockStaleAfter is the age of lock file that considered left by
+	// killed process, it's not touched for a few lockRefresh
+	lockStaleAfter = 6 * lockRefresh
+)
+
+var (
+	reusedMu sync.Mutex
+
+	// reused is the template database in the reused container by key, so
+	// one process only prepare it once
+	reused = map[string]*templateDatabase{}
+)
+
+// reuseEnabled returns true when the container should be reused across test
+// binaries
+func reuseEnabled(cfg PostgresConfig) bool {
+	return !isLocal(cfg) && (cfg.Reuse || os.Getenv("PGSNAP_REUSE") == "true")
+}
+
+// reuseKey identify the reused container by the postgres setup and the
+// content of the migration. It returns false when the migration content
+// cannot be known, so the container cannot be reused safely.
+func reuseKey(cfg PostgresConfig) (string, bool) {
+	key := sharedKey(cfg)
+	if key == "" {
+		return "", false
+	}
+
+	fingerprint, ok := migrationFingerprint(cfg)
+	if !ok {
+		return "", false
+	}
+
+	h := sha256.Sum256([]byte(key + "|" + fingerprint))
+	return hex.EncodeToString(h[:])[:12], true
+}
+
+// reusedTemplate returns template database in the labelled container that
+// shared by every test binaries with the same setup. The container is
+// created when it's not exists, and it's never removed by pgsnap.
+func reusedTemplate(cfg PostgresConfig) (*templateDatabase, error) {
+	key, ok := reuseKey(cfg)
+	if !ok {
+		return nil, fmt.Errorf("cannot reuse container, the migration has no fingerprint")
+	}
+
+	reusedMu.Lock()
+	defer reusedMu.Unlock()
+
+	if d, ok := reused[key]; ok {
+		return d, nil
+	}
+
+	// other test binaries might be preparing the same container
+	unlock, err := lockFile(filepath.Join(os.TempDir(), "pgsnap_"+key+".lock"), lockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	addr, logs, err := reusedContainer(cfg, key)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := openTemplateDatabase(addr, sharedKey(cfg))
+	if err != nil {
+		return nil, err
+	}
+	d.logs = logs
+
+	reused[key] = d
+	return d, nil
+}
+
+// reusedContainer find the running container with the key, or create it.
+// It returns the address and the logs since it's used by this process
+func reusedContainer(cfg PostgresConfig, key string) (string, *logBuffer, error) {
+	cfg.ContainerNameSuffix = "_reuse_" + key
+	cfg.KeepContainer = true
+	cfg.Labels = mergeLabels(cfg.Labels, map[string]string{reuseKeyLabel: key})
+
+	pool, err := dockertest.NewPool(cfg.DockerEndpoint)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot connect to docker endpoint (%s) %w", cfg.DockerEndpoint, err)
+	}
+
+	name := (&postgreInDocker{}).getContainerName(cfg)
+
+	resource, ok := pool.ContainerByName(name)
+	if ok && resource.Container.State.Running && resource.Container.Config.Labels[reuseKeyLabel] == key {
+		addr := fmt.Sprintf(addrTmpl, resource.GetPort("5432/tcp"))
+		if err := pool.Retry(func() error { return ping(addr) }); err != nil {
+			return "", nil, fmt.Errorf("reused container %s is not ready: %w", name, err)
+		}
+
+		logs := newLogBuffer(cfg.LogLimit)
+		_, err := pool.Client.AttachToContainerNonBlocking(docker.AttachToContainerOptions{
+			Container:    resource.Container.ID,
+			Stdout:       true,
+			Stderr:       true,
+			Stream:       true,
+			OutputStream: logs,
+			ErrorStream:  logs,
+		})
+		if err != nil {
+			log.Printf("Could not attach to container: %v", err)
+		}
+
+		return addr, logs, nil
+	}
+
+	if ok {
+		// stopped container with the same name, create it again
+		if err := pool.Purge(resource); err != nil {
+			return "", nil, fmt.Errorf("cannot remove stopped container %s: %w", name, err)
+		}
+	}
+
+	p, err := NewPostgreInDocker(cfg)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return p.GetAddr(), p.(*postgreInDocker).logs, nil
+}
+
+// lockFile create the lock file exclusively, and wait when it's already
+// exists. The lock file that older than lockStaleAfter is removed.
+func lockFile(path string, timeout time.Duration) (func() error, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			_, _ = fmt.Fprintf(f, "%d\n", os.Getpid())
+			_ = f.Close()
+
+			stop := refreshLock(path, lockRefresh)
+			return func() error {
+				stop()
+				return os.Remove(path)
+			}, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("cannot create lock %s: %w", path, err)
+		}
+
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > lockStaleAfter {
+			_ = os.Remove(path)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout waiting lock %s, remove it when no test is running", path)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// refreshLock touch the lock file periodically until stop is called
+func refreshLock(path string, every time.Duration) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := time.Now()
+				_ = os.Chtimes(path, now, now)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// openTemplateDatabase use the template database in the reused container,
+// or create it when it's not exists yet
+func openTemplateDatabase(addr, key string) (*templateDatabase, error) {
+	db, err := sql.Open("postgres", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var exists bool
+	err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", templateName).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("cannot check template database: %w", err)
+	}
+
+	if exists {
+		return &templateDatabase{addr: addr, key: key}, nil
+	}
+
+	return newTemplateDatabase(addr, key)
+}
+
+func mergeLabels(a, b map[string]string) map[string]string {
+	m := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		m[k] = v
+	}
+	for k, v := range b {
+		m[k] = v
+	}
+	return m
+}
@@ -0,0 +1,91 @@
+package docker
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_lockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pgsnap.lock")
+
+	unlock, err := lockFile(path, time.Second)
+	require.NoError(t, err)
+
+	_, err = lockFile(path, 50*time.Millisecond)
+	assert.Error(t, err)
+
+	require.NoError(t, unlock())
+
+	unlock, err = lockFile(path, time.Second)
+	require.NoError(t, err)
+
+	// lock left by killed process
+	old := time.Now().Add(-lockStaleAfter - time.Minute)
+	require.NoError(t, os.Chtimes(path, old, old))
+
+	unlockStale, err := lockFile(path, 50*time.Millisecond)
+	require.NoError(t, err)
+	require.NoError(t, unlockStale())
+	assert.Error(t, unlock())
+}
+
+// the held lock is not considered stale by the other process
+func Test_refreshLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pgsnap.lock")
+	require.NoError(t, os.WriteFile(path, nil, 0o644))
+
+	old := time.Now().Add(-lockStaleAfter - time.Minute)
+	require.NoError(t, os.Chtimes(path, old, old))
+
+	stop := refreshLock(path, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		info, err := os.Stat(path)
+		return err == nil && time.Since(info.ModTime()) < lockStaleAfter
+	}, time.Second, 10*time.Millisecond)
+	stop()
+
+	assert.Less(t, lockStaleAfter, lockTimeout)
+}
+
+type customMigrator struct{}
+
+func (customMigrator) Migrate(context.Context, *sql.DB) error { return nil }
+
+func Test_reuseKey(t *testing.T) {
+	dir := writeMigrations(t, map[string]string{"1_a.up.sql": "CREATE TABLE a (id int);"})
+	cfg := PostgresConfig{Migrator: GolangMigrate(dir)}
+
+	key, ok := reuseKey(cfg)
+	require.True(t, ok)
+	assert.Len(t, key, 12)
+
+	same, _ := reuseKey(PostgresConfig{Migrator: GolangMigrate(dir), ContainerNameSuffix: "TestOther"})
+	assert.Equal(t, key, same)
+
+	version, _ := reuseKey(PostgresConfig{Migrator: GolangMigrate(dir), PostgresVersion: "13"})
+	assert.NotEqual(t, key, version)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "2_b.up.sql"), []byte("CREATE TABLE b (id int);"), 0o644))
+	changed, _ := reuseKey(cfg)
+	assert.NotEqual(t, key, changed)
+
+	_, ok = reuseKey(PostgresConfig{Migrator: customMigrator{}})
+	assert.False(t, ok)
+}
+
+func Test_reuseEnabled(t *testing.T) {
+	t.Setenv("PGSNAP_REUSE", "")
+	assert.False(t, reuseEnabled(PostgresConfig{}))
+	assert.True(t, reuseEnabled(PostgresConfig{Reuse: true}))
+	assert.False(t, reuseEnabled(PostgresConfig{Reuse: true, Local: true}))
+
+	t.Setenv("PGSNAP_REUSE", "true")
+	assert.True(t, reuseEnabled(PostgresConfig{}))
+}
@@ -0,0 +1,198 @@
+package docker
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+const templateName = "pgsnap_template"
+
+type (
+	// templateDatabase hand out database for every test, cloned from the
+	// template database that already migrated. So the tests that running
+	// in parallel don't share the same mutable database.
+	templateDatabase struct {
+		mu      sync.Mutex
+		addr    string
+		key     string
+		counter int
+
+		// logs is the logs of the container, can be nil
+		logs *logBuffer
+	}
+)
+
+// shared is filled by RunPostgreInM
+var shared *templateDatabase
+
+// newTemplateDatabase copy the migrated postgres database (the default one)
+// into template database. addr is the address of the postgres database and
+// key is the sharedKey of the container
+func newTemplateDatabase(addr, key string) (*templateDatabase, error) {
+	// we cannot connect to the database that will be the source of
+	// CREATE DATABASE, so use template1 instead
+	db, err := sql.Open("postgres", withDatabase(addr, "template1"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	queries := []string{
+		"DROP DATABASE IF EXISTS " + templateName,
+		"CREATE DATABASE " + templateName + " TEMPLATE postgres",
+		"ALTER DATABASE " + templateName + " WITH IS_TEMPLATE true ALLOW_CONNECTIONS false",
+	}
+
+	for _, q := range queries {
+		if _, err := db.Exec(q); err != nil {
+			return nil, fmt.Errorf("cannot prepare template database (%s): %w", q, err)
+		}
+	}
+
+	return &templateDatabase{addr: addr, key: key}, nil
+}
+
+// NewDatabase clone the template database, and returns the address and the
+// function to drop it. The drop function is never nil, so it's safe to be
+// deferred before checking the error
+func (d *templateDatabase) NewDatabase() (string, func() error, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	noop := func() error { return nil }
+
+	d.counter++
+	name := fmt.Sprintf("pgsnap_%d_%d", os.Getpid(), d.counter)
+
+	db, err := sql.Open("postgres", d.addr)
+	if err != nil {
+		return "", noop, err
+	}
+	defer db.Close()
+
+	// CREATE DATABASE cannot use placeholder
+	_, err = db.Exec("CREATE DATABASE " + pq.QuoteIdentifier(name) + " TEMPLATE " + templateName)
+	if err != nil {
+		return "", noop, fmt.Errorf("cannot clone template database into %s: %w", name, err)
+	}
+
+	drop := func() error {
+		return d.dropDatabase(name)
+	}
+
+	return withDatabase(d.addr, name), drop, nil
+}
+
+// database clone the template database, with the logs filtered by the
+// database name
+func (d *templateDatabase) database() (*database, error) {
+	offset := d.logs.Offset()
+
+	addr, drop, err := d.NewDatabase()
+	if err != nil {
+		return nil, err
+	}
+
+	name := databaseName(addr)
+	logs := func() string {
+		return filterDatabase(d.logs.Since(offset), name)
+	}
+
+	return &database{addr: addr, drop: drop, logs: logs}, nil
+}
+
+func (d *templateDatabase) dropDatabase(name string) error {
+	db, err := sql.Open("postgres", d.addr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// the connection from the test might be still open
+	_, err = db.Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1", name)
+	if err != nil {
+		return fmt.Errorf("cannot terminate connection to %s: %w", name, err)
+	}
+
+	_, err = db.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(name))
+	if err != nil {
+		return fmt.Errorf("cannot drop database %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// matches check whether the test can use the template database, the test
+// should have the same migration and postgres setup as the shared container
+func (d *templateDatabase) matches(cfg PostgresConfig) bool {
+	key := sharedKey(cfg)
+	return d != nil && key != "" && d.key == key
+}
+
+// sharedKey identify the migration and the postgres setup of the container.
+// It returns empty string when the migration cannot be identified.
+func sharedKey(cfg PostgresConfig) string {
+	migration := migrationKey(cfg)
+	if migration == "" {
+		return ""
+	}
+
+	repository := cfg.Repository
+	if repository == "" {
+		repository = "postgres"
+	}
+
+	env := append([]string{}, cfg.Env...)
+	sort.Strings(env)
+
+	return strings.Join([]string{
+		migration,
+		repository + ":" + cfg.PostgresVersion,
+		strconv.FormatBool(cfg.Local) + ":" + cfg.LocalBinDir,
+		strings.Join(env, ","),
+		strings.Join(cfg.InitdbArgs, " "),
+		strings.Join(settingArgs(postgresSettings(cfg)), " "),
+		strings.Join(cfg.Extensions, ","),
+		fmt.Sprint(cfg.Memory, cfg.CPUs, cfg.ShmSize),
+	}, "|")
+}
+
+// migrationKey identify how the container is migrated. It returns empty
+// string when it cannot be known, for example custom Migrator.
+func migrationKey(cfg PostgresConfig) string {
+	if cfg.Migrator == nil {
+		return absMigrationPath(cfg)
+	}
+
+	m, ok := cfg.Migrator.(*fileMigrator)
+	if !ok {
+		return ""
+	}
+
+	dir, err := filepath.Abs(m.dir)
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%d:%s", m.format, dir)
+}
+
+// withDatabase change the database in postgres address
+func withDatabase(addr, database string) string {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return addr
+	}
+
+	u.Path = "/" + database
+	return u.String()
+}
@@ -0,0 +1,37 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_withDatabase(t *testing.T) {
+	assert.Equal(t,
+		"postgres://postgres@127.0.0.1:5432/pgsnap_1_2?sslmode=disable",
+		withDatabase("postgres://postgres@127.0.0.1:5432/?sslmode=disable", "pgsnap_1_2"),
+	)
+
+	assert.Equal(t,
+		"postgres://postgres@127.0.0.1:5432/template1?sslmode=disable",
+		withDatabase("postgres://postgres@127.0.0.1:5432/postgres?sslmode=disable", "template1"),
+	)
+}
+
+func Test_templateDatabase_matches(t *testing.T) {
+	var d *templateDatabase
+	assert.False(t, d.matches(PostgresConfig{}))
+
+	d = &templateDatabase{key: sharedKey(PostgresConfig{MigrationPath: "./sqlschema"})}
+	assert.True(t, d.matches(PostgresConfig{MigrationPath: "sqlschema/"}))
+	assert.True(t, d.matches(PostgresConfig{MigrationPath: "sqlschema/", Repository: "postgres", ContainerNameSuffix: "Test"}))
+	assert.False(t, d.matches(PostgresConfig{MigrationPath: "./wrong_schema"}))
+	assert.False(t, d.matches(PostgresConfig{Migrator: SQLFiles("./sqlschema")}))
+	assert.False(t, d.matches(PostgresConfig{MigrationPath: "./sqlschema", PostgresVersion: "13"}))
+	assert.False(t, d.matches(PostgresConfig{MigrationPath: "./sqlschema", Settings: map[string]string{"fsync": "off"}}))
+	assert.False(t, d.matches(PostgresConfig{MigrationPath: "./sqlschema", Memory: 1 << 30}))
+
+	d = &templateDatabase{key: sharedKey(PostgresConfig{Migrator: GolangMigrate("./sqlschema")})}
+	assert.True(t, d.matches(PostgresConfig{Migrator: GolangMigrate("sqlschema/")}))
+	assert.False(t, d.matches(PostgresConfig{Migrator: Goose("./sqlschema")}))
+}
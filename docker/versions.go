@@ -0,0 +1,66 @@
+package docker
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/egon12/pgsnap"
+)
+
+// RunVersionMatrix run f in a subtest for every postgres version set by
+// WithVersions, or PGSNAP_VERSIONS (comma separated). Every version has its
+// own snapshot. After all versions are run, the results of the queries are
+// compared with the first version, and the differences are reported as
+// error.
+func RunVersionMatrix(t *testing.T, f func(t *testing.T, s *pgsnap.Snap), options ...Options) {
+	t.Helper()
+
+	versions := newConfig(t.Name(), options...).Versions
+	if len(versions) == 0 {
+		versions = splitVersions(os.Getenv("PGSNAP_VERSIONS"))
+	}
+	if len(versions) == 0 {
+		t.Fatal("pgsnap: no postgres version, use WithVersions or PGSNAP_VERSIONS")
+	}
+
+	results := map[string][]pgsnap.Query{}
+
+	for _, v := range versions {
+		v := v
+		t.Run("pg"+v, func(t *testing.T) {
+			s := NewPgSnapDocker(t, append(options, WithPostgresVersion(v))...)
+
+			// the queries is complete after Finish
+			func() {
+				defer s.Finish()
+				f(t, s)
+			}()
+
+			results[v] = s.Queries()
+		})
+	}
+
+	base := versions[0]
+	for _, v := range versions[1:] {
+		a, okA := results[base]
+		b, okB := results[v]
+		if !okA || !okB {
+			continue
+		}
+
+		for _, d := range pgsnap.DiffQueries(a, b) {
+			t.Errorf("pgsnap: pg%s and pg%s are different at %s", base, v, d)
+		}
+	}
+}
+
+func splitVersions(s string) []string {
+	var versions []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
@@ -0,0 +1,12 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_splitVersions(t *testing.T) {
+	assert.Equal(t, []string{"12", "16-alpine"}, splitVersions(" 12, ,16-alpine "))
+	assert.Nil(t, splitVersions(""))
+}
@@ -1,9 +1,11 @@
 package pgsnap
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
-	"testing"
 	"time"
 
 	"github.com/jackc/pgmock"
@@ -12,25 +14,71 @@ import (
 
 type (
 	server struct {
-		t       testing.TB
+		r       Reporter
+		queries *queryLog
 		l       net.Listener
 		done    chan<- struct{}
 		isDebug bool
-		wg      sync.WaitGroup
+
+		// ctx is cancelled when the test is finished, the goroutines in
+		// wg exit after the client connection is closed
+		ctx context.Context
+		wg  sync.WaitGroup
+
+		// doneOnce guard done, it's sent when the script is replayed or
+		// the connection is finished
+		doneOnce sync.Once
+
+		// activity is reported when the test timeout
+		activity *activity
+
+		// stepTimeout is how long a step waits for the client message,
+		// zero means no limit
+		stepTimeout time.Duration
+
+		// auth is required from the client before the replay
+		auth Auth
+
+		// recordedAuth is the authentications in the snapshot, they are
+		// compared with the client ones. authReplayed is how many of them
+		// already compared
+		recordedAuth []authAttempt
+		authReplayed int
+
+		// hybrid is filled when the unmatched message should be proxied
+		// to the database, instead of failing the test
+		hybrid *hybrid
+
+		// conn is the client connection, it's owned by the server and
+		// closed on finish. In hybrid mode, it's owned by the proxy too
+		// after the switch
+		mu       sync.Mutex
+		conn     net.Conn
+		finished bool
 	}
 )
 
+// authenticationSteps is the number of steps in the head of the script that
+// receive the startup message and send AuthenticationOk. They are replaced by
+// Auth, the rest of the startup is replayed from the script
+const authenticationSteps = 2
+
 // newServer will create FakePostgresServer with errchan and donechan
-func newServer(l net.Listener,
+func newServer(ctx context.Context,
+	l net.Listener,
 	done chan<- struct{},
-	t testing.TB,
+	r Reporter,
+	queries *queryLog,
 	isDebug bool,
 ) *server {
 	return &server{
-		l:       l,
-		done:    done,
-		t:       t,
-		isDebug: isDebug,
+		ctx:      ctx,
+		l:        l,
+		done:     done,
+		r:        r,
+		queries:  queries,
+		isDebug:  isDebug,
+		activity: newActivity(),
 	}
 }
 
@@ -39,8 +87,48 @@ func (s *server) Run(script *pgmock.Script) {
 	s.runFakePostgres(script)
 }
 
-func (s *server) Wait() {
+// RunSemantic replay the semantic snapshot
+func (s *server) RunSemantic(queries []semanticQuery) {
+	s.wg.Add(1)
+	go s.acceptConnForSemantic(queries)
+}
+
+// finish closes the client connection and waits until the goroutines exit.
+// The proxy is finished too when the replay is switched into recording
+func (s *server) finish() {
+	s.closeConns()
 	s.wg.Wait()
+	s.hybrid.finish()
+}
+
+// closeConns closes the client connection, and the database connection
+// after the hybrid switch, without waiting
+func (s *server) closeConns() {
+	s.mu.Lock()
+	s.finished = true
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.hybrid.closeConns()
+}
+
+// own makes the server the owner of the client connection, so it's closed on
+// finish. It returns false, and close the connection, when the server is
+// already finished
+func (s *server) own(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.finished {
+		_ = conn.Close()
+		return false
+	}
+
+	s.conn = conn
+	s.activity.accept()
+	return true
 }
 
 func (s *server) runFakePostgres(script *pgmock.Script) {
@@ -53,43 +141,455 @@ func (s *server) acceptConnForScript(script *pgmock.Script) {
 	defer func() {
 		s.debugLogf("server: finish script")
 		s.wg.Done()
-		s.done <- struct{}{}
+		s.signalDone()
 	}()
 
-	conn, err := s.l.Accept()
+	conn, be, err := s.accept()
 	if err != nil {
-		s.t.Errorf("server: cannot accept connection: %v", err)
+		s.r.Errorf("server: cannot accept connection: %v", err)
+		return
+	}
+	if conn == nil {
 		return
 	}
-	defer conn.Close()
 	s.debugLogf("server: accepted connection")
 
-	be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	// the startup until AuthenticationOk is done by acceptClient
+	steps := script.Steps[authenticationSteps:]
 
 	s.debugLogf("server: run script")
-	if err := script.Run(be); err != nil {
-		s.t.Errorf("server: run script got error: %v", err)
-		s.waitTilSync(be)
-		s.sendError(be, err)
+	recording, err := s.runScript(steps, be, conn)
+	if recording {
+		// the connection is used by the proxy until the client close it
+		s.debugLogf("server: switched to proxy")
+		return
+	}
+	defer conn.Close()
+
+	if err != nil {
+		s.r.Errorf("server: run script got error: %v", err)
+		if s.ctx.Err() == nil {
+			s.sendError(be, err)
+		}
+		return
+	}
+}
+
+// accept the authenticated client, the authentications are compared with the
+// snapshot
+func (s *server) accept() (net.Conn, *pgproto3.Backend, error) {
+	conn, be, err := acceptClient(s.l, s.auth, s.own, s.replayAuth, s.debugLogf)
+	if err != nil || conn == nil {
+		return conn, be, err
+	}
+
+	for _, a := range s.recordedAuth[s.authReplayed:] {
+		s.r.Errorf("server: %s in the snapshot, but the client is accepted before it", a)
+	}
+	s.authReplayed = len(s.recordedAuth)
+
+	return conn, be, nil
+}
+
+// replayAuth compares the client authentication with the next one in the
+// snapshot
+func (s *server) replayAuth(a authAttempt) {
+	if s.authReplayed >= len(s.recordedAuth) {
+		s.r.Errorf("server: %s, but it's not in the snapshot", a)
+		return
+	}
+
+	want := s.recordedAuth[s.authReplayed]
+	s.authReplayed++
+	if a != want {
+		s.r.Errorf("server: %s, but the snapshot has %s", a, want)
+	}
+}
+
+// runScript is like (*pgmock.Script).Run, but it also observe the messages
+// in the snapshot, so we know which queries already replayed. In hybrid mode,
+// recording is true when the rest of the conversation is proxied to the
+// database.
+//
+// When the client message is different from the snapshot, the mismatch is
+// reported and the client batch is answered with error, then the replay
+// continue from the next batch in the snapshot. So the client is never
+// blocked, and every mismatch is reported.
+func (s *server) runScript(steps []pgmock.Step, be *pgproto3.Backend, conn net.Conn) (recording bool, err error) {
+	var replayed []*recordedStep
+
+	// the responses are written at once before the next client message is
+	// received, like the database does at the end of the batch
+	responses := &responseBuffer{conn: conn}
+
+	for i := 0; i < len(steps); i++ {
+		s.activity.set("server", "%s", describeStep(steps, i))
+
+		if r, ok := steps[i].(*recordedStep); ok && !r.client {
+			responses.add(r.msg.(pgproto3.BackendMessage))
+			s.queries.observe(r.msg)
+			replayed = append(replayed, r)
+			continue
+		}
+
+		err := responses.flush()
+		if err == nil {
+			err = s.runStep(steps[i], be, conn)
+		}
+		if err != nil && s.ctx.Err() != nil {
+			return false, unfinishedScript(steps, i)
+		}
+		if err == nil {
+			if r, ok := steps[i].(*recordedStep); ok {
+				s.queries.observe(r.msg)
+				replayed = append(replayed, r)
+				if m, ok := r.msg.(pgproto3.FrontendMessage); ok {
+					s.activity.received(m)
+				}
+				if _, ok := r.msg.(*pgproto3.Terminate); ok {
+					// like postgres, the connection is closed after
+					// Terminate, the client might wait for it
+					s.signalDone()
+					return false, nil
+				}
+			}
+			continue
+		}
+
+		if isTimeout(err) {
+			return false, fmt.Errorf("no message from the client after %v, %s", s.stepTimeout, describeStep(steps, i))
+		}
+
+		var mismatch *mismatchError
+		if !errors.As(err, &mismatch) {
+			return false, err
+		}
+		s.activity.received(mismatch.msg)
+
+		if _, ok := mismatch.msg.(*pgproto3.Terminate); ok {
+			s.r.Errorf("server: client terminated before every step is replayed, %s", describeStep(steps, i))
+			return false, nil
+		}
+
+		if s.hybrid != nil {
+			s.debugLogf("server: %v", err)
+			recording, err = s.record(be, conn, replayed, mismatch.msg)
+			if recording {
+				return true, nil
+			}
+		}
+
+		s.r.Errorf("server: run script got error: %v", err)
+
+		// the client might be waiting for the previous batches
+		for _, r := range pendingResponses(steps, i) {
+			responses.add(r.msg.(pgproto3.BackendMessage))
+			s.queries.observe(r.msg)
+			replayed = append(replayed, r)
+		}
+		if err := responses.flush(); err != nil {
+			return false, nil
+		}
+
+		// continue after the response of the recorded batch
+		end, txStatus := endOfBatch(steps, i)
+		if !s.skipBatch(be, mismatch.msg, err, txStatus) {
+			return false, nil
+		}
+		i = end
+	}
+
+	if err := responses.flush(); err != nil {
+		if s.ctx.Err() != nil {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// the script is replayed, the rest is not part of the test timeout
+	s.signalDone()
+	s.activity.set("server", "every step is replayed, waiting for the next client message")
+
+	for {
+		// the client might continue with the queries that are not
+		// recorded yet
+		msg, ok := s.receiveAfterScript(be)
+		if !ok {
+			return false, nil
+		}
+
+		err := fmt.Errorf("%T is not in the snapshot, every message is already replayed", msg)
+		if s.hybrid != nil {
+			recording, err = s.record(be, conn, replayed, msg)
+			if recording {
+				return true, nil
+			}
+		}
+
+		s.r.Errorf("server: run script got error: %v", err)
+		if !s.skipBatch(be, msg, err, 'I') {
+			return false, nil
+		}
+	}
+}
+
+// runStep run the step, the client message should be received in
+// stepTimeout
+func (s *server) runStep(step pgmock.Step, be *pgproto3.Backend, conn net.Conn) error {
+	return s.withStepTimeout(conn, func() error {
+		return step.Step(be)
+	})
+}
+
+func (s *server) withStepTimeout(conn net.Conn, f func() error) error {
+	if s.stepTimeout <= 0 {
+		return f()
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(s.stepTimeout)); err != nil {
+		return err
+	}
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	return f()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// describeStep returns the step index, the snapshot line and what it's
+// waiting for
+func describeStep(steps []pgmock.Step, i int) string {
+	r, ok := steps[i].(*recordedStep)
+	if !ok {
+		return fmt.Sprintf("replaying step %d of %d, the startup", i+1, len(steps))
+	}
+
+	if _, ok := r.msg.(pgproto3.BackendMessage); ok {
+		return fmt.Sprintf("replaying step %d of %d (line %d), sending %T", i+1, len(steps), r.line, r.msg)
+	}
+
+	return fmt.Sprintf("replaying step %d of %d (line %d), waiting for %T from the client", i+1, len(steps), r.line, r.msg)
+}
+
+// endOfBatch returns the index of ReadyForQuery that answers the batch of the
+// step i in the snapshot, and its transaction status. The batches are
+// counted, because the pipelining client sends the batch before the previous
+// one is answered
+func endOfBatch(steps []pgmock.Step, i int) (int, byte) {
+	end := readyForQuery(steps, batchesBefore(steps, i)+1)
+	if end == len(steps) {
+		return end, 'I'
+	}
+	return end, steps[end].(*recordedStep).msg.(*pgproto3.ReadyForQuery).TxStatus
+}
+
+// skipBatch answer the client batch of msg with the error. Like postgres,
+// the messages after the error are discarded until Sync. It returns false
+// when the client terminate or close the connection.
+func (s *server) skipBatch(be *pgproto3.Backend, msg pgproto3.FrontendMessage, cause error, txStatus byte) bool {
+	s.activity.set("server", "skipping the client messages until Sync after mismatch")
+
+	// the error aborts the transaction, like postgres
+	if txStatus == 'T' {
+		txStatus = 'E'
+	}
+
+	sent := false
+	for {
+		switch msg.(type) {
+		case *pgproto3.Terminate:
+			return false
+		case *pgproto3.Flush:
+			// the client is waiting for the response before Sync
+			if !sent {
+				sent = s.sendErrorResponse(be, cause)
+			}
+		case *pgproto3.Sync, *pgproto3.Query:
+			if !sent {
+				s.sendErrorResponse(be, cause)
+			}
+			return be.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus}) == nil
+		}
+
+		var err error
+		msg, err = be.Receive()
+		if err != nil {
+			return false
+		}
+		s.activity.received(msg)
+	}
+}
+
+func (s *server) record(be *pgproto3.Backend, conn net.Conn, replayed []*recordedStep, msg pgproto3.FrontendMessage) (bool, error) {
+	if err := s.hybrid.record(be, conn, replayed, msg); err != nil {
+		return false, fmt.Errorf("cannot switch to proxy on %T: %w", msg, err)
+	}
+	return true, nil
+}
+
+// receiveAfterScript waits for the client message after the script is
+// replayed. It returns false when the client terminate or close the
+// connection, or the test is finished.
+func (s *server) receiveAfterScript(be *pgproto3.Backend) (pgproto3.FrontendMessage, bool) {
+	msg, err := be.Receive()
+	if err != nil {
+		return nil, false
+	}
+	s.activity.received(msg)
+
+	if _, ok := msg.(*pgproto3.Terminate); ok {
+		return nil, false
+	}
+
+	return msg, true
+}
+
+// unfinishedScript returns the error when the test is finished before the
+// client send every message in the script. It's fine when the rest is the
+// server messages, or Terminate that might be sent after the test finished
+func unfinishedScript(steps []pgmock.Step, i int) error {
+	for j := i; j < len(steps); j++ {
+		r, ok := steps[j].(*recordedStep)
+		if !ok {
+			// the rest of the startup, sent by the server
+			continue
+		}
+
+		switch r.msg.(type) {
+		case *pgproto3.Terminate:
+		case pgproto3.FrontendMessage:
+			return fmt.Errorf("test is finished before every step is replayed, %s", describeStep(steps, j))
+		}
+	}
+	return nil
+}
+
+func (s *server) acceptConnForSemantic(queries []semanticQuery) {
+	defer func() {
+		s.debugLogf("server: finish semantic replay")
+		s.wg.Done()
+		s.signalDone()
+	}()
+
+	conn, be, err := s.accept()
+	if err != nil {
+		s.r.Errorf("server: cannot accept connection: %v", err)
+		return
+	}
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	s.debugLogf("server: accepted connection")
+
+	startup := pgmock.AcceptUnauthenticatedConnRequestSteps()[authenticationSteps:]
+	if err := (&pgmock.Script{Steps: startup}).Run(be); err != nil {
+		if s.ctx.Err() != nil {
+			s.r.Errorf("server: test is finished before the client start up")
+			return
+		}
+		s.r.Errorf("server: cannot start up: %v", err)
 		return
 	}
+
+	if err := s.replaySemantic(newSemanticReplay(queries), be, conn); err != nil {
+		s.r.Errorf("server: replay semantic snapshot got error: %v", err)
+	}
 }
 
-func (s *server) waitTilSync(be *pgproto3.Backend) {
-	for i := 0; i < 10; i++ {
-		msg, err := be.Receive()
+// replaySemantic answer the client messages until every query in the
+// snapshot is replayed, or the client terminate the connection
+func (s *server) replaySemantic(r *semanticReplay, be *pgproto3.Backend, conn net.Conn) error {
+	for {
+		doing := fmt.Sprintf("replaying query %d of %d, waiting for the client message", r.next+1, len(r.queries))
+		s.activity.set("server", "%s", doing)
+
+		var msg pgproto3.FrontendMessage
+		err := s.withStepTimeout(conn, func() (err error) {
+			msg, err = be.Receive()
+			return err
+		})
+		if isTimeout(err) {
+			return fmt.Errorf("no message from the client after %v, %s", s.stepTimeout, doing)
+		}
+		if err != nil && s.ctx.Err() != nil {
+			if r.done() {
+				return nil
+			}
+			return fmt.Errorf("test is finished before every query is replayed, the next is: %s", r.queries[r.next].SQL)
+		}
 		if err != nil {
+			return err
+		}
+		s.activity.received(msg)
+		s.queries.observe(msg)
+
+		responses, err := r.handle(msg)
+		if err == errTerminated {
+			if !r.done() {
+				return fmt.Errorf("%d queries in the snapshot are not executed, the next is: %s",
+					len(r.queries)-r.next, r.queries[r.next].SQL)
+			}
+			return nil
+		}
+		if err != nil {
+			// answer the batch with error, and continue with the next one
+			s.r.Errorf("server: replay semantic snapshot got error: %v", err)
+			if !s.skipBatch(be, msg, err, r.txStatus) {
+				return nil
+			}
+			r.failed = false
 			continue
 		}
 
-		_, ok := msg.(*pgproto3.Sync)
-		if ok {
+		for _, m := range responses {
+			s.queries.observe(m)
+			if err := be.Send(m); err != nil {
+				return err
+			}
+		}
+
+		if _, ok := msg.(*pgproto3.Sync); ok && r.done() {
 			break
 		}
+		if _, ok := msg.(*pgproto3.Query); ok && r.done() {
+			break
+		}
+	}
+
+	// every query is replayed, the rest is not part of the test timeout
+	s.signalDone()
+	s.activity.set("server", "every query is replayed, waiting for the next client message")
+
+	for {
+		// the client might continue with the queries that are not
+		// recorded yet
+		msg, ok := s.receiveAfterScript(be)
+		if !ok {
+			return nil
+		}
+		s.queries.observe(msg)
+
+		err := fmt.Errorf("%T is not in the snapshot, every query is already replayed", msg)
+		s.r.Errorf("server: replay semantic snapshot got error: %v", err)
+		if !s.skipBatch(be, msg, err, r.txStatus) {
+			return nil
+		}
 	}
 }
 
 func (s *server) sendError(be *pgproto3.Backend, postgresError error) {
+	s.sendErrorResponse(be, postgresError)
+
+	// ignore the error
+	_ = be.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+}
+
+// sendErrorResponse send the error to the client, like the postgres error
+func (s *server) sendErrorResponse(be *pgproto3.Backend, postgresError error) bool {
 	err := be.Send(&pgproto3.ErrorResponse{
 		Severity:            "ERROR",
 		SeverityUnlocalized: "ERROR",
@@ -97,17 +597,22 @@ func (s *server) sendError(be *pgproto3.Backend, postgresError error) {
 		Message:             "pgsnap:\n" + postgresError.Error(),
 	})
 	if err != nil {
-		s.t.Errorf("BE send Error (%s) caused by %s", err, postgresError)
+		s.r.Errorf("BE send Error (%s) caused by %s", err, postgresError)
+		return false
 	}
+	return true
+}
 
-	// ignore the error
-	_ = be.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+// signalDone stops the test timeout, it's only sent once
+func (s *server) signalDone() {
+	s.doneOnce.Do(func() {
+		s.done <- struct{}{}
+	})
 }
 
 func (s *server) debugLogf(format string, args ...interface{}) {
 	if s.isDebug {
-		s.t.Helper()
 		args = append([]interface{}{time.Now()}, args...)
-		s.t.Logf("%v: "+format, args...)
+		s.r.Logf("%v: "+format, args...)
 	}
 }
@@ -0,0 +1,39 @@
+package pgsnap
+
+import (
+	"testing"
+
+	"github.com/jackc/pgmock"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_unfinishedScript(t *testing.T) {
+	steps := append(pgmock.AcceptUnauthenticatedConnRequestSteps()[authenticationSteps:],
+		&recordedStep{msg: &pgproto3.Query{String: "select 1"}, line: 1},
+		&recordedStep{msg: &pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")}, line: 2},
+		&recordedStep{msg: &pgproto3.ReadyForQuery{TxStatus: 'I'}, line: 3},
+		&recordedStep{msg: &pgproto3.Terminate{}, line: 4},
+	)
+
+	tests := []struct {
+		name string
+		i    int
+		want string
+	}{
+		{"sending the startup", 0, "test is finished before every step is replayed, replaying step 3 of 6 (line 1), waiting for *pgproto3.Query from the client"},
+		{"waiting for client", 2, "test is finished before every step is replayed, replaying step 3 of 6 (line 1), waiting for *pgproto3.Query from the client"},
+		{"sending the response", 3, ""},
+		{"waiting for terminate", 5, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := unfinishedScript(steps, tt.i)
+			if tt.want == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.want)
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package pgsnap
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// FixturesMetadataKey is the snapshot metadata key of the fixtures hash
+const FixturesMetadataKey = "fixtures"
+
+type (
+	// fixtureTable is the rows of one table in YAML/JSON fixture
+	fixtureTable struct {
+		name string
+		rows []fixtureRow
+	}
+
+	fixtureRow struct {
+		columns []string
+		values  []interface{}
+	}
+)
+
+// FixturesMetadata returns the snapshot metadata that contains the hash of
+// the fixtures content. It returns nil when there are no fixtures.
+func FixturesMetadata(paths []string) (map[string]string, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	h := sha256.New()
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read fixture: %w", err)
+		}
+
+		h.Write([]byte(filepath.Base(p)))
+		h.Write([]byte{0})
+		h.Write(b)
+		h.Write([]byte{0})
+	}
+
+	return map[string]string{FixturesMetadataKey: "sha256:" + hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// loadFixtures insert the fixtures in order. The .sql file is executed as it
+// is, and the .yaml, .yml and .json file contains the rows per table, like
+//
+//	mytable:
+//	  - id: 1
+//	    name: Adrian
+//
+// The tables are inserted in the order written in the file.
+func loadFixtures(ctx context.Context, db *pgx.Conn, paths []string) error {
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return fmt.Errorf("cannot read fixture: %w", err)
+		}
+
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".sql":
+			// without arguments, pgx use simple protocol that allow
+			// multiple statements
+			if _, err := db.Exec(ctx, string(b)); err != nil {
+				return fmt.Errorf("cannot load fixture %s: %w", p, err)
+			}
+
+		case ".yaml", ".yml", ".json":
+			tables, err := parseTableFixture(b)
+			if err != nil {
+				return fmt.Errorf("invalid fixture %s: %w", p, err)
+			}
+
+			for _, t := range tables {
+				for _, r := range t.rows {
+					if _, err := db.Exec(ctx, insertSQL(t.name, r.columns), r.values...); err != nil {
+						return fmt.Errorf("cannot load fixture %s into %s: %w", p, t.name, err)
+					}
+				}
+			}
+
+		default:
+			return fmt.Errorf("unsupported fixture %s", p)
+		}
+	}
+
+	return nil
+}
+
+// parseTableFixture parse YAML (or JSON, which is also YAML) fixture, keeping
+// the order of the tables and the columns
+func parseTableFixture(src []byte) ([]fixtureTable, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(src, &doc); err != nil {
+		return nil, err
+	}
+
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: want map of table name to rows", root.Line)
+	}
+
+	var tables []fixtureTable
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		name, rows := root.Content[i], root.Content[i+1]
+		if rows.Kind != yaml.SequenceNode {
+			return nil, fmt.Errorf("line %d: want list of rows for %s", rows.Line, name.Value)
+		}
+
+		t := fixtureTable{name: name.Value}
+		for _, row := range rows.Content {
+			r, err := parseFixtureRow(row)
+			if err != nil {
+				return nil, err
+			}
+			t.rows = append(t.rows, r)
+		}
+
+		tables = append(tables, t)
+	}
+
+	return tables, nil
+}
+
+func parseFixtureRow(row *yaml.Node) (fixtureRow, error) {
+	if row.Kind != yaml.MappingNode || len(row.Content) == 0 {
+		return fixtureRow{}, fmt.Errorf("line %d: want map of column to value", row.Line)
+	}
+
+	var r fixtureRow
+	for i := 0; i+1 < len(row.Content); i += 2 {
+		column, node := row.Content[i], row.Content[i+1]
+
+		var v interface{}
+		if err := node.Decode(&v); err != nil {
+			return fixtureRow{}, fmt.Errorf("line %d: %w", node.Line, err)
+		}
+
+		// nested value is stored as json, for json and jsonb column
+		if node.Kind == yaml.MappingNode || node.Kind == yaml.SequenceNode {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return fixtureRow{}, fmt.Errorf("line %d: %w", node.Line, err)
+			}
+			v = string(b)
+		}
+
+		r.columns = append(r.columns, column.Value)
+		r.values = append(r.values, v)
+	}
+
+	return r, nil
+}
+
+// insertSQL returns INSERT with placeholder, table can contain the schema
+func insertSQL(table string, columns []string) string {
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = pgx.Identifier{c}.Sanitize()
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		pgx.Identifier(strings.Split(table, ".")).Sanitize(),
+		strings.Join(quoted, ", "),
+		strings.Join(placeholders, ", "),
+	)
+}
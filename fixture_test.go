@@ -0,0 +1,136 @@
+package pgsnap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseTableFixture(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    []fixtureTable
+		wantErr string
+	}{
+		{
+			name: "yaml keep the order",
+			src: `
+users:
+  - id: 1
+    name: Adrian
+posts:
+  - user_id: 1
+    title: null
+    tags: [a, b]
+`,
+			want: []fixtureTable{
+				{name: "users", rows: []fixtureRow{{columns: []string{"id", "name"}, values: []interface{}{1, "Adrian"}}}},
+				{name: "posts", rows: []fixtureRow{{columns: []string{"user_id", "title", "tags"}, values: []interface{}{1, nil, `["a","b"]`}}}},
+			},
+		},
+		{
+			name: "json",
+			src:  `{"public.mytable": [{"name": "Magdalena", "data": {"a": 1}}]}`,
+			want: []fixtureTable{
+				{name: "public.mytable", rows: []fixtureRow{{columns: []string{"name", "data"}, values: []interface{}{"Magdalena", `{"a":1}`}}}},
+			},
+		},
+		{
+			name: "empty",
+			src:  "",
+		},
+		{
+			name:    "not a map",
+			src:     "- id: 1",
+			wantErr: "want map of table name to rows",
+		},
+		{
+			name:    "rows is not a list",
+			src:     "users:\n  id: 1",
+			wantErr: "want list of rows for users",
+		},
+		{
+			name:    "row is not a map",
+			src:     "users:\n  - 1",
+			wantErr: "want map of column to value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTableFixture([]byte(tt.src))
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_insertSQL(t *testing.T) {
+	assert.Equal(t,
+		`INSERT INTO "public"."mytable" ("id", "name") VALUES ($1, $2)`,
+		insertSQL("public.mytable", []string{"id", "name"}),
+	)
+}
+
+func TestFixturesMetadata(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("users:\n  - id: 1\n"), 0o644))
+
+	m, err := FixturesMetadata(nil)
+	require.NoError(t, err)
+	assert.Nil(t, m)
+
+	before, err := FixturesMetadata([]string{path})
+	require.NoError(t, err)
+	assert.Contains(t, before[FixturesMetadataKey], "sha256:")
+
+	require.NoError(t, os.WriteFile(path, []byte("users:\n  - id: 2\n"), 0o644))
+
+	after, err := FixturesMetadata([]string{path})
+	require.NoError(t, err)
+	assert.NotEqual(t, before, after)
+
+	_, err = FixturesMetadata([]string{filepath.Join(dir, "missing.sql")})
+	assert.Error(t, err)
+}
+
+// the fixtures are loaded in the sandbox, and rolled back on Finish, so
+// the snapshot can be recorded again without the duplicated rows
+func TestSnap_fixtures_rerecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.sql")
+	require.NoError(t, os.WriteFile(path, []byte("insert into mytable(name) values ('Adrian')\n"), 0o644))
+
+	for i := 0; i < 2; i++ {
+		// the fake server is used as the database, it expects the
+		// fixtures inside the transaction that is never committed
+		upstream := NewSnapWithConfig(&namedTB{TB: t, name: "TestSnap_fixtures_rerecord_upstream"}, addr, Config{})
+
+		s := NewSnapWithConfig(t, upstream.Addr(), Config{ForceWrite: true, Fixtures: []string{path}})
+		t.Cleanup(func() { _ = os.Remove(s.script.getFilename()) })
+
+		ctx := context.Background()
+		conn, err := pgx.Connect(ctx, s.Addr())
+		require.NoError(t, err)
+
+		_, err = conn.Exec(ctx, "select 1")
+		require.NoError(t, err)
+		assert.Equal(t, byte('I'), conn.PgConn().TxStatus())
+
+		require.NoError(t, conn.Close(ctx))
+		assert.NoError(t, s.Finish(), "recording %d", i+1)
+		assert.NoError(t, upstream.Finish(), "recording %d", i+1)
+	}
+}
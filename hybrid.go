@@ -0,0 +1,312 @@
+package pgsnap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// hybrid switches the replay into recording on the first client message
+// that is not in the snapshot, or when the client continue after the
+// snapshot is replayed. The snapshot is written again with the replayed
+// part, followed by the messages proxied to the database.
+//
+// Before proxying, the session state is restored in the database: the
+// prepared statements that the client already parsed, and the transaction
+// block. The failed transaction and the portals are not restored.
+type hybrid struct {
+	ctx     context.Context
+	r       Reporter
+	queries *queryLog
+	url     string
+	script  *script
+	cfg     Config
+
+	// activity is shared with the fake server, so the timeout report
+	// contains the state of the proxy after the switch
+	activity *activity
+
+	mu    sync.Mutex
+	proxy *proxy
+}
+
+// record start proxying the client to the database, the proxy owns the
+// client connection. replayed is the steps that already replayed, and msg is
+// the first client message that is not in the snapshot.
+func (h *hybrid) record(be *pgproto3.Backend, conn net.Conn, replayed []*recordedStep, msg pgproto3.FrontendMessage) (err error) {
+	// the client messages after the last response are not answered yet,
+	// they are sent again to the database
+	answered, unanswered := splitAnswered(replayed)
+
+	if h.cfg.Level != LevelWire {
+		return fmt.Errorf("hybrid mode only support LevelWire snapshot")
+	}
+
+	p := newProxy(h.ctx, h.r, h.queries, h.url, h.script, nil, h.cfg)
+	p.activity = h.activity
+
+	defer func() {
+		// the switch is tried again on the next mismatch
+		if err != nil {
+			p.finish()
+		}
+	}()
+
+	// connect before the snapshot is rewritten, so it's kept when the
+	// database is not available
+	if err := p.connect(); err != nil {
+		return err
+	}
+
+	out, err := p.create()
+	if err != nil {
+		return err
+	}
+
+	// the client is already authenticated like in the snapshot
+	for _, a := range h.script.auth {
+		if err := p.writeAuth(out, a); err != nil {
+			return err
+		}
+	}
+
+	for _, step := range answered {
+		prefix := byte('F')
+		if _, ok := step.msg.(pgproto3.BackendMessage); ok {
+			prefix = 'B'
+		}
+		if err := p.writeReplayed(out, prefix, step.msg); err != nil {
+			return err
+		}
+	}
+
+	fe := p.prepareFrontend(p.db)
+
+	if err := h.restore(p, fe, answered); err != nil {
+		return fmt.Errorf("cannot restore the session: %w", err)
+	}
+
+	for _, step := range unanswered {
+		m, ok := step.msg.(pgproto3.FrontendMessage)
+		if !ok {
+			continue
+		}
+
+		// the client uses its own names in the next messages
+		m = h.clientNames(m)
+		if parse, ok := m.(*pgproto3.Parse); ok {
+			p.canonical.alias(parse.Name, step.msg.(*pgproto3.Parse).Name)
+		}
+
+		if err := h.forward(p, fe, out, m); err != nil {
+			return err
+		}
+	}
+
+	// the replayed messages are already observed
+	h.queries.observe(msg)
+	if err := h.forward(p, fe, out, msg); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.proxy = p
+	h.mu.Unlock()
+
+	if !p.own(conn) {
+		return nil
+	}
+	p.runConversation(fe, be, out)
+
+	return nil
+}
+
+// finish the proxy, when the replay is switched into recording
+func (h *hybrid) finish() {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	p := h.proxy
+	h.mu.Unlock()
+
+	p.finish()
+}
+
+func (h *hybrid) closeConns() {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	p := h.proxy
+	h.mu.Unlock()
+
+	p.closeConns()
+}
+
+func (h *hybrid) forward(p *proxy, fe *pgproto3.Frontend, out io.Writer, msg pgproto3.FrontendMessage) error {
+	if err := p.writeLine(out, 'F', msg); err != nil {
+		return err
+	}
+
+	if err := p.forwardToDatabase(fe, msg); err != nil {
+		return fmt.Errorf("cannot forward to postgres: %T: %w", msg, err)
+	}
+
+	return nil
+}
+
+// restore parse the statements of the client and begin the transaction in
+// the database, like in the replayed session. The responses are not sent to
+// the client
+func (h *hybrid) restore(p *proxy, fe *pgproto3.Frontend, replayed []*recordedStep) error {
+	parsed, txStatus := sessionState(replayed)
+
+	if txStatus != 'I' {
+		if err := roundTrip(p, fe, &pgproto3.Query{String: "BEGIN"}); err != nil {
+			return err
+		}
+	}
+
+	var clients []string
+	for client := range h.script.names.statements {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+
+	var msgs []pgproto3.FrontendMessage
+	for _, client := range clients {
+		recorded := h.script.names.statements[client]
+
+		parse, ok := parsed[recorded]
+		if !ok {
+			continue
+		}
+
+		p.canonical.alias(client, recorded)
+		msgs = append(msgs, &pgproto3.Parse{
+			Name:          client,
+			Query:         parse.Query,
+			ParameterOIDs: parse.ParameterOIDs,
+		})
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	return roundTrip(p, fe, append(msgs, &pgproto3.Sync{})...)
+}
+
+// clientNames returns the recorded message with the statement and portal
+// names that bound to the client names
+func (h *hybrid) clientNames(msg pgproto3.FrontendMessage) pgproto3.FrontendMessage {
+	names := h.script.names
+	stmt := func(recorded string) string { return names.client('S', recorded) }
+	portal := func(recorded string) string { return names.client('P', recorded) }
+
+	switch m := msg.(type) {
+	case *pgproto3.Parse:
+		n := *m
+		n.Name = stmt(m.Name)
+		return &n
+	case *pgproto3.Bind:
+		n := *m
+		n.PreparedStatement = stmt(m.PreparedStatement)
+		n.DestinationPortal = portal(m.DestinationPortal)
+		return &n
+	case *pgproto3.Describe:
+		n := *m
+		if m.ObjectType == 'S' {
+			n.Name = stmt(m.Name)
+		} else {
+			n.Name = portal(m.Name)
+		}
+		return &n
+	case *pgproto3.Close:
+		n := *m
+		if m.ObjectType == 'S' {
+			n.Name = stmt(m.Name)
+		} else {
+			n.Name = portal(m.Name)
+		}
+		return &n
+	case *pgproto3.Execute:
+		n := *m
+		n.Portal = portal(m.Portal)
+		return &n
+	}
+
+	return msg
+}
+
+// roundTrip send the messages, and wait until ReadyForQuery
+func roundTrip(p *proxy, fe *pgproto3.Frontend, msgs ...pgproto3.FrontendMessage) error {
+	for _, msg := range msgs {
+		if err := p.sendToDatabase(fe, p.sandbox.rewrite(msg)...); err != nil {
+			return err
+		}
+	}
+
+	var errResponse *pgproto3.ErrorResponse
+	for {
+		msg, err := fe.Receive()
+		if err != nil {
+			return err
+		}
+
+		msg, err = p.sandbox.translate(msg)
+		if err != nil {
+			return err
+		}
+
+		switch m := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			errResponse = m
+		case *pgproto3.ReadyForQuery:
+			if errResponse != nil {
+				return errorResponseToPgError(errResponse)
+			}
+			return nil
+		}
+	}
+}
+
+// splitAnswered split the steps after the last backend message
+func splitAnswered(steps []*recordedStep) ([]*recordedStep, []*recordedStep) {
+	for i := len(steps) - 1; i >= 0; i-- {
+		if _, ok := steps[i].msg.(pgproto3.BackendMessage); ok {
+			return steps[:i+1], steps[i+1:]
+		}
+	}
+	return nil, steps
+}
+
+// sessionState returns the statements parsed by the recorded name, and the
+// transaction status at the end of the steps
+func sessionState(steps []*recordedStep) (map[string]*pgproto3.Parse, byte) {
+	parsed := map[string]*pgproto3.Parse{}
+	txStatus := byte('I')
+
+	for _, step := range steps {
+		switch m := step.msg.(type) {
+		case *pgproto3.Parse:
+			parsed[m.Name] = m
+		case *pgproto3.Close:
+			if m.ObjectType == 'S' {
+				delete(parsed, m.Name)
+			}
+		case *pgproto3.ReadyForQuery:
+			txStatus = m.TxStatus
+		}
+	}
+
+	return parsed, txStatus
+}
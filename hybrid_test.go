@@ -0,0 +1,250 @@
+package pgsnap
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unreachableAddr is used when the test should not connect to the database
+const unreachableAddr = "postgres://postgres@127.0.0.1:1/?sslmode=disable"
+
+func TestSnap_hybrid_replayed(t *testing.T) {
+	t.Run("pq", func(t *testing.T) {
+		tb := &namedTB{TB: t, name: "TestSnap_runScript_pq"}
+		cfg := ConfigFromEnv()
+		cfg.Hybrid = true
+
+		db, s := NewDBWithConfig(tb, unreachableAddr, cfg)
+		runPQ(t, db)
+		require.NoError(t, db.Close())
+
+		s.Finish()
+		assert.Empty(t, s.Errors())
+	})
+
+	t.Run("client is not closed", func(t *testing.T) {
+		tb := &namedTB{TB: t, name: "TestSnap_runScript_pgx"}
+		cfg := ConfigFromEnv()
+		cfg.Hybrid = true
+
+		s := NewSnapWithConfig(tb, unreachableAddr, cfg)
+		runPGX(t, s.Addr())
+
+		s.Finish()
+		assert.Empty(t, s.Errors())
+	})
+}
+
+func TestSnap_hybrid_unreachable(t *testing.T) {
+	before, err := os.ReadFile("pgsnap_snap_runscript_pq.txt")
+	require.NoError(t, err)
+
+	tb := newFakeTB(&namedTB{TB: t, name: "TestSnap_runScript_pq"})
+	cfg := ConfigFromEnv()
+	cfg.Hybrid = true
+
+	// the ping is not executed, so the first message is not in the snapshot
+	db, s := NewDBWithConfig(tb, unreachableAddr, cfg)
+	_, err = db.Query("select id from mytable limit $1", 8)
+	assert.Error(t, err)
+	_ = db.Close()
+	s.Finish()
+
+	require.Len(t, tb.ErrorMessages, 2)
+	assert.True(t,
+		strings.HasPrefix(tb.ErrorMessages[0], "server: run script got error: cannot switch to proxy on *pgproto3.Parse: can't connect to db"),
+		tb.ErrorMessages[0],
+	)
+	// the client might terminate before or after the test is finished
+	assert.Contains(t, tb.ErrorMessages[1],
+		"before every step is replayed, replaying step 6 of 21 (line 4), waiting for *pgproto3.Parse from the client",
+	)
+
+	after, err := os.ReadFile("pgsnap_snap_runscript_pq.txt")
+	require.NoError(t, err)
+	assert.Equal(t, string(before), string(after), "snapshot should not be changed")
+}
+
+// hybridSwitchSnapshot is replayed until the client send Bind instead of the
+// Describe of stmt_2, the rest is recorded again
+const hybridSwitchSnapshot = `F {"Type":"Query","String":"BEGIN"}
+B {"Type":"CommandComplete","CommandTag":"BEGIN"}
+B {"Type":"ReadyForQuery","TxStatus":"T"}
+F {"Type":"Parse","Name":"stmt_1","Query":"select id from mytable where id = $1","ParameterOIDs":null}
+F {"Type":"Describe","ObjectType":"S","Name":"stmt_1"}
+F {"Type":"Sync"}
+B {"Type":"ParseComplete"}
+B {"Type":"ParameterDescription","ParameterOIDs":[23]}
+B {"Type":"RowDescription","Fields":[{"Name":"id","TableOID":16384,"TableAttributeNumber":1,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0}]}
+B {"Type":"ReadyForQuery","TxStatus":"T"}
+F {"Type":"Parse","Name":"stmt_2","Query":"select 2","ParameterOIDs":null}
+F {"Type":"Describe","ObjectType":"S","Name":"stmt_2"}
+F {"Type":"Sync"}
+B {"Type":"ParseComplete"}
+B {"Type":"ParameterDescription","ParameterOIDs":[]}
+B {"Type":"RowDescription","Fields":[{"Name":"?column?","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0}]}
+B {"Type":"ReadyForQuery","TxStatus":"T"}
+F {"Type":"Query","String":"ROLLBACK"}
+B {"Type":"CommandComplete","CommandTag":"ROLLBACK"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`
+
+// the replayed session is restored in the database: the transaction and the
+// statement "a" are sent before the unanswered Parse of "b". The fake server
+// is used as the database
+func TestSnap_hybrid_switch(t *testing.T) {
+	upstream := NewSnapWithConfig(&namedTB{TB: t, name: "TestSnap_hybrid_switch_upstream"}, addr, Config{})
+
+	filename := newScript(t).getFilename()
+	require.NoError(t, os.WriteFile(filename, []byte(hybridSwitchSnapshot), 0644))
+	t.Cleanup(func() { _ = os.Remove(filename) })
+
+	cfg := ConfigFromEnv()
+	cfg.Hybrid = true
+	s := NewSnapWithConfig(t, upstream.Addr(), cfg)
+
+	conn, err := net.Dial("tcp", s.l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
+	send := func(msgs ...pgproto3.FrontendMessage) {
+		for _, msg := range msgs {
+			require.NoError(t, fe.Send(msg))
+		}
+	}
+
+	send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "user"},
+	})
+	receiveTypes(t, fe, 3)
+
+	// replayed, with the client statement names
+	send(&pgproto3.Query{String: "BEGIN"})
+	receiveTypes(t, fe, 2)
+	send(
+		&pgproto3.Parse{Name: "a", Query: "select id from mytable where id = $1"},
+		&pgproto3.Describe{ObjectType: 'S', Name: "a"},
+		&pgproto3.Sync{},
+	)
+	receiveTypes(t, fe, 4)
+
+	// Parse is replayed, but Bind is not in the snapshot
+	send(
+		&pgproto3.Parse{Name: "b", Query: "select 2"},
+		&pgproto3.Bind{PreparedStatement: "b"},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t, []string{
+		"*pgproto3.ParseComplete",
+		"*pgproto3.BindComplete",
+		"*pgproto3.DataRow",
+		"*pgproto3.CommandComplete",
+		"*pgproto3.ReadyForQuery",
+	}, receiveTypes(t, fe, 5))
+
+	// the statement parsed while replaying
+	send(
+		&pgproto3.Bind{PreparedStatement: "a", Parameters: [][]byte{[]byte("4")}},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t, []string{
+		"*pgproto3.BindComplete",
+		"*pgproto3.DataRow",
+		"*pgproto3.CommandComplete",
+		"*pgproto3.ReadyForQuery",
+	}, receiveTypes(t, fe, 4))
+
+	send(&pgproto3.Query{String: "COMMIT"})
+	receiveTypes(t, fe, 2)
+	send(&pgproto3.Terminate{})
+
+	// the proxy close the connection after Terminate is recorded
+	_, err = fe.Receive()
+	require.Error(t, err)
+
+	assert.NoError(t, s.Finish())
+	assert.NoError(t, upstream.Finish())
+
+	// the snapshot after the mismatch point is replaced by the recorded one
+	got, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	replayed := strings.Join(strings.SplitAfter(hybridSwitchSnapshot, "\n")[:10], "")
+	assert.Equal(t, replayed+`F {"Type":"Parse","Name":"stmt_2","Query":"select 2","ParameterOIDs":null}
+F {"Type":"Bind","DestinationPortal":"","PreparedStatement":"stmt_2","ParameterFormatCodes":null,"Parameters":[],"ResultFormatCodes":[]}
+F {"Type":"Execute","Portal":"","MaxRows":0}
+F {"Type":"Sync"}
+B {"Type":"ParseComplete"}
+B {"Type":"BindComplete"}
+B {"Type":"DataRow","Values":[{"text":"2"}]}
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"T"}
+F {"Type":"Bind","DestinationPortal":"","PreparedStatement":"stmt_1","ParameterFormatCodes":null,"Parameters":[{"text":"4"}],"ResultFormatCodes":[]}
+F {"Type":"Execute","Portal":"","MaxRows":0}
+F {"Type":"Sync"}
+B {"Type":"BindComplete"}
+B {"Type":"DataRow","Values":[{"text":"4"}]}
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"T"}
+F {"Type":"Query","String":"COMMIT"}
+B {"Type":"CommandComplete","CommandTag":"COMMIT"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+F {"Type":"Terminate"}
+`, string(got))
+}
+
+func Test_splitAnswered(t *testing.T) {
+	parse := &recordedStep{msg: &pgproto3.Parse{Query: "select 1"}}
+	sync := &recordedStep{msg: &pgproto3.Sync{}}
+	ready := &recordedStep{msg: &pgproto3.ReadyForQuery{TxStatus: 'I'}}
+	bind := &recordedStep{msg: &pgproto3.Bind{}}
+
+	tests := []struct {
+		name           string
+		steps          []*recordedStep
+		wantAnswered   []*recordedStep
+		wantUnanswered []*recordedStep
+	}{
+		{"empty", nil, nil, nil},
+		{"answered", []*recordedStep{parse, sync, ready}, []*recordedStep{parse, sync, ready}, []*recordedStep{}},
+		{"pending", []*recordedStep{parse, sync, ready, bind}, []*recordedStep{parse, sync, ready}, []*recordedStep{bind}},
+		{"no response", []*recordedStep{parse, sync}, nil, []*recordedStep{parse, sync}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answered, unanswered := splitAnswered(tt.steps)
+			assert.Equal(t, tt.wantAnswered, answered)
+			assert.Equal(t, tt.wantUnanswered, unanswered)
+		})
+	}
+}
+
+func Test_sessionState(t *testing.T) {
+	steps := []*recordedStep{
+		{msg: &pgproto3.Query{String: "begin"}},
+		{msg: &pgproto3.ReadyForQuery{TxStatus: 'T'}},
+		{msg: &pgproto3.Parse{Name: "stmt_1", Query: "select 1"}},
+		{msg: &pgproto3.Parse{Name: "stmt_2", Query: "select 2"}},
+		{msg: &pgproto3.Close{ObjectType: 'S', Name: "stmt_1"}},
+		{msg: &pgproto3.Close{ObjectType: 'P', Name: "stmt_2"}},
+		{msg: &pgproto3.Sync{}},
+		{msg: &pgproto3.ReadyForQuery{TxStatus: 'T'}},
+	}
+
+	parsed, txStatus := sessionState(steps)
+	assert.Equal(t, map[string]*pgproto3.Parse{
+		"stmt_2": {Name: "stmt_2", Query: "select 2"},
+	}, parsed)
+	assert.Equal(t, byte('T'), txStatus)
+}
@@ -0,0 +1,138 @@
+package pgsnap
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnap_Finish_replay(t *testing.T) {
+	t.Run("client is closed", func(t *testing.T) {
+		db, s := NewDBWithConfig(&namedTB{TB: t, name: "TestSnap_runScript_pq"}, addr, Config{})
+		runPQ(t, db)
+		require.NoError(t, db.Close())
+
+		assert.NoError(t, s.Finish())
+		assert.Empty(t, leakedGoroutines())
+	})
+
+	t.Run("client is not closed", func(t *testing.T) {
+		s := NewSnapWithConfig(&namedTB{TB: t, name: "TestSnap_runScript_pgx"}, addr, Config{})
+		runPGX(t, s.Addr())
+		require.NotEmpty(t, leakedGoroutines(), "the fake server is still running")
+
+		assert.NoError(t, s.Finish())
+		assert.Empty(t, leakedGoroutines())
+	})
+
+	t.Run("client is not connected", func(t *testing.T) {
+		tb := newFakeTB(&namedTB{TB: t, name: "TestSnap_runScript_pgx"})
+		s := NewSnapWithConfig(tb, addr, Config{})
+
+		err := s.Finish()
+		require.Error(t, err)
+		assert.Len(t, err.(MultiError), 1)
+		assert.Empty(t, leakedGoroutines())
+	})
+
+	t.Run("replay is not finished", func(t *testing.T) {
+		tb := newFakeTB(&namedTB{TB: t, name: "TestSnap_runScript_pgx"})
+		s := NewSnapWithConfig(tb, addr, Config{})
+
+		conn, err := pgx.Connect(context.Background(), s.Addr())
+		require.NoError(t, err)
+
+		err = s.Finish()
+		assert.EqualError(t, err, "server: run script got error: test is finished before every step is replayed, "+
+			"replaying step 3 of 23 (line 1), waiting for *pgproto3.Query from the client")
+		assert.Empty(t, leakedGoroutines())
+
+		_ = conn.Close(context.Background())
+	})
+}
+
+func TestSnap_Finish_proxy(t *testing.T) {
+	for _, closeClient := range []bool{true, false} {
+		name := "client is closed"
+		if !closeClient {
+			name = "client is not closed"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			// the fake server is used as the database, the proxy ping it
+			// before the client send the query
+			upstream := NewSnapWithConfig(&namedTB{TB: t, name: "TestSnap_runScript_pq"}, addr, Config{})
+
+			tb := &namedTB{TB: t, name: "TestSnap_Finish_proxy"}
+			s := NewSnapWithConfig(tb, upstream.Addr(), Config{ForceWrite: true})
+			t.Cleanup(func() { _ = os.Remove(s.script.getFilename()) })
+
+			db, err := sql.Open("postgres", s.Addr())
+			require.NoError(t, err)
+			defer db.Close()
+
+			rows, err := db.Query("select id from mytable limit $1", 7)
+			require.NoError(t, err)
+			require.NoError(t, rows.Close())
+
+			if closeClient {
+				require.NoError(t, db.Close())
+			}
+
+			assert.NoError(t, s.Finish())
+			assert.NoError(t, upstream.Finish())
+			assert.Empty(t, leakedGoroutines())
+
+			recorded, err := os.ReadFile(s.script.getFilename())
+			require.NoError(t, err)
+			assert.Contains(t, string(recorded), `B {"Type":"CommandComplete","CommandTag":"SELECT 3"}`)
+		})
+	}
+}
+
+// pgx waits until the server closes the connection after Terminate, like
+// in `defer conn.Close(ctx)` that runs before `defer snap.Finish()`
+func TestSnap_proxy_terminate(t *testing.T) {
+	// the upstream is not replayed until the end
+	upstream := NewSnapWithConfig(newFakeTB(&namedTB{TB: t, name: "TestSnap_runScript_pq"}), addr, Config{})
+
+	s := NewSnapWithConfig(&namedTB{TB: t, name: "TestSnap_proxy_terminate"}, upstream.Addr(), Config{ForceWrite: true})
+	t.Cleanup(func() { _ = os.Remove(s.script.getFilename()) })
+
+	conn, err := pgx.Connect(context.Background(), s.Addr())
+	require.NoError(t, err)
+
+	// pgx gives up waiting when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	assert.NoError(t, conn.Close(ctx))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "pgx waits until the context is done")
+
+	assert.NoError(t, s.Finish())
+	_ = upstream.Finish()
+}
+
+// leakedGoroutines returns the stack of the goroutines that run the proxy,
+// the fake server or the snap
+func leakedGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+
+	var leaked []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "egon12/pgsnap.(*") {
+			leaked = append(leaked, g)
+		}
+	}
+	return leaked
+}
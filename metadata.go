@@ -0,0 +1,131 @@
+package pgsnap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// StalePolicy is what to do when the snapshot is recorded with different
+// metadata, for example recorded with older schema
+type StalePolicy int
+
+const (
+	// StaleWarn only log the stale snapshot, and keep replaying it
+	StaleWarn StalePolicy = iota
+
+	// StaleFail report the stale snapshot as error
+	StaleFail
+
+	// StaleRerecord record the snapshot again from the real database
+	StaleRerecord
+)
+
+// IsSnapshotStale returns true when the snapshot of the test exists, but
+// recorded with different metadata
+func IsSnapshotStale(t testing.TB, metadata map[string]string) bool {
+	t.Helper()
+
+	script := newScript(t)
+	_, err := script.Read()
+	if err != nil {
+		return false
+	}
+
+	return len(staleKeys(script.metadata, metadata)) > 0
+}
+
+// staleKeys returns the keys which value in the snapshot is different from
+// the wanted one. Metadata that only exists in the snapshot is ignored.
+func staleKeys(recorded, want map[string]string) []string {
+	var keys []string
+	for k, v := range want {
+		if recorded[k] != v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkStale compares the snapshot metadata with the configured one. It
+// returns true when the snapshot should be recorded again.
+func (s *Snap) checkStale(script *script) bool {
+	keys := staleKeys(script.metadata, s.cfg.Metadata)
+	if len(keys) == 0 {
+		return false
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "pgsnap: snapshot %s is stale:", script.getFilename())
+	for _, k := range keys {
+		recorded, ok := script.metadata[k]
+		if !ok {
+			recorded = "(not recorded)"
+		}
+		fmt.Fprintf(b, "\n  %s: recorded %s, now %s", k, recorded, s.cfg.Metadata[k])
+	}
+
+	switch s.cfg.OnStale {
+	case StaleFail:
+		s.reporter.Errorf("%s", b.String())
+	case StaleRerecord:
+		s.reporter.Logf("%s\nrecording it again", b.String())
+		return true
+	default:
+		s.reporter.Logf("%s", b.String())
+	}
+
+	return false
+}
+
+// mergeMetadata returns a new map that contains both metadata, the value in
+// b is used when the key exists in both
+func mergeMetadata(a, b map[string]string) map[string]string {
+	if len(b) == 0 {
+		return a
+	}
+
+	m := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		m[k] = v
+	}
+	for k, v := range b {
+		m[k] = v
+	}
+	return m
+}
+
+// writeMetadata write metadata in the head of snapshot file, sorted by key
+// so it does not make noise in the diff
+func writeMetadata(w io.Writer, metadata map[string]string) error {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if strings.ContainsAny(k, " \n") || strings.Contains(metadata[k], "\n") {
+			return fmt.Errorf("invalid metadata %q: %q", k, metadata[k])
+		}
+
+		if _, err := fmt.Fprintf(w, "M %s %s\n", k, metadata[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseMetadata parse line "M key value" without the prefix
+func parseMetadata(src []byte) (string, string, error) {
+	kv := strings.SplitN(strings.TrimSpace(string(src)), " ", 2)
+	if len(kv) != 2 {
+		return "", "", errors.New("invalid metadata: " + string(src))
+	}
+	return kv[0], kv[1], nil
+}
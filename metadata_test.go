@@ -0,0 +1,53 @@
+package pgsnap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_writeMetadata(t *testing.T) {
+	b := &strings.Builder{}
+	err := writeMetadata(b, map[string]string{
+		"schema":   "sha256:abc",
+		"fixtures": "sha256:def",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "M fixtures sha256:def\nM schema sha256:abc\n", b.String())
+
+	err = writeMetadata(b, map[string]string{"with space": "value"})
+	assert.Error(t, err)
+}
+
+func Test_readScript_metadata(t *testing.T) {
+	s := &script{t: t}
+	_, err := s.readScript(strings.NewReader("M schema sha256:abc\n" + `F {"Type":"Query","String":";"}` + "\n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"schema": "sha256:abc"}, s.metadata)
+}
+
+func Test_staleKeys(t *testing.T) {
+	recorded := map[string]string{"schema": "sha256:abc", "postgres": "15"}
+
+	assert.Empty(t, staleKeys(recorded, map[string]string{"schema": "sha256:abc"}))
+	assert.Equal(t, []string{"schema"}, staleKeys(recorded, map[string]string{"schema": "sha256:def"}))
+	assert.Equal(t, []string{"fixtures"}, staleKeys(recorded, map[string]string{"fixtures": "sha256:abc"}))
+}
+
+func TestIsSnapshotStale(t *testing.T) {
+	// use the snapshot of TestSnap_runScript_pgx that recorded without metadata
+	tb := &namedTB{TB: t, name: "TestSnap_runScript_pgx"}
+	assert.True(t, IsSnapshotStale(tb, map[string]string{"schema": "sha256:abc"}))
+	assert.False(t, IsSnapshotStale(tb, nil))
+}
+
+type namedTB struct {
+	testing.TB
+	name string
+}
+
+func (n *namedTB) Name() string {
+	return n.name
+}
@@ -0,0 +1,150 @@
+package pgsnap
+
+import "fmt"
+
+// nameMapping binds the prepared statement and portal names sent by the
+// client to the names in the snapshot. The names are generated by the
+// driver (like lrupsc_5_0 in pgx v4 or stmtcache_* in pgx v5), so they are
+// different from the recorded ones, but they should be used consistently in
+// one connection: the statement that parsed as stmt_1 should be described,
+// bound and closed as stmt_1.
+//
+// The client names are bound on Parse (statement) and Bind (portal), and
+// unbound on Close. The name that never bound is compared as is.
+//
+// The nil nameMapping ignores the statement names and compares the portal
+// names as is.
+type nameMapping struct {
+	// statements and portals are the recorded names by the client names,
+	// clientStatements and clientPortals are the other way around, the
+	// client names in the order they are bound
+	statements       map[string]string
+	portals          map[string]string
+	clientStatements map[string][]string
+	clientPortals    map[string][]string
+}
+
+func newNameMapping() *nameMapping {
+	return &nameMapping{
+		statements:       map[string]string{},
+		portals:          map[string]string{},
+		clientStatements: map[string][]string{},
+		clientPortals:    map[string][]string{},
+	}
+}
+
+func (n *nameMapping) bindStatement(client, recorded string) {
+	if n != nil {
+		bindName(n.statements, n.clientStatements, client, recorded)
+	}
+}
+
+func (n *nameMapping) bindPortal(client, recorded string) {
+	if n != nil {
+		bindName(n.portals, n.clientPortals, client, recorded)
+	}
+}
+
+func bindName(bound map[string]string, clients map[string][]string, client, recorded string) {
+	unbindName(bound, clients, client)
+	bound[client] = recorded
+	clients[recorded] = append(clients[recorded], client)
+}
+
+func unbindName(bound map[string]string, clients map[string][]string, client string) {
+	recorded, ok := bound[client]
+	if !ok {
+		return
+	}
+	delete(bound, client)
+
+	names := clients[recorded]
+	for i, name := range names {
+		if name == client {
+			names = append(names[:i:i], names[i+1:]...)
+			break
+		}
+	}
+	if len(names) == 0 {
+		delete(clients, recorded)
+	} else {
+		clients[recorded] = names
+	}
+}
+
+// client returns the last client name that bound to the recorded statement
+// ('S') or portal ('P'), or the recorded name when it's not bound
+func (n *nameMapping) client(objectType byte, recorded string) string {
+	if n == nil {
+		return recorded
+	}
+
+	clients := n.clientPortals
+	if objectType == 'S' {
+		clients = n.clientStatements
+	}
+
+	if names := clients[recorded]; len(names) > 0 {
+		return names[len(names)-1]
+	}
+	return recorded
+}
+
+// close unbind the statement ('S') or the portal ('P')
+func (n *nameMapping) close(objectType byte, client string) {
+	if n == nil {
+		return
+	}
+
+	if objectType == 'S' {
+		unbindName(n.statements, n.clientStatements, client)
+	} else {
+		unbindName(n.portals, n.clientPortals, client)
+	}
+}
+
+// checkStatement returns error when the client statement is not the recorded
+// one
+func (n *nameMapping) checkStatement(client, want string) error {
+	if n == nil {
+		return nil
+	}
+
+	return compareName("statement", n.statements, client, want)
+}
+
+// checkPortal returns error when the client portal is not the recorded one
+func (n *nameMapping) checkPortal(client, want string) error {
+	var portals map[string]string
+	if n != nil {
+		portals = n.portals
+	}
+
+	return compareName("portal", portals, client, want)
+}
+
+// check returns error when the client statement or portal is not the
+// recorded one
+func (n *nameMapping) check(objectType byte, client, want string) error {
+	if objectType == 'S' {
+		return n.checkStatement(client, want)
+	}
+	return n.checkPortal(client, want)
+}
+
+func compareName(kind string, bound map[string]string, client, want string) error {
+	got, ok := bound[client]
+	if !ok {
+		got = client
+	}
+
+	if got == want {
+		return nil
+	}
+
+	if !ok {
+		return fmt.Errorf("msg => %s: %s, want => %s: %s", kind, client, kind, want)
+	}
+
+	return fmt.Errorf("msg => %s: %s (recorded as %s), want => %s: %s", kind, client, got, kind, want)
+}
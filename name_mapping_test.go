@@ -0,0 +1,107 @@
+package pgsnap
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_nameMapping(t *testing.T) {
+	t.Run("statement cache evict and reuse the name", func(t *testing.T) {
+		names := newNameMapping()
+		for i, tt := range []struct {
+			step comparer
+			msg  pgproto3.FrontendMessage
+		}{
+			{&expectParseMessage{want: &pgproto3.Parse{Name: "stmt_1", Query: "select 1"}, names: names}, &pgproto3.Parse{Name: "stmtcache_a1", Query: "select 1"}},
+			{&expectDescribeMessage{want: &pgproto3.Describe{ObjectType: 'S', Name: "stmt_1"}, names: names}, &pgproto3.Describe{ObjectType: 'S', Name: "stmtcache_a1"}},
+			{&expectBindMessage{want: &pgproto3.Bind{PreparedStatement: "stmt_1"}, names: names}, &pgproto3.Bind{PreparedStatement: "stmtcache_a1"}},
+			{&expectExecuteMessage{want: &pgproto3.Execute{}, names: names}, &pgproto3.Execute{}},
+			{&expectCloseMessage{want: &pgproto3.Close{ObjectType: 'S', Name: "stmt_1"}, names: names}, &pgproto3.Close{ObjectType: 'S', Name: "stmtcache_a1"}},
+			{&expectParseMessage{want: &pgproto3.Parse{Name: "stmt_2", Query: "select 2"}, names: names}, &pgproto3.Parse{Name: "stmtcache_a1", Query: "select 2"}},
+			{&expectBindMessage{want: &pgproto3.Bind{PreparedStatement: "stmt_2"}, names: names}, &pgproto3.Bind{PreparedStatement: "stmtcache_a1"}},
+		} {
+			assert.NoError(t, tt.step.compare(tt.msg), "step %d", i)
+		}
+	})
+
+	t.Run("statement bound to the other recorded statement", func(t *testing.T) {
+		names := newNameMapping()
+		parse := &expectParseMessage{want: &pgproto3.Parse{Name: "stmt_1", Query: "select 1"}, names: names}
+		assert.NoError(t, parse.compare(&pgproto3.Parse{Name: "lrupsc_1_0", Query: "select 1"}))
+		parse = &expectParseMessage{want: &pgproto3.Parse{Name: "stmt_2", Query: "select 2"}, names: names}
+		assert.NoError(t, parse.compare(&pgproto3.Parse{Name: "lrupsc_1_1", Query: "select 2"}))
+
+		bind := &expectBindMessage{want: &pgproto3.Bind{PreparedStatement: "stmt_2"}, names: names}
+		assert.Equal(t,
+			errors.New("msg => statement: lrupsc_1_0 (recorded as stmt_1), want => statement: stmt_2"),
+			bind.compare(&pgproto3.Bind{PreparedStatement: "lrupsc_1_0"}),
+		)
+	})
+
+	t.Run("closed statement is unbound", func(t *testing.T) {
+		names := newNameMapping()
+		names.bindStatement("lrupsc_1_0", "stmt_1")
+		names.close('S', "lrupsc_1_0")
+
+		assert.Equal(t,
+			errors.New("msg => statement: lrupsc_1_0, want => statement: stmt_1"),
+			names.checkStatement("lrupsc_1_0", "stmt_1"),
+		)
+	})
+
+	t.Run("named portal", func(t *testing.T) {
+		names := newNameMapping()
+		bind := &expectBindMessage{want: &pgproto3.Bind{DestinationPortal: "portal_1"}, names: names}
+		assert.NoError(t, bind.compare(&pgproto3.Bind{DestinationPortal: "cursor_x"}))
+
+		describe := &expectDescribeMessage{want: &pgproto3.Describe{ObjectType: 'P', Name: "portal_1"}, names: names}
+		assert.NoError(t, describe.compare(&pgproto3.Describe{ObjectType: 'P', Name: "cursor_x"}))
+
+		execute := &expectExecuteMessage{want: &pgproto3.Execute{Portal: "portal_1", MaxRows: 10}, names: names}
+		assert.NoError(t, execute.compare(&pgproto3.Execute{Portal: "cursor_x", MaxRows: 10}))
+		assert.Equal(t,
+			errors.New("msg => MaxRows: 5, want => MaxRows: 10"),
+			execute.compare(&pgproto3.Execute{Portal: "cursor_x", MaxRows: 5}),
+		)
+		assert.Equal(t,
+			errors.New("msg => portal: cursor_y, want => portal: portal_1"),
+			execute.compare(&pgproto3.Execute{Portal: "cursor_y", MaxRows: 10}),
+		)
+
+		closing := &expectCloseMessage{want: &pgproto3.Close{ObjectType: 'P', Name: "portal_1"}, names: names}
+		assert.NoError(t, closing.compare(&pgproto3.Close{ObjectType: 'P', Name: "cursor_x"}))
+		assert.Error(t, execute.compare(&pgproto3.Execute{Portal: "cursor_x", MaxRows: 10}))
+	})
+
+	t.Run("client name of the recorded one", func(t *testing.T) {
+		names := newNameMapping()
+		names.bindStatement("lrupsc_1_0", "stmt_1")
+		names.bindStatement("lrupsc_1_1", "stmt_1")
+		names.bindPortal("cursor_x", "portal_1")
+		assert.Equal(t, "lrupsc_1_1", names.client('S', "stmt_1"))
+		assert.Equal(t, "cursor_x", names.client('P', "portal_1"))
+
+		// rebound to the other recorded statement
+		names.bindStatement("lrupsc_1_1", "stmt_2")
+		assert.Equal(t, "lrupsc_1_0", names.client('S', "stmt_1"))
+		assert.Equal(t, "lrupsc_1_1", names.client('S', "stmt_2"))
+
+		names.close('S', "lrupsc_1_0")
+		names.close('S', "lrupsc_1_1")
+		names.close('P', "cursor_x")
+		assert.Equal(t, "stmt_1", names.client('S', "stmt_1"))
+		assert.Equal(t, "stmt_2", names.client('S', "stmt_2"))
+		assert.Equal(t, "portal_1", names.client('P', "portal_1"))
+	})
+
+	t.Run("nil mapping ignores statement name", func(t *testing.T) {
+		var names *nameMapping
+		names.bindStatement("a", "b")
+		names.close('S', "a")
+		assert.NoError(t, names.checkStatement("a", "b"))
+		assert.Error(t, names.checkPortal("a", "b"))
+	})
+}
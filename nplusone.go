@@ -0,0 +1,131 @@
+package pgsnap
+
+import (
+	"strings"
+	"unicode"
+)
+
+// RepeatedQuery is a query shape that executed repeatedly in one test. It's
+// usually caused by N+1 query, a loop that issue the same SELECT per row.
+type RepeatedQuery struct {
+	// Shape is the SQL with the literals replaced by '?'
+	Shape string
+
+	// Count is how many times the shape is executed
+	Count int
+}
+
+// RepeatedQueries returns the SELECT query shapes that executed at least
+// threshold times, ordered by the first execution.
+func (s *Snap) RepeatedQueries(threshold int) []RepeatedQuery {
+	return findRepeatedQueries(s.Queries(), threshold)
+}
+
+// detectNPlusOne report the repeated queries when the NPlusOneThreshold is
+// configured
+func (s *Snap) detectNPlusOne() {
+	if s.cfg.NPlusOneThreshold <= 0 {
+		return
+	}
+
+	report := s.reporter.Errorf
+	if s.cfg.NPlusOneWarnOnly {
+		report = s.reporter.Logf
+	}
+
+	for _, r := range s.RepeatedQueries(s.cfg.NPlusOneThreshold) {
+		report("pgsnap: possible N+1 query, executed %d times: %s", r.Count, r.Shape)
+	}
+}
+
+func findRepeatedQueries(queries []Query, threshold int) []RepeatedQuery {
+	if threshold <= 0 {
+		return nil
+	}
+
+	var shapes []string
+	counts := map[string]int{}
+
+	for _, q := range queries {
+		if !isSelect(q) {
+			continue
+		}
+
+		shape := queryShape(q.SQL)
+		if _, ok := counts[shape]; !ok {
+			shapes = append(shapes, shape)
+		}
+		counts[shape]++
+	}
+
+	var result []RepeatedQuery
+	for _, shape := range shapes {
+		if counts[shape] >= threshold {
+			result = append(result, RepeatedQuery{Shape: shape, Count: counts[shape]})
+		}
+	}
+
+	return result
+}
+
+func isSelect(q Query) bool {
+	if q.CommandTag != "" {
+		return firstWord(q.CommandTag) == "SELECT"
+	}
+	return firstWord(q.SQL) == "SELECT"
+}
+
+// queryShape collapse the whitespaces and replace the literal string and
+// number with '?', so the query with inlined values can be grouped together.
+// The placeholder like $1 is kept as it is.
+func queryShape(sql string) string {
+	b := &strings.Builder{}
+	runes := []rune(strings.TrimSpace(sql))
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case r == '\'':
+			// skip until the closing quote, '' is an escaped quote
+			for i++; i < len(runes); i++ {
+				if runes[i] != '\'' {
+					continue
+				}
+				if i+1 < len(runes) && runes[i+1] == '\'' {
+					i++
+					continue
+				}
+				break
+			}
+			b.WriteRune('?')
+
+		case unicode.IsDigit(r) && !isIdentifierPart(runes, i-1):
+			for i+1 < len(runes) && (unicode.IsDigit(runes[i+1]) || runes[i+1] == '.') {
+				i++
+			}
+			b.WriteRune('?')
+
+		case unicode.IsSpace(r):
+			for i+1 < len(runes) && unicode.IsSpace(runes[i+1]) {
+				i++
+			}
+			b.WriteRune(' ')
+
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return strings.TrimRight(b.String(), "; ")
+}
+
+// isIdentifierPart returns true when runes[i] is part of identifier or
+// placeholder, so the digit after it is not a literal
+func isIdentifierPart(runes []rune, i int) bool {
+	if i < 0 {
+		return false
+	}
+	r := runes[i]
+	return r == '$' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
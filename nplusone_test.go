@@ -0,0 +1,99 @@
+package pgsnap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_queryShape(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{
+			sql:  "select id from mytable where id = $1",
+			want: "select id from mytable where id = $1",
+		},
+		{
+			sql:  "select id from   mytable\n\twhere id = 12 and name = 'O''Brien';",
+			want: "select id from mytable where id = ? and name = ?",
+		},
+		{
+			sql:  "select t1.id, 1.5 from t1",
+			want: "select t1.id, ? from t1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			assert.Equal(t, tt.want, queryShape(tt.sql))
+		})
+	}
+}
+
+func Test_findRepeatedQueries(t *testing.T) {
+	queries := []Query{
+		{SQL: "select * from product", CommandTag: "SELECT 3"},
+		{SQL: "select * from stock where product_id = $1", Args: []interface{}{1}, CommandTag: "SELECT 1"},
+		{SQL: "select * from stock where product_id = $1", Args: []interface{}{2}, CommandTag: "SELECT 1"},
+		{SQL: "update stock set qty = 1 where product_id = $1", CommandTag: "UPDATE 1"},
+		{SQL: "update stock set qty = 1 where product_id = $1", CommandTag: "UPDATE 1"},
+		{SQL: "update stock set qty = 1 where product_id = $1", CommandTag: "UPDATE 1"},
+		{SQL: "select * from stock where product_id = 3", CommandTag: "SELECT 1"},
+	}
+
+	assert.Equal(t, []RepeatedQuery{
+		{Shape: "select * from stock where product_id = $1", Count: 2},
+	}, findRepeatedQueries(queries, 2))
+
+	assert.Empty(t, findRepeatedQueries(queries, 3))
+	assert.Empty(t, findRepeatedQueries(queries, 0))
+
+	assert.Equal(t, []RepeatedQuery{
+		{Shape: "select * from stock where product_id = ?", Count: 2},
+	}, findRepeatedQueries([]Query{
+		{SQL: "select * from stock where product_id = 1"},
+		{SQL: "select * from stock where product_id = 2"},
+	}, 2))
+}
+
+// runNPlusOne replays the snapshot that select the name per id
+func runNPlusOne(t *testing.T, s *Snap) {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, s.Addr())
+	require.NoError(t, err)
+
+	for _, id := range []string{"1", "2", "3"} {
+		_, err := conn.Exec(ctx, "select name from mytable where id = "+id)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, conn.Close(ctx))
+}
+
+func TestSnap_nPlusOne(t *testing.T) {
+	tb := newFakeTB(t)
+	s := NewSnapWithConfig(tb, addr, Config{NPlusOneThreshold: 3})
+	runNPlusOne(t, s)
+
+	assert.Error(t, s.Finish())
+	assert.Equal(t, []string{
+		"pgsnap: possible N+1 query, executed 3 times: select name from mytable where id = ?",
+	}, tb.ErrorMessages)
+}
+
+func TestSnap_nPlusOne_warnOnly(t *testing.T) {
+	tb := &namedTB{TB: t, name: "TestSnap_nPlusOne"}
+
+	s := NewSnapWithConfig(tb, addr, Config{NPlusOneThreshold: 3, NPlusOneWarnOnly: true})
+	runNPlusOne(t, s)
+	assert.NoError(t, s.Finish())
+
+	// below the threshold
+	s = NewSnapWithConfig(tb, addr, Config{NPlusOneThreshold: 4})
+	runNPlusOne(t, s)
+	assert.NoError(t, s.Finish())
+}
@@ -0,0 +1,562 @@
+package pgsnap
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+)
+
+type (
+	// Plan is the result of EXPLAIN (FORMAT JSON) of a query, captured
+	// while recording the snapshot
+	Plan struct {
+		SQL  string          `json:"sql"`
+		Plan json.RawMessage `json:"plan"`
+
+		// RelationRows is the estimated rows of the sequentially scanned
+		// relations, the whole relation not only the filtered rows. The
+		// key is the relation name with the schema, like public.mytable
+		RelationRows map[string]float64 `json:"relationRows,omitempty"`
+	}
+
+	// Plans is the content of plans file that saved next to the snapshot
+	Plans []Plan
+
+	// PlanDiff is a query that have different plan between two recordings
+	PlanDiff struct {
+		SQL string
+		Old string
+		New string
+	}
+
+	// planNode is the part of EXPLAIN (FORMAT JSON) that we care about
+	planNode struct {
+		NodeType     string     `json:"Node Type"`
+		Schema       string     `json:"Schema"`
+		RelationName string     `json:"Relation Name"`
+		IndexName    string     `json:"Index Name"`
+		PlanRows     float64    `json:"Plan Rows"`
+		Plans        []planNode `json:"Plans"`
+	}
+)
+
+// LoadPlans read the plans file
+func LoadPlans(path string) (Plans, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var plans Plans
+	if err := json.Unmarshal(b, &plans); err != nil {
+		return nil, fmt.Errorf("cannot read plans %s: %w", path, err)
+	}
+
+	return plans, nil
+}
+
+// Save write the plans into file
+func (p Plans) Save(path string) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// DiffPlans compare the shape of the plans (node types, relations and
+// indexes) of the query that exists in both recordings. Cost and rows
+// estimation are ignored, because it's always changing.
+func DiffPlans(old, new Plans) []PlanDiff {
+	oldShapes := map[string]string{}
+	for _, p := range old {
+		oldShapes[p.SQL] = p.Shape()
+	}
+
+	var diffs []PlanDiff
+	for _, p := range new {
+		oldShape, ok := oldShapes[p.SQL]
+		if !ok {
+			continue
+		}
+
+		if newShape := p.Shape(); newShape != oldShape {
+			diffs = append(diffs, PlanDiff{SQL: p.SQL, Old: oldShape, New: newShape})
+		}
+	}
+
+	return diffs
+}
+
+// Shape returns the plan tree in a single line, like
+// "Limit -> (Seq Scan on mytable)"
+func (p Plan) Shape() string {
+	root, err := p.root()
+	if err != nil {
+		return "invalid plan: " + err.Error()
+	}
+	return root.shape()
+}
+
+// SeqScans returns the relations that sequentially scanned with at least
+// minRows rows. The size is taken from RelationRows, the Plan Rows of the
+// scan (the rows after the filter) is only used when it's not there. The
+// relation has the schema when the plan is explained with VERBOSE
+func (p Plan) SeqScans(minRows float64) []string {
+	var relations []string
+	for _, n := range p.seqScanNodes() {
+		rows, ok := p.RelationRows[n.relation()]
+		if !ok {
+			rows = n.PlanRows
+		}
+		if rows >= minRows {
+			relations = append(relations, n.relation())
+		}
+	}
+	return relations
+}
+
+func (p Plan) seqScanNodes() []planNode {
+	root, err := p.root()
+	if err != nil {
+		return nil
+	}
+
+	var nodes []planNode
+	root.walk(func(n planNode) {
+		if n.NodeType == "Seq Scan" {
+			nodes = append(nodes, n)
+		}
+	})
+	return nodes
+}
+
+func (p Plan) root() (planNode, error) {
+	var explain []struct {
+		Plan planNode `json:"Plan"`
+	}
+
+	if err := json.Unmarshal(p.Plan, &explain); err != nil {
+		return planNode{}, err
+	}
+
+	if len(explain) == 0 {
+		return planNode{}, fmt.Errorf("empty plan")
+	}
+
+	return explain[0].Plan, nil
+}
+
+func (n planNode) shape() string {
+	s := n.NodeType
+	if n.RelationName != "" {
+		s += " on " + n.RelationName
+	}
+	if n.IndexName != "" {
+		s += " using " + n.IndexName
+	}
+
+	if len(n.Plans) == 0 {
+		return s
+	}
+
+	children := make([]string, len(n.Plans))
+	for i, c := range n.Plans {
+		children[i] = c.shape()
+	}
+	return s + " -> (" + strings.Join(children, ", ") + ")"
+}
+
+// relation returns the relation name with the schema, if it's known
+func (n planNode) relation() string {
+	if n.Schema == "" {
+		return n.RelationName
+	}
+	return n.Schema + "." + n.RelationName
+}
+
+func (n planNode) walk(f func(planNode)) {
+	f(n)
+	for _, c := range n.Plans {
+		c.walk(f)
+	}
+}
+
+// explainName is the statement and portal that used to explain the query
+// with parameters, so the unnamed ones of the client are kept
+const explainName = "pgsnap_explain"
+
+// explainSavepoint keeps the client transaction when EXPLAIN fails
+const explainSavepoint = "pgsnap_explain"
+
+type (
+	// planCapture runs EXPLAIN (VERBOSE, FORMAT JSON) for each distinct
+	// query in the upstream session of the proxy, right after the query is
+	// answered. So the plan is made with the data the query ran against,
+	// which is only visible in that session in the sandbox.
+	//
+	// The EXPLAIN is sent as another batch, and its responses are not
+	// forwarded to the client. The client gets the response of its query
+	// after the EXPLAIN is answered, so its next batch is sent after it. Inside transaction, it's wrapped in a
+	// savepoint, so the failed EXPLAIN doesn't abort the client transaction.
+	planCapture struct {
+		mu sync.Mutex
+
+		// report is called when the query can't be explained
+		report func(format string, args ...interface{})
+
+		seen  map[string]bool
+		plans Plans
+
+		// relationRows is the estimated rows of the relations that
+		// already explained, or being explained
+		relationRows map[string]float64
+
+		// sent and answered count the batches sent to postgres, and the
+		// ReadyForQuery received. own is the batches sent by planCapture
+		// by their number
+		sent     int
+		answered int
+		own      map[int]*planBatch
+	}
+
+	// planBatch is the batch sent by planCapture, it's answered by one
+	// ReadyForQuery
+	planBatch struct {
+		msgs []pgproto3.FrontendMessage
+
+		// done is called after the batch is answered, it's nil for the
+		// savepoint queries
+		done func(b *planBatch)
+
+		// rows is the first value of each DataRow
+		rows [][]byte
+		err  *pgproto3.ErrorResponse
+	}
+)
+
+func newPlanCapture(report func(format string, args ...interface{})) *planCapture {
+	return &planCapture{
+		report:       report,
+		seen:         map[string]bool{},
+		relationRows: map[string]float64{},
+		own:          map[int]*planBatch{},
+	}
+}
+
+// sending counts the batches of the client that sent to postgres, every
+// Sync and Query is answered by one ReadyForQuery
+func (c *planCapture) sending(msgs ...pgproto3.FrontendMessage) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, msg := range msgs {
+		switch msg.(type) {
+		case *pgproto3.Sync, *pgproto3.Query:
+			c.sent++
+		}
+	}
+}
+
+// inject sends the batches of planCapture. The caller must make sure no
+// other message is sent at the same time
+func (c *planCapture) inject(batches []*planBatch, send func(msgs ...pgproto3.FrontendMessage) error) error {
+	for _, b := range batches {
+		c.mu.Lock()
+		c.own[c.sent] = b
+		c.sent++
+		c.mu.Unlock()
+
+		if err := send(b.msgs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consume returns true when the message is the response of the batch sent
+// by planCapture. When the batch is answered, its done is called
+func (c *planCapture) consume(msg pgproto3.BackendMessage) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	_, ready := msg.(*pgproto3.ReadyForQuery)
+
+	b, ok := c.own[c.answered]
+	if !ok {
+		if ready {
+			c.answered++
+		}
+		c.mu.Unlock()
+		return false
+	}
+
+	switch m := msg.(type) {
+	case *pgproto3.DataRow:
+		if len(m.Values) > 0 {
+			b.rows = append(b.rows, append([]byte(nil), m.Values[0]...))
+		}
+	case *pgproto3.ErrorResponse:
+		if b.err == nil {
+			errResponse := *m
+			b.err = &errResponse
+		}
+	case *pgproto3.ReadyForQuery:
+		delete(c.own, c.answered)
+		c.answered++
+	}
+	c.mu.Unlock()
+
+	if ready && b.done != nil {
+		b.done(b)
+	}
+
+	return true
+}
+
+// pending returns true when a batch of planCapture is not answered yet
+func (c *planCapture) pending() bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.own) > 0
+}
+
+// explain returns the batches that explain the new queries. txStatus is the
+// status of the database after the batch of the queries
+func (c *planCapture) explain(queries []executedQuery, txStatus byte) []*planBatch {
+	if c == nil || txStatus == 'E' {
+		// it fails in the aborted transaction, the query is explained
+		// when it's executed again
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var batches []*planBatch
+	for _, q := range queries {
+		if c.seen[q.sql] || !isExplainable(q.sql) {
+			continue
+		}
+		c.seen[q.sql] = true
+
+		sql := q.sql
+		batches = append(batches, wrapPlanBatch(txStatus, &planBatch{
+			msgs: explainMessages(q),
+			done: func(b *planBatch) { c.explained(sql, b) },
+		})...)
+	}
+	return batches
+}
+
+// explained keeps the plan of the query
+func (c *planCapture) explained(sql string, b *planBatch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if b.err != nil || len(b.rows) == 0 {
+		c.report("pgsnap: cannot explain %s: %v", sql, b.error())
+		return
+	}
+
+	c.plans = append(c.plans, Plan{SQL: sql, Plan: json.RawMessage(b.rows[0])})
+}
+
+// relations returns the batches that estimate the rows of the sequentially
+// scanned relations, that are not estimated yet
+func (c *planCapture) relations(txStatus byte) []*planBatch {
+	if c == nil || txStatus == 'E' {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var relations []string
+	var stmts []string
+	for _, p := range c.plans {
+		for _, n := range p.seqScanNodes() {
+			rel := n.relation()
+			if _, ok := c.relationRows[rel]; ok {
+				continue
+			}
+			c.relationRows[rel] = -1
+
+			relations = append(relations, rel)
+			stmts = append(stmts, "EXPLAIN (FORMAT JSON) SELECT * FROM "+n.identifier())
+		}
+	}
+	if len(relations) == 0 {
+		return nil
+	}
+
+	return wrapPlanBatch(txStatus, &planBatch{
+		msgs: []pgproto3.FrontendMessage{&pgproto3.Query{String: strings.Join(stmts, "; ")}},
+		done: func(b *planBatch) { c.estimated(relations, b) },
+	})
+}
+
+// estimated keeps the rows of the relations, from the plan of the unfiltered
+// scan. Unlike reltuples, it's also estimated for the table that never
+// analyzed
+func (c *planCapture) estimated(relations []string, b *planBatch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if b.err != nil || len(b.rows) != len(relations) {
+		c.report("pgsnap: cannot estimate the rows of %s: %v", strings.Join(relations, ", "), b.error())
+		return
+	}
+
+	for i, rel := range relations {
+		root, err := (Plan{Plan: b.rows[i]}).root()
+		if err != nil {
+			c.report("pgsnap: cannot estimate the rows of %s: %v", rel, err)
+			continue
+		}
+		c.relationRows[rel] = root.PlanRows
+	}
+}
+
+// result returns the captured plans with the rows of the relations
+func (c *planCapture) result() Plans {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	plans := make(Plans, len(c.plans))
+	for i, p := range c.plans {
+		for _, n := range p.seqScanNodes() {
+			rows, ok := c.relationRows[n.relation()]
+			if !ok || rows < 0 {
+				continue
+			}
+			if p.RelationRows == nil {
+				p.RelationRows = map[string]float64{}
+			}
+			p.RelationRows[n.relation()] = rows
+		}
+		plans[i] = p
+	}
+	return plans
+}
+
+// error returns the error of the batch that has no result
+func (b *planBatch) error() error {
+	if b.err != nil {
+		return errorResponseToPgError(b.err)
+	}
+	return fmt.Errorf("unexpected result, got %d rows", len(b.rows))
+}
+
+// explainMessages returns the batch that explain the query with the same
+// parameters
+func explainMessages(q executedQuery) []pgproto3.FrontendMessage {
+	sql := "EXPLAIN (VERBOSE, FORMAT JSON) " + q.sql
+	if q.portal == nil {
+		return []pgproto3.FrontendMessage{&pgproto3.Query{String: sql}}
+	}
+
+	var oids []uint32
+	if q.portal.stmt != nil {
+		oids = q.portal.stmt.oids
+	}
+
+	// the statement is closed first, in case the previous batch failed
+	// before closing it
+	return []pgproto3.FrontendMessage{
+		&pgproto3.Close{ObjectType: 'S', Name: explainName},
+		&pgproto3.Parse{Name: explainName, Query: sql, ParameterOIDs: oids},
+		&pgproto3.Bind{
+			DestinationPortal:    explainName,
+			PreparedStatement:    explainName,
+			ParameterFormatCodes: q.portal.formats,
+			Parameters:           q.portal.params,
+		},
+		&pgproto3.Execute{Portal: explainName},
+		&pgproto3.Close{ObjectType: 'S', Name: explainName},
+		&pgproto3.Sync{},
+	}
+}
+
+// wrapPlanBatch returns the batch inside the savepoint when the database is
+// inside transaction
+func wrapPlanBatch(txStatus byte, b *planBatch) []*planBatch {
+	if txStatus == 'I' {
+		return []*planBatch{b}
+	}
+
+	return []*planBatch{
+		{msgs: []pgproto3.FrontendMessage{&pgproto3.Query{String: "SAVEPOINT " + explainSavepoint}}},
+		b,
+		{msgs: []pgproto3.FrontendMessage{&pgproto3.Query{
+			String: "ROLLBACK TO SAVEPOINT " + explainSavepoint + "; RELEASE SAVEPOINT " + explainSavepoint,
+		}}},
+	}
+}
+
+// identifier returns the quoted relation name
+func (n planNode) identifier() string {
+	if n.Schema == "" {
+		return pgx.Identifier{n.RelationName}.Sanitize()
+	}
+	return pgx.Identifier{n.Schema, n.RelationName}.Sanitize()
+}
+
+// capturePlans compare the plans captured while recording with the previous
+// recording, and save it next to the snapshot
+func (s *Snap) capturePlans() {
+	if s.proxy == nil || s.proxy.plans == nil {
+		return
+	}
+
+	report := s.reporter.Errorf
+	if s.cfg.PlanWarnOnly {
+		report = s.reporter.Logf
+	}
+
+	plans := s.proxy.plans.result()
+	path := s.script.sideFilename(".plans.json")
+
+	old, err := LoadPlans(path)
+	if err != nil && !os.IsNotExist(err) {
+		s.reporter.Errorf("pgsnap: %v", err)
+	}
+
+	for _, d := range DiffPlans(old, plans) {
+		report("pgsnap: plan changed for %s\nold: %s\nnew: %s", d.SQL, d.Old, d.New)
+	}
+
+	for _, p := range plans {
+		for _, rel := range p.SeqScans(s.cfg.SeqScanThreshold) {
+			report("pgsnap: sequential scan on %s for %s", rel, p.SQL)
+		}
+	}
+
+	if err := plans.Save(path); err != nil {
+		s.reporter.Errorf("pgsnap: cannot save plans %s: %v", path, err)
+	}
+}
+
+func isExplainable(sql string) bool {
+	switch firstWord(sql) {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "WITH", "VALUES", "TABLE", "MERGE":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package pgsnap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	seqScanPlan = `[{"Plan":{"Node Type":"Limit","Plan Rows":7,"Plans":[` +
+		`{"Node Type":"Seq Scan","Relation Name":"mytable","Plan Rows":2550}]}}]`
+
+	indexScanPlan = `[{"Plan":{"Node Type":"Limit","Plan Rows":7,"Plans":[` +
+		`{"Node Type":"Index Scan","Relation Name":"mytable","Index Name":"mytable_pkey","Plan Rows":7}]}}]`
+)
+
+func TestPlan_Shape(t *testing.T) {
+	p := Plan{SQL: "select id from mytable limit $1", Plan: json.RawMessage(seqScanPlan)}
+	assert.Equal(t, "Limit -> (Seq Scan on mytable)", p.Shape())
+
+	p = Plan{SQL: "select id from mytable limit $1", Plan: json.RawMessage(indexScanPlan)}
+	assert.Equal(t, "Limit -> (Index Scan on mytable using mytable_pkey)", p.Shape())
+}
+
+func TestPlan_SeqScans(t *testing.T) {
+	p := Plan{SQL: "select id from mytable limit $1", Plan: json.RawMessage(seqScanPlan)}
+	assert.Equal(t, []string{"mytable"}, p.SeqScans(1000))
+	assert.Empty(t, p.SeqScans(5000))
+}
+
+func TestDiffPlans(t *testing.T) {
+	old := Plans{
+		{SQL: "select id from mytable limit $1", Plan: json.RawMessage(indexScanPlan)},
+		{SQL: "select 1", Plan: json.RawMessage(`[{"Plan":{"Node Type":"Result"}}]`)},
+	}
+	new := Plans{
+		{SQL: "select id from mytable limit $1", Plan: json.RawMessage(seqScanPlan)},
+		{SQL: "select 1", Plan: json.RawMessage(`[{"Plan":{"Node Type":"Result","Plan Rows":1}}]`)},
+		{SQL: "select 2", Plan: json.RawMessage(`[{"Plan":{"Node Type":"Result"}}]`)},
+	}
+
+	assert.Equal(t, []PlanDiff{{
+		SQL: "select id from mytable limit $1",
+		Old: "Limit -> (Index Scan on mytable using mytable_pkey)",
+		New: "Limit -> (Seq Scan on mytable)",
+	}}, DiffPlans(old, new))
+}
+
+func TestPlans_SaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pgsnap_test.plans.json")
+	plans := Plans{{SQL: "select id from mytable limit $1", Plan: json.RawMessage(seqScanPlan)}}
+
+	require.NoError(t, plans.Save(path))
+
+	loaded, err := LoadPlans(path)
+	require.NoError(t, err)
+	require.Len(t, loaded, 1)
+	assert.Equal(t, plans[0].SQL, loaded[0].SQL)
+	assert.Equal(t, plans[0].Shape(), loaded[0].Shape())
+}
+
+func TestPlan_SeqScans_relationRows(t *testing.T) {
+	// the filter leaves 1 row, but the whole table is scanned
+	filtered := `[{"Plan":{"Node Type":"Seq Scan","Relation Name":"mytable","Plan Rows":1}}]`
+
+	p := Plan{SQL: "select id from mytable where name = 'Budi'", Plan: json.RawMessage(filtered)}
+	assert.Empty(t, p.SeqScans(1000))
+
+	p.RelationRows = map[string]float64{"mytable": 2550}
+	assert.Equal(t, []string{"mytable"}, p.SeqScans(1000))
+	assert.Empty(t, p.SeqScans(5000))
+}
+
+func TestSnap_capturePlans(t *testing.T) {
+	for _, warnOnly := range []bool{false, true} {
+		t.Run(fmt.Sprintf("warnOnly=%v", warnOnly), func(t *testing.T) {
+			// the fake server is used as the database, it expects EXPLAIN
+			// after each query in the same session
+			upstream := NewSnapWithConfig(&namedTB{TB: t, name: "TestSnap_capturePlans_upstream"}, addr, Config{})
+
+			tb := newFakeTB(t)
+			s := NewSnapWithConfig(tb, upstream.Addr(), Config{ForceWrite: true, CapturePlans: true, PlanWarnOnly: warnOnly})
+			path := s.script.sideFilename(".plans.json")
+			t.Cleanup(func() {
+				_ = os.Remove(s.script.getFilename())
+				_ = os.Remove(path)
+			})
+
+			ctx := context.Background()
+			conn, err := pgx.Connect(ctx, s.Addr())
+			require.NoError(t, err)
+
+			_, err = conn.Exec(ctx, "select id from mytable where name = 'Budi'")
+			require.NoError(t, err)
+
+			// explained inside the savepoint, with the same parameter
+			tx, err := conn.Begin(ctx)
+			require.NoError(t, err)
+			_, err = tx.Exec(ctx, "select id from mytable where id = $1", 7)
+			require.NoError(t, err)
+			require.NoError(t, tx.Commit(ctx))
+
+			require.NoError(t, conn.Close(ctx))
+
+			// the scan returns 1 row, but the table has 2550 rows
+			if warnOnly {
+				assert.NoError(t, s.Finish())
+			} else {
+				assert.Error(t, s.Finish())
+				assert.Equal(t, []string{
+					"pgsnap: sequential scan on public.mytable for select id from mytable where name = 'Budi'",
+				}, tb.ErrorMessages)
+			}
+			assert.NoError(t, upstream.Finish())
+
+			// EXPLAIN is not in the snapshot
+			recorded, err := os.ReadFile(s.script.getFilename())
+			require.NoError(t, err)
+			assert.NotContains(t, string(recorded), "EXPLAIN")
+			assert.NotContains(t, string(recorded), "pgsnap_explain")
+
+			plans, err := LoadPlans(path)
+			require.NoError(t, err)
+			require.Len(t, plans, 2)
+			assert.Equal(t, "Seq Scan on mytable", plans[0].Shape())
+			assert.Equal(t, map[string]float64{"public.mytable": 2550}, plans[0].RelationRows)
+			assert.Equal(t, "Index Only Scan on mytable using mytable_pkey", plans[1].Shape())
+			assert.Empty(t, plans[1].RelationRows)
+		})
+	}
+}
+
+func Test_wrapPlanBatch(t *testing.T) {
+	b := &planBatch{msgs: []pgproto3.FrontendMessage{&pgproto3.Query{String: "EXPLAIN select 1"}}}
+
+	assert.Equal(t, []*planBatch{b}, wrapPlanBatch('I', b))
+
+	// inside the transaction, the failed EXPLAIN doesn't abort it
+	batches := wrapPlanBatch('T', b)
+	require.Len(t, batches, 3)
+	assert.Equal(t, []pgproto3.FrontendMessage{&pgproto3.Query{String: "SAVEPOINT pgsnap_explain"}}, batches[0].msgs)
+	assert.Equal(t, b, batches[1])
+	assert.Equal(t, []pgproto3.FrontendMessage{
+		&pgproto3.Query{String: "ROLLBACK TO SAVEPOINT pgsnap_explain; RELEASE SAVEPOINT pgsnap_explain"},
+	}, batches[2].msgs)
+}
+
+func TestPlanCapture_explain(t *testing.T) {
+	c := newPlanCapture(t.Errorf)
+	queries := []executedQuery{{sql: "select 1"}, {sql: "select 1"}, {sql: "begin"}}
+
+	// it fails in the aborted transaction
+	assert.Empty(t, c.explain(queries, 'E'))
+
+	batches := c.explain(queries, 'I')
+	require.Len(t, batches, 1)
+	assert.Equal(t, []pgproto3.FrontendMessage{
+		&pgproto3.Query{String: "EXPLAIN (VERBOSE, FORMAT JSON) select 1"},
+	}, batches[0].msgs)
+
+	// the query is explained once
+	assert.Empty(t, c.explain(queries, 'I'))
+}
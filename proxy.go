@@ -3,92 +3,288 @@ package pgsnap
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 	"sync"
-	"sync/atomic"
-	"testing"
 
 	"github.com/jackc/pgproto3/v2"
 	"github.com/jackc/pgx/v4"
 )
 
 type proxy struct {
-	t         testing.TB
-	dsn       string
-	script    *script
-	l         net.Listener
-	isDebug   bool
-	done      atomic.Bool
-	doneMutex sync.Mutex
+	r       Reporter
+	queries *queryLog
+	dsn     string
+	script  *script
+	l       net.Listener
+	isDebug bool
+
+	// ctx is cancelled on finish, the connections are closed and the
+	// goroutines in wg exit
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// client is the connection from the test, it's owned by the proxy and
+	// closed on finish
+	mu       sync.Mutex
+	client   net.Conn
+	finished bool
+
+	// db is the upstream connection, it's closed on finish
+	db *pgx.Conn
+
+	// sandbox is filled when the session should be rolled back on finish
+	sandbox *sandbox
+
+	// plans is filled when the queries should be explained while recording
+	plans *planCapture
+
+	// sendMu guards the messages sent to the database, the batches of the
+	// client and the ones injected by plans are not interleaved
+	sendMu sync.Mutex
+
+	// metadata is written in the head of snapshot
+	metadata map[string]string
+
+	// fixtures is loaded in the upstream connection before proxying
+	fixtures []string
+
+	// canonical replaces the volatile fields before written into snapshot
+	canonical *canonicalizer
+
+	// level is what written into snapshot. In LevelSemantic the queries are
+	// written into out on finish
+	level SnapshotLevel
+	out   io.WriteCloser
+
+	// blobs saves the large values outside the snapshot file
+	blobs *blobStore
+
+	// activity is reported when the test timeout
+	activity *activity
+
+	// auth is required from the client
+	auth Auth
+}
+
+func newProxy(ctx context.Context, r Reporter, queries *queryLog, dsn string, script *script, l net.Listener, cfg Config) *proxy {
+	ctx, cancel := context.WithCancel(ctx)
+
+	p := &proxy{
+		r:         r,
+		queries:   queries,
+		dsn:       dsn,
+		script:    script,
+		l:         l,
+		isDebug:   cfg.Debug,
+		ctx:       ctx,
+		cancel:    cancel,
+		metadata:  cfg.Metadata,
+		fixtures:  cfg.Fixtures,
+		canonical: newCanonicalizer(),
+		level:     cfg.Level,
+		blobs:     script.blobs(cfg.BlobThreshold),
+		activity:  newActivity(),
+		auth:      cfg.Auth,
+	}
+
+	// the fixtures are rolled back with the sandbox, so they can be
+	// loaded again on the next recording
+	if cfg.Sandbox || len(cfg.Fixtures) > 0 {
+		p.sandbox = &sandbox{}
+	}
+
+	return p
 }
 
-func newProxy(t testing.TB, dsn string, script *script, l net.Listener, isDebug bool) *proxy {
-	return &proxy{
-		t:       t,
-		dsn:     dsn,
-		script:  script,
-		l:       l,
-		isDebug: isDebug,
-		done:    atomic.Bool{},
+func (s *proxy) run() error {
+	out, err := s.create()
+	if err != nil {
+		return err
+	}
+
+	if err := s.connect(); err != nil {
+		s.finish()
+		return err
 	}
+
+	// only accept one connection / test. This is a limitation of the current
+	// implementation.
+	s.wg.Add(1)
+	go s.acceptConnForProxy(out)
+
+	return nil
 }
 
-func (s *proxy) run() {
-	s.t.Helper()
+// create the snapshot file, and write the metadata
+func (s *proxy) create() (io.Writer, error) {
 	outFilename := s.script.getFilename()
 
 	out, err := os.Create(outFilename)
 	if err != nil {
-		s.t.Fatalf("can't create file %s: %v", outFilename, err)
+		return nil, fmt.Errorf("can't create file %s: %w", outFilename, err)
+	}
+
+	if err := s.blobs.clear(); err != nil {
+		return nil, fmt.Errorf("can't remove blobs of %s: %w", outFilename, err)
+	}
+
+	if err := writeMetadata(out, s.metadata); err != nil {
+		return nil, fmt.Errorf("can't write metadata into %s: %w", outFilename, err)
 	}
+	s.out = out
 
-	db, err := pgx.Connect(context.TODO(), s.dsn)
+	return out, nil
+}
+
+// connect to the database, and prepare the sandbox and the fixtures
+func (s *proxy) connect() error {
+	db, err := pgx.Connect(s.ctx, s.dsn)
 	if err != nil {
-		s.t.Fatalf("can't connect to db %s: %v", s.dsn, err)
+		return fmt.Errorf("can't connect to db %s: %w", s.dsn, err)
 	}
+	s.mu.Lock()
+	s.db = db
+	s.mu.Unlock()
 
-	err = db.Ping(context.TODO())
+	err = db.Ping(s.ctx)
 	if err != nil {
-		s.t.Fatalf("can't ping to db %s: %v", s.dsn, err)
+		return fmt.Errorf("can't ping to db %s: %w", s.dsn, err)
 	}
 
-	// only accept one connection / test. This is a limitation of the current
-	// implementation.
-	go s.acceptConnForProxy(db, out)
+	if s.sandbox != nil {
+		if _, err := db.Exec(s.ctx, sandboxBegin); err != nil {
+			return fmt.Errorf("can't start sandbox with %s: %w", sandboxBegin, err)
+		}
+	}
+
+	// in the sandbox, the fixtures is loaded before the first statement
+	// savepoint, so it is not rolled back by the failed statement
+	if err := loadFixtures(s.ctx, db, s.fixtures); err != nil {
+		return err
+	}
+
+	if s.sandbox != nil {
+		if _, err := db.Exec(s.ctx, sandboxSavepoint); err != nil {
+			return fmt.Errorf("can't start sandbox with %s: %w", sandboxSavepoint, err)
+		}
+	}
+
+	return nil
 }
 
+// finish closes the client and the upstream connection, and waits until
+// the goroutines exit. Then the snapshot is completed and closed.
 func (s *proxy) finish() {
 	if s == nil {
 		return
 	}
 
 	s.debugLogf("pgsnap: proxy finish")
-	s.setDone()
+
+	s.closeConns()
+	s.wg.Wait()
+
+	if s.out == nil {
+		return
+	}
+
+	if s.level == LevelSemantic {
+		if err := s.writeSemantic(); err != nil {
+			s.r.Errorf("pgsnap: cannot write semantic snapshot: %v", err)
+		}
+	}
+
+	if err := s.out.Close(); err != nil {
+		s.r.Errorf("pgsnap: cannot close snapshot: %v", err)
+	}
+	s.out = nil
+}
+
+// closeConns closes the client and the upstream connection without waiting,
+// so the goroutines that blocked on them exit
+func (s *proxy) closeConns() {
+	if s == nil {
+		return
+	}
+
+	s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.finished = true
+	if s.client != nil {
+		_ = s.client.Close()
+	}
+
+	if s.db != nil {
+		// the raw connection is used by the goroutines. In the sandbox, the
+		// transaction is never committed, closing the connection will
+		// make postgres roll it back
+		_ = s.db.PgConn().Conn().Close()
+	}
 }
 
-func (s *proxy) acceptConnForProxy(db *pgx.Conn, out io.Writer) {
-	conn, err := s.l.Accept()
+func (s *proxy) acceptConnForProxy(out io.Writer) {
+	defer s.wg.Done()
+
+	attempt := func(a authAttempt) {
+		if err := s.writeAuth(out, a); err != nil {
+			s.r.Errorf("pgsnap: cannot write authentication: %v", err)
+		}
+	}
+
+	conn, be, err := acceptClient(s.l, s.auth, s.own, attempt, s.debugLogf)
 	if err != nil {
-		log.Println("server: cannot accept connection:", err)
-		s.t.Errorf("server: cannot accept connection: %v", err)
+		s.r.Errorf("server: cannot accept connection: %v", err)
 		return
 	}
-	if s.isDebug {
-		s.t.Log("accepting connection")
+	if conn == nil {
+		return
 	}
+	s.debugLogf("accepting connection")
 
-	be := s.prepareBackend(conn)
+	s.prepareBackend(be)
 
-	fe := s.prepareFrontend(db)
+	fe := s.prepareFrontend(s.db)
 
 	s.runConversation(fe, be, out)
 }
 
+// own makes the proxy the owner of the client connection, so it's closed on
+// finish. It returns false, and close the connection, when the proxy is
+// already finished
+func (s *proxy) own(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.finished {
+		_ = conn.Close()
+		return false
+	}
+
+	s.client = conn
+	s.activity.accept()
+	return true
+}
+
+// closeClient closes the client connection, it's closed again on finish
+func (s *proxy) closeClient() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		_ = s.client.Close()
+	}
+}
+
 // runConversation will run conversation between frontend and backend
 func (s *proxy) runConversation(fe *pgproto3.Frontend, be *pgproto3.Backend, out io.Writer) {
+	s.wg.Add(2)
 	go s.streamBEtoFE(fe, be, out)
 	go s.streamFEtoBE(fe, be, out)
 }
@@ -96,107 +292,266 @@ func (s *proxy) runConversation(fe *pgproto3.Frontend, be *pgproto3.Backend, out
 // streamBEtoFE streams messages from test to frontend
 // this get message from test script and it will be saved to file
 func (s *proxy) streamBEtoFE(fe *pgproto3.Frontend, be *pgproto3.Backend, out io.Writer) {
+	defer s.wg.Done()
+	defer s.activity.set("client pump", "exited")
+
 	for {
 		s.debugLogf("pgsnap: BE receiving")
+		s.activity.set("client pump", "receiving from the client")
 		msg, err := be.Receive()
 		if err != nil {
-			if s.isDone() {
+			if s.ctx.Err() != nil {
 				s.debugLogf("pgsnap: error on receive after test done: %v", err)
 				return
 			}
 			if err == io.ErrUnexpectedEOF {
-				s.t.Errorf("pgsnap: BE got unexpectedEOF. Maybe db client exited?")
+				s.r.Errorf("pgsnap: BE got unexpectedEOF. Maybe db client exited?")
 				return
 			}
 
-			s.t.Errorf("pgsnap: BE failed receive message: %v", err)
-			continue
+			s.r.Errorf("pgsnap: BE failed receive message: %v", err)
+			return
 		}
 
-		b, err := json.Marshal(msg)
-		if err != nil {
-			s.t.Errorf("pgsnap: BE cannot marshal: %T: %+v", msg, msg)
-		}
-		if len(b) > 0 {
-			b = append([]byte{'F', ' '}, b...)
-			b = append(b, []byte("\n")...)
-			_, _ = out.Write(b)
+		s.activity.received(msg)
+		s.queries.observe(msg)
+
+		if err := s.writeLine(out, 'F', msg); err != nil {
+			s.r.Errorf("pgsnap: BE cannot marshal: %T: %+v: %v", msg, msg, err)
 		}
-		s.debugLogf("pgsnap: BE create FE obj %T: %+v", msg, msg)
 
-		if msg != nil {
-			s.debugLogf("pgsnap: BE send to database: %+v", msg)
-			err = fe.Send(msg)
-			s.debugLogf("pgsnap: BE send to database done err: %v", err)
-			if err != nil {
-				s.t.Errorf("pgsnap: BE cannot forward to postgre: %T: %+v", msg, msg)
+		s.debugLogf("pgsnap: BE send to database: %+v", msg)
+		s.activity.set("client pump", "sending %T to the database", msg)
+		if err := s.forwardToDatabase(fe, msg); err != nil {
+			if s.ctx.Err() == nil {
+				s.r.Errorf("pgsnap: BE cannot forward to postgre: %T: %+v: %v", msg, msg, err)
 			}
+			return
 		}
 
-		if s.isDone() {
+		if _, ok := msg.(*pgproto3.Terminate); ok {
+			// the database close the connection after Terminate, so
+			// the other stream exit too. The client is closed like
+			// postgres does, pgx waits for it
 			s.debugLogf("pgsnap: BE exit loop")
+			s.cancel()
+			s.closeClient()
 			return
 		}
 	}
 }
 
 func (s *proxy) streamFEtoBE(fe *pgproto3.Frontend, be *pgproto3.Backend, out io.Writer) {
+	defer s.wg.Done()
+	defer s.activity.set("database pump", "exited")
+
+	// held is the responses that are sent to the client after the
+	// EXPLAIN batches are answered, so the next client batch is not
+	// sent before them
+	var held []pgproto3.BackendMessage
+
 	for {
 		s.debugLogf("pgsnap: FE receiving")
+		s.activity.set("database pump", "receiving from the database")
 
 		msg, err := fe.Receive()
 		if err != nil {
-			if s.isDone() {
+			if s.ctx.Err() != nil {
 				s.debugLogf("pgsnap: FE loop exit, error after done: %v", err)
 				return
 			}
 
 			if err == io.ErrUnexpectedEOF {
-				s.t.Errorf("pgsnap: unexpectedEOF from Database. Maybe database exit unexpectedly?")
+				s.r.Errorf("pgsnap: unexpectedEOF from Database. Maybe database exit unexpectedly?")
 				return
 			}
 
-			s.t.Errorf("pgsnap: error when FE receive: %v", err)
-			continue
+			s.r.Errorf("pgsnap: error when FE receive: %v", err)
+			return
 		}
 
 		s.debugLogf("pgsnap: FE receive Database message %T: %+v", msg, msg)
 
-		b, err := json.Marshal(msg)
+		// the status before translated by the sandbox
+		var txStatus byte
+		if rfq, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			txStatus = rfq.TxStatus
+		}
+
+		if s.plans.consume(msg) {
+			if txStatus != 0 {
+				s.injectPlans(fe, s.plans.relations(txStatus))
+			}
+			if !s.plans.pending() {
+				for _, m := range held {
+					if !s.sendToClient(be, m) {
+						return
+					}
+				}
+				held = nil
+			}
+			continue
+		}
+
+		msg, err = s.sandbox.translate(msg)
 		if err != nil {
-			s.t.Errorf("pgsnap: FE cannot marshal Database message: %T: %+v", msg, msg)
+			s.r.Errorf("pgsnap: sandbox: %v", err)
 		}
-		if len(b) > 0 {
-			b = append([]byte{'B', ' '}, b...)
-			b = append(b, []byte("\n")...)
-			_, _ = out.Write(b)
+		if msg == nil {
+			continue
 		}
-		s.debugLogf("pgsnap: FE forward to test %T: %+v", msg, msg)
 
-		if msg != nil {
-			be.Send(msg)
-			if err != nil {
-				s.t.Errorf("pgsnap: FE forward to client error: %T: %+v :%v", msg, msg, err)
-			}
+		s.queries.observe(msg)
+
+		if err := s.writeLine(out, 'B', msg); err != nil {
+			s.r.Errorf("pgsnap: FE cannot marshal Database message: %T: %+v: %v", msg, msg, err)
+		}
+
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok && s.plans != nil {
+			s.injectPlans(fe, s.plans.explain(s.queries.takeExecuted(), txStatus))
 		}
 
-		if s.isDone() {
-			s.debugLogf("pgsnap: FE exit loop")
+		if s.plans.pending() {
+			held = append(held, msg)
+			continue
+		}
+
+		if !s.sendToClient(be, msg) {
 			return
 		}
 	}
 }
 
-func (s *proxy) prepareBackend(conn net.Conn) *pgproto3.Backend {
-	be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+// marshal returns the snapshot line of the canonical message, without the
+// prefix
+func (s *proxy) marshal(msg pgproto3.Message) ([]byte, error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return s.blobs.externalize(b)
+}
+
+// writeLine writes the message into the snapshot with the prefix, 'F' for
+// client message and 'B' for database message
+func (s *proxy) writeLine(out io.Writer, prefix byte, msg pgproto3.Message) error {
+	if s.level != LevelWire {
+		return nil
+	}
+	return s.writeCanonical(out, prefix, s.canonical.canonicalize(msg))
+}
+
+// writeReplayed writes the message of the replayed snapshot in hybrid mode,
+// it's canonical already
+func (s *proxy) writeReplayed(out io.Writer, prefix byte, msg pgproto3.Message) error {
+	if s.level != LevelWire {
+		return nil
+	}
+	return s.writeCanonical(out, prefix, s.canonical.replayed(msg))
+}
+
+func (s *proxy) writeCanonical(out io.Writer, prefix byte, msg pgproto3.Message) error {
+	b, err := s.marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	b = append([]byte{prefix, ' '}, b...)
+	b = append(b, '\n')
+	_, err = out.Write(b)
+	return err
+}
+
+// writeAuth writes the authentication as "A <json>" line, in every level
+func (s *proxy) writeAuth(out io.Writer, a authAttempt) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
 
-	// expect startup message
-	_, _ = be.ReceiveStartupMessage()
-	_ = be.Send(&pgproto3.AuthenticationOk{})
+	b = append([]byte{'A', ' '}, b...)
+	b = append(b, '\n')
+	_, err = out.Write(b)
+	return err
+}
+
+// writeSemantic writes the observed queries as "Q <json>" lines
+func (s *proxy) writeSemantic() error {
+	for _, q := range s.queries.semanticQueries() {
+		b, err := json.Marshal(q.canonicalize(s.canonical))
+		if err != nil {
+			return err
+		}
+
+		b, err = s.blobs.externalize(b)
+		if err != nil {
+			return err
+		}
+
+		b = append([]byte{'Q', ' '}, b...)
+		b = append(b, '\n')
+		if _, err := s.out.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendToClient returns false when the client is gone
+func (s *proxy) sendToClient(be *pgproto3.Backend, msg pgproto3.BackendMessage) bool {
+	s.debugLogf("pgsnap: FE forward to test %T: %+v", msg, msg)
+	s.activity.set("database pump", "sending %T to the client", msg)
+	if err := be.Send(msg); err != nil {
+		if s.ctx.Err() == nil {
+			s.r.Errorf("pgsnap: FE forward to client error: %T: %+v: %v", msg, msg, err)
+		}
+		return false
+	}
+	return true
+}
+
+// forwardToDatabase sends the client message, rewritten by the sandbox
+func (s *proxy) forwardToDatabase(fe *pgproto3.Frontend, msg pgproto3.FrontendMessage) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	msgs := s.sandbox.rewrite(msg)
+	s.plans.sending(msgs...)
+	return s.sendToDatabase(fe, msgs...)
+}
+
+// injectPlans sends the EXPLAIN batches, the error is reported by the pump
+// when the next message is sent or received
+func (s *proxy) injectPlans(fe *pgproto3.Frontend, batches []*planBatch) {
+	if len(batches) == 0 {
+		return
+	}
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	err := s.plans.inject(batches, func(msgs ...pgproto3.FrontendMessage) error {
+		return s.sendToDatabase(fe, msgs...)
+	})
+	if err != nil {
+		s.debugLogf("pgsnap: cannot send EXPLAIN: %v", err)
+	}
+}
+
+func (s *proxy) sendToDatabase(fe *pgproto3.Frontend, msgs ...pgproto3.FrontendMessage) error {
+	for _, msg := range msgs {
+		if err := fe.Send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareBackend finish the startup of the authenticated client
+func (s *proxy) prepareBackend(be *pgproto3.Backend) {
 	_ = be.Send(&pgproto3.BackendKeyData{ProcessID: 0, SecretKey: 0})
 	_ = be.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
-
-	return be
 }
 
 func (s *proxy) prepareFrontend(db *pgx.Conn) *pgproto3.Frontend {
@@ -206,23 +561,6 @@ func (s *proxy) prepareFrontend(db *pgx.Conn) *pgproto3.Frontend {
 
 func (s *proxy) debugLogf(format string, args ...interface{}) {
 	if s.isDebug {
-		if !s.isDone() {
-			s.t.Helper()
-			s.t.Logf(format, args...)
-			return
-		}
-		log.Printf(s.t.Name()+": "+format, args...)
+		s.r.Logf(format, args...)
 	}
 }
-
-func (s *proxy) setDone() {
-	s.doneMutex.Lock()
-	defer s.doneMutex.Unlock()
-	s.done.Store(true)
-}
-
-func (s *proxy) isDone() bool {
-	s.doneMutex.Lock()
-	defer s.doneMutex.Unlock()
-	return s.done.Load()
-}
@@ -0,0 +1,734 @@
+package pgsnap
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+)
+
+type (
+	// Query is a statement executed by the client, either recorded by proxy
+	// or replayed by fake server.
+	Query struct {
+		// SQL is the query string sent by the client. The simple query with
+		// more than one statement is split by semicolon, and SQL is the
+		// statement without the semicolon
+		SQL string
+
+		// Args is the decoded parameters. If the type of parameter is
+		// unknown, it will be string for text format and []byte for binary
+		Args []interface{}
+
+		// Rows is the number of DataRow returned
+		Rows int
+
+		// Columns is the RowDescription of the result
+		Columns []Column
+
+		// Values is the decoded DataRow, like Args
+		Values [][]interface{}
+
+		// CommandTag is the tag returned by postgres, like "SELECT 3"
+		CommandTag string
+
+		// Err is the error returned by postgres
+		Err error
+
+		// InTransaction is true when the query is executed inside
+		// transaction block. BEGIN and COMMIT themselves are inside it
+		InTransaction bool
+	}
+
+	// Column is the field of RowDescription
+	Column struct {
+		Name        string
+		DataTypeOID uint32
+	}
+
+	// queryLog build []Query from the messages exchanged between client
+	// and postgres
+	queryLog struct {
+		mu sync.Mutex
+		ci *pgtype.ConnInfo
+
+		statements map[string]*statement
+		portals    map[string]*portal
+
+		// describing is the statements that waiting for ParameterDescription
+		describing []*statement
+
+		// pending is the queries that already executed, but waiting for
+		// the result
+		pending []*pendingQuery
+
+		// executed is the succeeded queries with the parameters as sent by
+		// the client, until they are taken by takeExecuted. It's only
+		// filled when keepExecuted is true
+		executed     []executedQuery
+		keepExecuted bool
+
+		// simpleStmts is filled while waiting the result of simple query,
+		// the statements that not finished yet. Simple query can contain
+		// more than one statement
+		simpleStmts []string
+
+		// parsed is the last statement parsed in the current batch, used
+		// when the query is failed before executed
+		parsed *statement
+
+		// described is the statement that waiting for RowDescription
+		described *statement
+
+		queries []Query
+
+		// txStatus is the transaction status after the last finished
+		// statement, it's synced on ReadyForQuery
+		txStatus byte
+
+		// records is the queries for the semantic snapshot, it's added
+		// when the query is sent, so it's in the order of execution
+		records     []*semanticQuery
+		recordStart int
+
+		// simpleRecord is the record of simple query waiting the results
+		simpleRecord *semanticQuery
+	}
+
+	statement struct {
+		sql     string
+		oids    []uint32
+		columns []Column
+		fields  []semanticField
+	}
+
+	// pendingQuery is the query waiting for the result, with the result
+	// format codes requested by Bind
+	pendingQuery struct {
+		Query
+		formats []int16
+
+		// portal is nil for simple query
+		portal *portal
+
+		// record is the semantic query that the result belongs to
+		record *semanticQuery
+		result semanticResult
+	}
+
+	portal struct {
+		stmt          *statement
+		formats       []int16
+		params        [][]byte
+		resultFormats []int16
+	}
+
+	// executedQuery is the succeeded query that can be executed again, like
+	// by EXPLAIN
+	executedQuery struct {
+		sql string
+
+		// portal is nil for simple query
+		portal *portal
+	}
+)
+
+func newQueryLog() *queryLog {
+	return &queryLog{
+		ci:         pgtype.NewConnInfo(),
+		statements: map[string]*statement{},
+		portals:    map[string]*portal{},
+		txStatus:   'I',
+	}
+}
+
+// RowsAffected returns the number of rows affected by the query
+func (q Query) RowsAffected() int64 {
+	return pgconn.CommandTag(q.CommandTag).RowsAffected()
+}
+
+// IsWrite returns true if the query is modifying the database
+func (q Query) IsWrite() bool {
+	cmd := firstWord(q.CommandTag)
+	if cmd == "" {
+		cmd = firstWord(q.SQL)
+	}
+
+	switch cmd {
+	case "INSERT", "UPDATE", "DELETE", "MERGE",
+		"CREATE", "DROP", "ALTER", "TRUNCATE",
+		"GRANT", "REVOKE", "COMMENT", "REINDEX":
+		return true
+	case "COPY":
+		return copyDirection(q.SQL) == "FROM"
+	}
+
+	return false
+}
+
+// observe consume message from client or postgres. It can be called from
+// different goroutine.
+func (l *queryLog) observe(msg pgproto3.Message) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch m := msg.(type) {
+	case *pgproto3.Query:
+		stmts := splitStatements(m.String)
+		if len(stmts) <= 1 {
+			// keep it as is, the empty query is answered too
+			stmts = []string{m.String}
+		} else {
+			for i := range stmts {
+				stmts[i] = strings.TrimSpace(stmts[i])
+			}
+		}
+		l.simpleStmts = stmts
+		l.simpleRecord = l.addRecord(&semanticQuery{SQL: m.String})
+
+	case *pgproto3.Parse:
+		l.parsed = &statement{
+			sql:  m.Query,
+			oids: append([]uint32(nil), m.ParameterOIDs...),
+		}
+		l.statements[m.Name] = l.parsed
+
+	case *pgproto3.Describe:
+		if m.ObjectType == 'S' {
+			l.describing = append(l.describing, l.statements[m.Name])
+		}
+
+	case *pgproto3.ParameterDescription:
+		if len(l.describing) == 0 {
+			return
+		}
+		if stmt := l.describing[0]; stmt != nil {
+			stmt.oids = append([]uint32(nil), m.ParameterOIDs...)
+		}
+		l.described = l.describing[0]
+		l.describing = l.describing[1:]
+
+	case *pgproto3.RowDescription:
+		columns := make([]Column, len(m.Fields))
+		for i, f := range m.Fields {
+			columns[i] = Column{Name: string(f.Name), DataTypeOID: f.DataTypeOID}
+		}
+		fields := newSemanticFields(m.Fields)
+
+		if l.described != nil {
+			l.described.columns = columns
+			l.described.fields = fields
+			l.described = nil
+		}
+		if q := l.current(); q != nil && q.Columns == nil {
+			q.Columns = columns
+			q.result.Fields = fields
+		}
+
+	case *pgproto3.NoData:
+		l.described = nil
+
+	case *pgproto3.Bind:
+		p := &portal{
+			stmt:          l.statements[m.PreparedStatement],
+			formats:       append([]int16(nil), m.ParameterFormatCodes...),
+			resultFormats: append([]int16(nil), m.ResultFormatCodes...),
+		}
+		for _, param := range m.Parameters {
+			if param == nil {
+				p.params = append(p.params, nil)
+				continue
+			}
+			p.params = append(p.params, append([]byte{}, param...))
+		}
+		l.portals[m.DestinationPortal] = p
+
+	case *pgproto3.Execute:
+		p, ok := l.portals[m.Portal]
+		if !ok || p.stmt == nil {
+			return
+		}
+		l.pending = append(l.pending, &pendingQuery{
+			Query: Query{
+				SQL:     p.stmt.sql,
+				Args:    l.decodeArgs(p),
+				Columns: p.stmt.columns,
+			},
+			formats: p.resultFormats,
+			portal:  p,
+			record: l.addRecord(&semanticQuery{
+				SQL:       p.stmt.sql,
+				ParamOIDs: p.stmt.oids,
+				Params:    l.textArgs(p),
+			}),
+			result: semanticResult{Fields: p.stmt.fields},
+		})
+
+	case *pgproto3.Close:
+		if m.ObjectType == 'S' {
+			delete(l.statements, m.Name)
+		} else {
+			delete(l.portals, m.Name)
+		}
+
+	case *pgproto3.DataRow:
+		if q := l.current(); q != nil {
+			q.Rows++
+			q.Values = append(q.Values, l.decodeRow(q, m.Values))
+			q.result.Rows = append(q.result.Rows, l.textRow(q, m.Values))
+		}
+
+	case *pgproto3.CommandComplete:
+		if q := l.current(); q != nil {
+			q.CommandTag = string(m.CommandTag)
+			q.result.CommandTag = q.CommandTag
+			l.finish()
+		}
+
+	case *pgproto3.PortalSuspended:
+		if l.current() != nil {
+			l.finish()
+		}
+
+	case *pgproto3.EmptyQueryResponse:
+		if q := l.current(); q != nil {
+			q.result.Empty = true
+			q.addResult()
+			l.pending = l.pending[1:]
+		}
+
+	case *pgproto3.ErrorResponse:
+		if l.current() == nil && l.parsed != nil {
+			l.pending = append(l.pending, &pendingQuery{
+				Query: Query{SQL: l.parsed.sql},
+				record: l.addRecord(&semanticQuery{
+					SQL:         l.parsed.sql,
+					ParamOIDs:   l.parsed.oids,
+					ParseFailed: true,
+				}),
+			})
+		}
+		if q := l.current(); q != nil {
+			q.Err = errorResponseToPgError(m)
+			errorResponse := *m
+			q.result.Error = &errorResponse
+			l.finish()
+		}
+
+		// the rest of the queries in the batch will be skipped by postgres
+		l.pending = nil
+		l.simpleStmts = nil
+
+	case *pgproto3.ReadyForQuery:
+		for i := l.recordStart; i < len(l.records); i++ {
+			l.records[i].TxStatus = string(m.TxStatus)
+		}
+
+		l.recordStart = len(l.records)
+		l.simpleRecord = nil
+		l.txStatus = m.TxStatus
+		l.pending = nil
+		l.describing = nil
+		l.simpleStmts = nil
+		l.parsed = nil
+		l.described = nil
+	}
+}
+
+// Queries returns the queries observed so far
+func (l *queryLog) Queries() []Query {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Query(nil), l.queries...)
+}
+
+// current returns the query that waiting for the result
+func (l *queryLog) current() *pendingQuery {
+	if len(l.pending) > 0 {
+		return l.pending[0]
+	}
+
+	if len(l.simpleStmts) > 0 {
+		sql := l.simpleStmts[0]
+		l.simpleStmts = l.simpleStmts[1:]
+
+		l.pending = append(l.pending, &pendingQuery{Query: Query{SQL: sql}, record: l.simpleRecord})
+		return l.pending[0]
+	}
+
+	return nil
+}
+
+func (l *queryLog) finish() {
+	q := l.pending[0]
+	l.pending = l.pending[1:]
+
+	// BEGIN is inside the transaction it starts, and COMMIT is inside the
+	// one it ends
+	before := l.txStatus
+	l.txStatus = nextTxStatus(before, q.SQL, q.CommandTag, q.Err != nil)
+	q.InTransaction = before != 'I' || l.txStatus != 'I'
+
+	l.queries = append(l.queries, q.Query)
+	q.addResult()
+
+	if q.Err == nil && l.keepExecuted {
+		l.executed = append(l.executed, executedQuery{sql: q.SQL, portal: q.portal})
+	}
+}
+
+// takeExecuted returns the succeeded queries since the last call
+func (l *queryLog) takeExecuted() []executedQuery {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	executed := l.executed
+	l.executed = nil
+	return executed
+}
+
+// nextTxStatus returns the transaction status after the statement finished
+// with the command tag, or failed
+func nextTxStatus(status byte, sql, tag string, failed bool) byte {
+	if failed {
+		if status == 'I' {
+			return 'I'
+		}
+		return 'E'
+	}
+
+	stmt := normalizeTxStatement(sql)
+	if strings.HasSuffix(stmt, " and chain") {
+		return 'T'
+	}
+
+	switch tag {
+	case "BEGIN", "START TRANSACTION":
+		if status == 'I' {
+			return 'T'
+		}
+	case "COMMIT", "PREPARE TRANSACTION":
+		return 'I'
+	case "ROLLBACK":
+		// ROLLBACK TO SAVEPOINT stays in the transaction
+		if strings.HasPrefix(stmt, "rollback") && strings.Contains(stmt, " to ") {
+			return 'T'
+		}
+		return 'I'
+	}
+
+	return status
+}
+
+// addResult add the result into the semantic query
+func (q *pendingQuery) addResult() {
+	if q.record != nil {
+		q.record.Results = append(q.record.Results, q.result)
+	}
+}
+
+func (l *queryLog) addRecord(q *semanticQuery) *semanticQuery {
+	l.records = append(l.records, q)
+	return q
+}
+
+// semanticQueries returns the queries for the semantic snapshot observed so
+// far
+func (l *queryLog) semanticQueries() []semanticQuery {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := make([]semanticQuery, len(l.records))
+	for i, q := range l.records {
+		result[i] = *q
+	}
+	return result
+}
+
+// textArgs returns the parameters in text format
+func (l *queryLog) textArgs(p *portal) []*string {
+	args := make([]*string, len(p.params))
+	for i, param := range p.params {
+		var oid uint32
+		if i < len(p.stmt.oids) {
+			oid = p.stmt.oids[i]
+		}
+
+		args[i] = textValue(l.ci, oid, formatCode(p.formats, i), param)
+	}
+	return args
+}
+
+// textRow returns the DataRow in text format
+func (l *queryLog) textRow(q *pendingQuery, values [][]byte) []*string {
+	row := make([]*string, len(values))
+	for i, v := range values {
+		var oid uint32
+		if i < len(q.Columns) {
+			oid = q.Columns[i].DataTypeOID
+		}
+		row[i] = textValue(l.ci, oid, formatCode(q.formats, i), v)
+	}
+	return row
+}
+
+func (l *queryLog) decodeArgs(p *portal) []interface{} {
+	args := make([]interface{}, len(p.params))
+	for i, param := range p.params {
+		var oid uint32
+		if i < len(p.stmt.oids) {
+			oid = p.stmt.oids[i]
+		}
+
+		args[i] = decodeValue(l.ci, oid, formatCode(p.formats, i), param)
+	}
+	return args
+}
+
+func (l *queryLog) decodeRow(q *pendingQuery, values [][]byte) []interface{} {
+	row := make([]interface{}, len(values))
+	for i, v := range values {
+		var oid uint32
+		if i < len(q.Columns) {
+			oid = q.Columns[i].DataTypeOID
+		}
+		row[i] = decodeValue(l.ci, oid, formatCode(q.formats, i), v)
+	}
+	return row
+}
+
+// formatCode returns the format of i-th value, one format code is applied
+// to all values
+func formatCode(formats []int16, i int) int16 {
+	if len(formats) == 1 {
+		return formats[0]
+	} else if i < len(formats) {
+		return formats[i]
+	}
+	return 0
+}
+
+// decodeValue decode postgres value into go value. If the type is unknown
+// it returns string for text format and []byte for binary format
+func decodeValue(ci *pgtype.ConnInfo, oid uint32, format int16, src []byte) interface{} {
+	if src == nil {
+		return nil
+	}
+
+	v := decodeValueOf(ci, oid, format, src)
+	if v == nil {
+		if format == pgtype.TextFormatCode {
+			return string(src)
+		}
+		return src
+	}
+
+	return v.Get()
+}
+
+// decodeValueOf returns the pgtype.Value decoded from src, or nil when the
+// type is unknown or the value cannot be decoded
+func decodeValueOf(ci *pgtype.ConnInfo, oid uint32, format int16, src []byte) pgtype.Value {
+	dt, ok := ci.DataTypeForOID(oid)
+	if !ok {
+		return nil
+	}
+
+	v := pgtype.NewValue(dt.Value)
+
+	var err error
+	switch format {
+	case pgtype.TextFormatCode:
+		d, ok := v.(pgtype.TextDecoder)
+		if !ok {
+			return nil
+		}
+		err = d.DecodeText(ci, src)
+	default:
+		d, ok := v.(pgtype.BinaryDecoder)
+		if !ok {
+			return nil
+		}
+		err = d.DecodeBinary(ci, src)
+	}
+
+	if err != nil {
+		return nil
+	}
+
+	return v
+}
+
+func errorResponseToPgError(m *pgproto3.ErrorResponse) *pgconn.PgError {
+	return &pgconn.PgError{
+		Severity:         m.Severity,
+		Code:             m.Code,
+		Message:          m.Message,
+		Detail:           m.Detail,
+		Hint:             m.Hint,
+		Position:         m.Position,
+		InternalPosition: m.InternalPosition,
+		InternalQuery:    m.InternalQuery,
+		Where:            m.Where,
+		SchemaName:       m.SchemaName,
+		TableName:        m.TableName,
+		ColumnName:       m.ColumnName,
+		DataTypeName:     m.DataTypeName,
+		ConstraintName:   m.ConstraintName,
+		File:             m.File,
+		Line:             m.Line,
+		Routine:          m.Routine,
+	}
+}
+
+// copyDirection returns FROM or TO of the COPY statement. It's the first
+// word outside the parentheses and the quotes, so the FROM of the query in
+// COPY (SELECT ... FROM t) TO is skipped
+func copyDirection(sql string) string {
+	depth := 0
+	word := strings.Builder{}
+
+	for i := 0; i <= len(sql); i++ {
+		var c byte
+		if i < len(sql) {
+			c = sql[i]
+		}
+
+		if depth == 0 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			word.WriteByte(c)
+			continue
+		}
+
+		switch w := strings.ToUpper(word.String()); w {
+		case "FROM", "TO":
+			return w
+		}
+		word.Reset()
+
+		switch c {
+		case '\'', '"':
+			j := strings.IndexByte(sql[i+1:], c)
+			if j < 0 {
+				return ""
+			}
+			i += j + 1
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+	}
+
+	return ""
+}
+
+func firstWord(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(strings.TrimRight(fields[0], ";("))
+}
+
+// Queries returns every statement executed by the client so far. It's
+// better to call it after Finish, so all the messages are already observed
+func (s *Snap) Queries() []Query {
+	return s.queries.Queries()
+}
+
+// AssertQueryCount assert that the client execute exactly n statements
+func (s *Snap) AssertQueryCount(n int) bool {
+	s.t.Helper()
+
+	queries := s.Queries()
+	if len(queries) != n {
+		s.reporter.assertf("pgsnap: expect %d queries, got %d:\n%s", n, len(queries), formatQueries(queries))
+		return false
+	}
+
+	return true
+}
+
+// AssertNoWrites assert that the client did not modify the database
+func (s *Snap) AssertNoWrites() bool {
+	s.t.Helper()
+
+	var writes []Query
+	for _, q := range s.Queries() {
+		if q.IsWrite() {
+			writes = append(writes, q)
+		}
+	}
+
+	if len(writes) > 0 {
+		s.reporter.assertf("pgsnap: expect no writes, got %d:\n%s", len(writes), formatQueries(writes))
+		return false
+	}
+
+	return true
+}
+
+// AssertExecutedInTransaction assert that every sql is executed, and all
+// of them are executed inside transaction block.
+func (s *Snap) AssertExecutedInTransaction(sqls ...string) bool {
+	s.t.Helper()
+
+	ok := true
+	queries := s.Queries()
+
+	for _, sql := range sqls {
+		found := false
+		for _, q := range queries {
+			if strings.TrimSpace(q.SQL) != strings.TrimSpace(sql) {
+				continue
+			}
+
+			found = true
+			if !q.InTransaction {
+				s.reporter.assertf("pgsnap: query is executed outside transaction: %s", sql)
+				ok = false
+			}
+		}
+
+		if !found {
+			s.reporter.assertf("pgsnap: query is not executed: %s\nexecuted queries:\n%s", sql, formatQueries(queries))
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+func formatQueries(queries []Query) string {
+	b := &strings.Builder{}
+	for i, q := range queries {
+		fmt.Fprintf(b, "%d. %s %v", i+1, q.SQL, q.Args)
+		if q.CommandTag != "" {
+			fmt.Fprintf(b, " => %s", q.CommandTag)
+		}
+		if q.Err != nil {
+			fmt.Fprintf(b, " => %v", q.Err)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,214 @@
+package pgsnap
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnap_queries(t *testing.T) {
+	db, s := NewDB(t, addr)
+	db.SetMaxOpenConns(1)
+
+	require.NoError(t, db.Ping())
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	_, err = tx.Exec("insert into mytable(name) values ($1)", "Budi")
+	require.NoError(t, err)
+
+	require.NoError(t, tx.Commit())
+
+	runPQ(t, db)
+
+	s.Finish()
+
+	queries := s.Queries()
+	require.Len(t, queries, 4)
+	assert.Equal(t, Query{
+		SQL:           "insert into mytable(name) values ($1)",
+		Args:          []interface{}{"Budi"},
+		CommandTag:    "INSERT 0 1",
+		InTransaction: true,
+	}, queries[1])
+	assert.Equal(t, Query{
+		SQL:        "select id from mytable limit $1",
+		Args:       []interface{}{int64(7)},
+		Rows:       3,
+		Columns:    []Column{{Name: "id", DataTypeOID: 23}},
+		Values:     [][]interface{}{{int32(1)}, {int32(2)}, {int32(3)}},
+		CommandTag: "SELECT 3",
+	}, queries[3])
+
+	s.AssertQueryCount(4)
+	s.AssertExecutedInTransaction("BEGIN READ WRITE", "insert into mytable(name) values ($1)", "COMMIT")
+}
+
+// the failed assertion is reported into the Reporter, even after Finish
+func TestSnap_assert_reporter(t *testing.T) {
+	tb := newFakeTB(t)
+	s := &Snap{t: t, reporter: newCollector(tb, t.Name()), queries: newQueryLog()}
+	s.queries.queries = []Query{{SQL: "delete from t", CommandTag: "DELETE 1"}}
+	s.reporter.flush()
+
+	assert.False(t, s.AssertQueryCount(2))
+	assert.False(t, s.AssertNoWrites())
+	assert.False(t, s.AssertExecutedInTransaction("delete from t"))
+
+	require.Len(t, tb.ErrorMessages, 3)
+	assert.Contains(t, tb.ErrorMessages[0], "pgsnap: expect 2 queries, got 1")
+	assert.Contains(t, tb.ErrorMessages[1], "pgsnap: expect no writes, got 1")
+	assert.Equal(t, "pgsnap: query is executed outside transaction: delete from t", tb.ErrorMessages[2])
+}
+
+func Test_queryLog_observe(t *testing.T) {
+	t.Run("pgx flow with binary parameter", func(t *testing.T) {
+		l := newQueryLog()
+		for _, msg := range []pgproto3.Message{
+			&pgproto3.Parse{Name: "stmt_1", Query: "select id from mytable where id = $1"},
+			&pgproto3.Describe{ObjectType: 'S', Name: "stmt_1"},
+			&pgproto3.Sync{},
+			&pgproto3.ParseComplete{},
+			&pgproto3.ParameterDescription{ParameterOIDs: []uint32{23}},
+			&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("id"), DataTypeOID: 23}}},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+			&pgproto3.Bind{PreparedStatement: "stmt_1", ParameterFormatCodes: []int16{1}, Parameters: [][]byte{{0, 0, 0, 4}}, ResultFormatCodes: []int16{1}},
+			&pgproto3.Describe{ObjectType: 'P'},
+			&pgproto3.Execute{},
+			&pgproto3.Sync{},
+			&pgproto3.BindComplete{},
+			&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("id"), DataTypeOID: 23, Format: 1}}},
+			&pgproto3.DataRow{Values: [][]byte{{0, 0, 0, 4}}},
+			&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		} {
+			l.observe(msg)
+		}
+
+		assert.Equal(t, []Query{{
+			SQL:        "select id from mytable where id = $1",
+			Args:       []interface{}{int32(4)},
+			Rows:       1,
+			Columns:    []Column{{Name: "id", DataTypeOID: 23}},
+			Values:     [][]interface{}{{int32(4)}},
+			CommandTag: "SELECT 1",
+		}}, l.Queries())
+	})
+
+	t.Run("failed before executed", func(t *testing.T) {
+		l := newQueryLog()
+		for _, msg := range []pgproto3.Message{
+			&pgproto3.Parse{Query: "select * from non_existing_table"},
+			&pgproto3.Describe{ObjectType: 'S'},
+			&pgproto3.Sync{},
+			&pgproto3.ErrorResponse{Code: "42P01", Message: "relation \"non_existing_table\" does not exist"},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		} {
+			l.observe(msg)
+		}
+
+		queries := l.Queries()
+		require.Len(t, queries, 1)
+		assert.Equal(t, "select * from non_existing_table", queries[0].SQL)
+
+		var pgErr *pgconn.PgError
+		require.True(t, errors.As(queries[0].Err, &pgErr))
+		assert.Equal(t, "42P01", pgErr.Code)
+	})
+
+	t.Run("simple query with multiple statement", func(t *testing.T) {
+		l := newQueryLog()
+		for _, msg := range []pgproto3.Message{
+			&pgproto3.Query{String: "update mytable set name = 'a'; delete from mytable"},
+			&pgproto3.CommandComplete{CommandTag: []byte("UPDATE 3")},
+			&pgproto3.CommandComplete{CommandTag: []byte("DELETE 3")},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		} {
+			l.observe(msg)
+		}
+
+		queries := l.Queries()
+		require.Len(t, queries, 2)
+		assert.Equal(t, "update mytable set name = 'a'", queries[0].SQL)
+		assert.Equal(t, "UPDATE 3", queries[0].CommandTag)
+		assert.Equal(t, "delete from mytable", queries[1].SQL)
+		assert.Equal(t, int64(3), queries[1].RowsAffected())
+		assert.True(t, queries[1].IsWrite())
+	})
+
+	t.Run("transaction inside simple query", func(t *testing.T) {
+		l := newQueryLog()
+		for _, msg := range []pgproto3.Message{
+			&pgproto3.Query{String: "select 1; begin; update mytable set name = 'a'; savepoint a; rollback to a; commit; delete from mytable"},
+			&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+			&pgproto3.CommandComplete{CommandTag: []byte("BEGIN")},
+			&pgproto3.CommandComplete{CommandTag: []byte("UPDATE 3")},
+			&pgproto3.CommandComplete{CommandTag: []byte("SAVEPOINT")},
+			&pgproto3.CommandComplete{CommandTag: []byte("ROLLBACK")},
+			&pgproto3.CommandComplete{CommandTag: []byte("COMMIT")},
+			&pgproto3.CommandComplete{CommandTag: []byte("DELETE 3")},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		} {
+			l.observe(msg)
+		}
+
+		var inTx []string
+		for _, q := range l.Queries() {
+			if q.InTransaction {
+				inTx = append(inTx, q.SQL)
+			}
+		}
+		assert.Equal(t, []string{"begin", "update mytable set name = 'a'", "savepoint a", "rollback to a", "commit"}, inTx)
+	})
+
+	t.Run("transaction across batches", func(t *testing.T) {
+		l := newQueryLog()
+		for _, msg := range []pgproto3.Message{
+			&pgproto3.Query{String: "begin"},
+			&pgproto3.CommandComplete{CommandTag: []byte("BEGIN")},
+			&pgproto3.ReadyForQuery{TxStatus: 'T'},
+			&pgproto3.Query{String: "select 1; commit"},
+			&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+			&pgproto3.CommandComplete{CommandTag: []byte("COMMIT")},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+			&pgproto3.Query{String: "select 2; begin"},
+			&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+			&pgproto3.CommandComplete{CommandTag: []byte("BEGIN")},
+			&pgproto3.ReadyForQuery{TxStatus: 'T'},
+		} {
+			l.observe(msg)
+		}
+
+		queries := l.Queries()
+		require.Len(t, queries, 5)
+		assert.True(t, queries[1].InTransaction, "select 1 is before commit")
+		assert.False(t, queries[3].InTransaction, "select 2 is before begin")
+		assert.True(t, queries[4].InTransaction)
+	})
+}
+
+func Test_nextTxStatus(t *testing.T) {
+	assert.Equal(t, byte('T'), nextTxStatus('I', "BEGIN", "BEGIN", false))
+	assert.Equal(t, byte('I'), nextTxStatus('I', "select 1", "SELECT 1", true), "implicit transaction")
+	assert.Equal(t, byte('E'), nextTxStatus('T', "select 1", "", true))
+	assert.Equal(t, byte('I'), nextTxStatus('E', "COMMIT", "ROLLBACK", false))
+	assert.Equal(t, byte('T'), nextTxStatus('E', "ROLLBACK TO SAVEPOINT a", "ROLLBACK", false))
+	assert.Equal(t, byte('T'), nextTxStatus('T', "COMMIT AND CHAIN", "COMMIT", false))
+	assert.Equal(t, byte('I'), nextTxStatus('T', "PREPARE TRANSACTION 'a'", "PREPARE TRANSACTION", false))
+}
+
+func TestQuery_IsWrite(t *testing.T) {
+	assert.False(t, Query{SQL: "select 1", CommandTag: "SELECT 1"}.IsWrite())
+	assert.True(t, Query{SQL: "with x as (select 1) insert into t select * from x", CommandTag: "INSERT 0 1"}.IsWrite())
+	assert.True(t, Query{SQL: "  update t set a = 1"}.IsWrite())
+	assert.True(t, Query{SQL: "copy t from stdin", CommandTag: "COPY 3"}.IsWrite())
+	assert.False(t, Query{SQL: "copy t to stdout", CommandTag: "COPY 3"}.IsWrite())
+	assert.False(t, Query{SQL: "COPY (SELECT * FROM t) TO STDOUT", CommandTag: "COPY 3"}.IsWrite())
+	assert.False(t, Query{SQL: `copy "from" (a, b) to stdout`}.IsWrite())
+	assert.True(t, Query{SQL: "copy public.t (a, b) from stdin with (format csv)"}.IsWrite())
+}
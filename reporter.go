@@ -0,0 +1,102 @@
+package pgsnap
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type (
+	// Reporter is where pgsnap report errors and logs. testing.TB already
+	// satisfy this interface, but any logger that can format message can be
+	// used, so pgsnap can be used outside of go test (benchmark harness,
+	// examples or long-running tools).
+	Reporter interface {
+		Errorf(format string, args ...interface{})
+		Logf(format string, args ...interface{})
+	}
+
+	// MultiError is the errors returned by Snap.Finish
+	MultiError []error
+
+	// collector is the Reporter used by proxy, server and script. Those
+	// engines run in background goroutine, so instead of touching the
+	// testing.TB directly, the errors are collected and surfaced on Finish.
+	collector struct {
+		mu       sync.Mutex
+		r        Reporter
+		name     string
+		errs     []error
+		finished bool
+	}
+)
+
+func (m MultiError) Error() string {
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// TBReporter adapts testing.TB into Reporter. It's the default Reporter
+// used by NewSnap.
+func TBReporter(t testing.TB) Reporter {
+	return t
+}
+
+func newCollector(r Reporter, name string) *collector {
+	return &collector{r: r, name: name}
+}
+
+// Errorf will save the error, and it will be reported when flush is called.
+// Error that come after flush only printed by log package.
+func (c *collector) Errorf(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finished {
+		log.Printf(c.name+": "+format, args...)
+		return
+	}
+	c.errs = append(c.errs, fmt.Errorf(format, args...))
+}
+
+// Logf forwards the log to the Reporter. After flush, the Reporter might be
+// gone already (test is completed), so the log is printed by log package.
+func (c *collector) Logf(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finished {
+		log.Printf(c.name+": "+format, args...)
+		return
+	}
+	c.r.Logf(format, args...)
+}
+
+// assertf reports the failed assertion into the Reporter right away. Unlike
+// Errorf, it's called by the test after Finish, not by the engines
+func (c *collector) assertf(format string, args ...interface{}) {
+	c.r.Errorf(format, args...)
+}
+
+// Errors returns the collected errors
+func (c *collector) Errors() []error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]error(nil), c.errs...)
+}
+
+// flush reports all collected errors into the Reporter and returns them.
+func (c *collector) flush() []error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, err := range c.errs {
+		c.r.Errorf("%v", err)
+	}
+	c.finished = true
+
+	return append([]error(nil), c.errs...)
+}
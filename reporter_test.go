@@ -0,0 +1,25 @@
+package pgsnap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_collector(t *testing.T) {
+	tb := newFakeTB(t)
+	c := newCollector(tb, t.Name())
+
+	c.Errorf("first error: %d", 1)
+	c.Errorf("second error: %s", "two")
+
+	assert.Empty(t, tb.ErrorMessages, "errors should not be reported before flush")
+	assert.Len(t, c.Errors(), 2)
+
+	errs := c.flush()
+	assert.Len(t, errs, 2)
+	assert.Equal(t, []string{"first error: 1", "second error: two"}, tb.ErrorMessages)
+
+	c.Errorf("error after flush")
+	assert.Len(t, tb.ErrorMessages, 2, "errors after flush should not be reported to finished test")
+}
@@ -0,0 +1,538 @@
+package pgsnap
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const (
+	// sandboxTx is the savepoint that replace the client transaction
+	sandboxTx = "pgsnap_tx"
+
+	// sandboxStmt is the savepoint that moved after the batch that writes
+	// outside client transaction, so the failed statement can be rolled
+	// back without aborting the whole sandbox
+	sandboxStmt = "pgsnap_stmt"
+)
+
+type (
+	// sandbox wraps the recording session in one transaction that never
+	// committed. Client BEGIN/COMMIT/ROLLBACK are translated into
+	// SAVEPOINT/RELEASE/ROLLBACK TO, and the responses are translated back,
+	// so the client (and the snapshot) never know about it.
+	//
+	// In simple query, the transaction statements are replaced in the
+	// query string. In extended protocol, the client statement is parsed
+	// as a statement that does nothing, and its Execute is replaced by the
+	// translated statement in a statement of the sandbox. PREPARE
+	// TRANSACTION is replaced by a statement that fails, so the sandbox is
+	// never committed.
+	sandbox struct {
+		mu sync.Mutex
+
+		// depth is 1 when the client is inside transaction
+		depth int
+
+		// failed is true when the client transaction is aborted
+		failed bool
+
+		// batch is the client batch that is being sent, it's queued in
+		// responses when its first message is sent
+		batch *sandboxResponse
+
+		// fixup is the savepoint query that is sent before the next
+		// batch. It's decided by the response of the last batch outside
+		// client transaction: sandboxKeep after the write, and
+		// sandboxRestore after the failure
+		fixup string
+
+		// statements and portals is the sql of the client statements and
+		// portals by their name
+		statements map[string]string
+		portals    map[string]string
+
+		// responses is the batches sent to postgres that are not answered
+		// yet, in order. The client might send the next batch before the
+		// previous one is answered
+		responses []*sandboxResponse
+	}
+
+	tagRewrite struct {
+		from string
+		to   string
+	}
+
+	// sandboxResponse is the batch that answered by one ReadyForQuery
+	sandboxResponse struct {
+		// injected is true when the batch is sent by the sandbox, the
+		// response is not forwarded to the client
+		injected bool
+
+		// restoreOnFail is true for the injected sandboxKeep that sent
+		// alone, when it fails the savepoint is restored before the next
+		// batch
+		restoreOnFail bool
+
+		// inTx is true when the client is inside transaction after the
+		// batch
+		inTx bool
+
+		// writes is true when the batch might modify the database, so the
+		// savepoint is kept after it
+		writes bool
+
+		// fixed is true when the savepoint queries are already sent after
+		// the batch, before it's answered
+		fixed bool
+
+		tags []tagRewrite
+
+		// drops is the ParseComplete, BindComplete and CloseComplete of
+		// the batch in order, true when it's the response of the message
+		// sent by the sandbox
+		drops []bool
+	}
+)
+
+// sandboxBegin and sandboxSavepoint is run in the upstream connection
+// before proxying
+const (
+	sandboxBegin     = "BEGIN"
+	sandboxSavepoint = "SAVEPOINT " + sandboxStmt
+)
+
+// sandboxKeep moves the savepoint after the batch that writes, and
+// sandboxRestore rolls back the failed batch. Outside client transaction,
+// one of them is sent before the next batch, when it's needed
+const (
+	sandboxKeep    = "RELEASE SAVEPOINT " + sandboxStmt + "; SAVEPOINT " + sandboxStmt
+	sandboxRestore = "ROLLBACK TO SAVEPOINT " + sandboxStmt
+)
+
+// sandboxReject replaces the transaction statement that can't be translated
+const sandboxReject = `DO $pgsnap$BEGIN RAISE EXCEPTION 'pgsnap sandbox: PREPARE TRANSACTION is not supported' ` +
+	`USING ERRCODE = 'feature_not_supported'; END$pgsnap$`
+
+// sandboxNoop replaces COMMIT and ROLLBACK outside transaction, postgres only
+// give warning for them. It's also parsed for the client transaction
+// statement in extended protocol
+const sandboxNoop = "DO $pgsnap$BEGIN END$pgsnap$"
+
+// rewrite translate client message before sent to postgres. The messages are
+// sent in the returned order
+func (s *sandbox) rewrite(msg pgproto3.FrontendMessage) []pgproto3.FrontendMessage {
+	if s == nil {
+		return []pgproto3.FrontendMessage{msg}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch msg.(type) {
+	case *pgproto3.Terminate, *pgproto3.CopyData, *pgproto3.CopyDone, *pgproto3.CopyFail:
+		// COPY FROM STDIN belongs to the batch of its query
+		return []pgproto3.FrontendMessage{msg}
+	}
+
+	if s.statements == nil {
+		s.statements = map[string]string{}
+		s.portals = map[string]string{}
+	}
+
+	msgs := s.beginBatch()
+
+	switch m := msg.(type) {
+	case *pgproto3.Query:
+		msg = s.rewriteQuery(m)
+		s.endBatch()
+	case *pgproto3.Sync:
+		s.endBatch()
+	case *pgproto3.Parse:
+		msg = s.rewriteParse(m)
+	case *pgproto3.Bind:
+		s.portals[m.DestinationPortal] = s.statements[m.PreparedStatement]
+		s.batch.drops = append(s.batch.drops, false)
+	case *pgproto3.Execute:
+		return append(msgs, s.rewriteExecute(m)...)
+	case *pgproto3.Close:
+		if m.ObjectType == 'S' {
+			delete(s.statements, m.Name)
+		} else {
+			delete(s.portals, m.Name)
+		}
+		s.batch.drops = append(s.batch.drops, false)
+	}
+
+	return append(msgs, msg)
+}
+
+// beginBatch queue the response of the batch, when msg is its first message.
+// The savepoint queries of the previous batch are sent before it. When the
+// previous batch is not answered yet, both of them are sent
+func (s *sandbox) beginBatch() []pgproto3.FrontendMessage {
+	if s.batch != nil {
+		return nil
+	}
+
+	var queries []string
+	for _, r := range s.responses {
+		if !r.injected && !r.inTx && !r.fixed {
+			r.fixed = true
+			queries = []string{sandboxKeep, sandboxRestore}
+		}
+	}
+	if queries == nil && s.fixup != "" {
+		queries = []string{s.fixup}
+	}
+	s.fixup = ""
+
+	var msgs []pgproto3.FrontendMessage
+	for _, q := range queries {
+		msgs = append(msgs, &pgproto3.Query{String: q})
+		s.responses = append(s.responses, &sandboxResponse{
+			injected:      true,
+			restoreOnFail: len(queries) == 1 && q == sandboxKeep,
+		})
+	}
+
+	s.batch = &sandboxResponse{}
+	s.responses = append(s.responses, s.batch)
+	return msgs
+}
+
+func (s *sandbox) endBatch() {
+	s.batch.inTx = s.depth > 0
+	s.batch = nil
+}
+
+func (s *sandbox) rewriteQuery(q *pgproto3.Query) *pgproto3.Query {
+	stmts := splitStatements(q.String)
+
+	rewritten := false
+	for i, stmt := range stmts {
+		stmt = strings.TrimSpace(stmt)
+		if isTxStatement(normalizeTxStatement(stmt), "prepare transaction") {
+			return &pgproto3.Query{String: sandboxReject}
+		}
+
+		tx, ok := s.rewriteStatement(stmt)
+		if !ok {
+			stmts[i] = stmt
+			s.batch.writes = s.batch.writes || !isReadOnly(stmt)
+			continue
+		}
+
+		stmts[i] = tx
+		rewritten = true
+	}
+
+	if !rewritten {
+		return q
+	}
+	return &pgproto3.Query{String: strings.Join(stmts, "; ")}
+}
+
+// rewriteParse parse the statement that does nothing for the transaction
+// statement, it's translated when it's executed
+func (s *sandbox) rewriteParse(m *pgproto3.Parse) pgproto3.FrontendMessage {
+	s.statements[m.Name] = m.Query
+	s.batch.drops = append(s.batch.drops, false)
+
+	if !hasTxStatement(m.Query) {
+		return m
+	}
+
+	// postgres doesn't accept multi-statement in extended protocol
+	stmts := splitStatements(m.Query)
+	if len(stmts) != 1 || isTxStatement(normalizeTxStatement(stmts[0]), "prepare transaction") {
+		return &pgproto3.Parse{Name: m.Name, Query: sandboxReject}
+	}
+	return &pgproto3.Parse{Name: m.Name, Query: sandboxNoop}
+}
+
+// rewriteExecute replace the execution of the transaction statement with
+// the translated one, in the statement and portal of the sandbox
+func (s *sandbox) rewriteExecute(m *pgproto3.Execute) []pgproto3.FrontendMessage {
+	sql := s.portals[m.Portal]
+
+	if stmts := splitStatements(sql); len(stmts) == 1 && hasTxStatement(sql) {
+		if tx, ok := s.rewriteStatement(strings.TrimSpace(stmts[0])); ok {
+			s.batch.drops = append(s.batch.drops, true, true, true, true)
+			return []pgproto3.FrontendMessage{
+				&pgproto3.Parse{Name: sandboxTx, Query: tx},
+				&pgproto3.Bind{DestinationPortal: sandboxTx, PreparedStatement: sandboxTx},
+				&pgproto3.Execute{Portal: sandboxTx},
+				&pgproto3.Close{ObjectType: 'P', Name: sandboxTx},
+				&pgproto3.Close{ObjectType: 'S', Name: sandboxTx},
+			}
+		}
+	}
+
+	s.batch.writes = s.batch.writes || !isReadOnly(sql)
+	return []pgproto3.FrontendMessage{m}
+}
+
+// rewriteStatement returns the statement that replace the client BEGIN,
+// COMMIT or ROLLBACK. It returns false for the other statements
+func (s *sandbox) rewriteStatement(stmt string) (string, bool) {
+	normalized := normalizeTxStatement(stmt)
+
+	switch {
+	case isTxStatement(normalized, "begin", "start transaction"):
+		if s.depth > 0 {
+			// postgres only give warning for nested BEGIN
+			return stmt, true
+		}
+		s.depth = 1
+		s.failed = false
+		return s.replace("SAVEPOINT "+sandboxTx, "SAVEPOINT", "BEGIN"), true
+
+	case isTxStatement(normalized, "commit", "end"):
+		if s.depth == 0 {
+			return s.replace(sandboxNoop, "DO", "COMMIT"), true
+		}
+		s.depth = 0
+		if s.failed {
+			// postgres replies ROLLBACK when committing aborted transaction
+			return s.replace("ROLLBACK TO SAVEPOINT "+sandboxTx, "ROLLBACK", "ROLLBACK"), true
+		}
+		s.batch.writes = true
+		return s.replace("RELEASE SAVEPOINT "+sandboxTx, "RELEASE", "COMMIT"), true
+
+	case isTxStatement(normalized, "rollback", "abort") && !strings.HasPrefix(normalized, "rollback to"):
+		if s.depth == 0 {
+			return s.replace(sandboxNoop, "DO", "ROLLBACK"), true
+		}
+		s.depth = 0
+		return s.replace("ROLLBACK TO SAVEPOINT "+sandboxTx, "ROLLBACK", "ROLLBACK"), true
+	}
+
+	return "", false
+}
+
+// translate translate postgres message before sent to client. It returns
+// nil when the message is a response of injected query.
+func (s *sandbox) translate(msg pgproto3.BackendMessage) (pgproto3.BackendMessage, error) {
+	if s == nil {
+		return msg, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.responses) == 0 {
+		return msg, nil
+	}
+
+	batch := s.responses[0]
+	if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+		s.responses = s.responses[1:]
+	}
+
+	if batch.injected {
+		if m, ok := msg.(*pgproto3.ReadyForQuery); ok && m.TxStatus == 'E' && batch.restoreOnFail {
+			s.fixup = sandboxRestore
+		}
+		return nil, nil
+	}
+
+	switch m := msg.(type) {
+	case *pgproto3.ParseComplete, *pgproto3.BindComplete, *pgproto3.CloseComplete:
+		if len(batch.drops) > 0 {
+			drop := batch.drops[0]
+			batch.drops = batch.drops[1:]
+			if drop {
+				return nil, nil
+			}
+		}
+
+	case *pgproto3.ErrorResponse:
+		// the rest of the batch is skipped until Sync
+		batch.drops = nil
+
+	case *pgproto3.CommandComplete:
+		if len(batch.tags) > 0 && string(m.CommandTag) == batch.tags[0].from {
+			tag := batch.tags[0].to
+			batch.tags = batch.tags[1:]
+			return &pgproto3.CommandComplete{CommandTag: []byte(tag)}, nil
+		}
+
+	case *pgproto3.ReadyForQuery:
+		if m.TxStatus == 'I' {
+			return msg, fmt.Errorf("sandbox transaction is ended by client, the changes are not rolled back")
+		}
+
+		if batch.inTx {
+			s.failed = m.TxStatus == 'E'
+			return msg, nil
+		}
+
+		// outside the client transaction, the failed statement is
+		// rolled back by sandboxRestore
+		if !batch.fixed {
+			switch {
+			case m.TxStatus == 'E':
+				s.fixup = sandboxRestore
+			case batch.writes:
+				s.fixup = sandboxKeep
+			}
+		}
+		return &pgproto3.ReadyForQuery{TxStatus: 'I'}, nil
+	}
+
+	return msg, nil
+}
+
+func (s *sandbox) replace(query, from, to string) string {
+	s.batch.tags = append(s.batch.tags, tagRewrite{from: from, to: to})
+	return query
+}
+
+// readOnlyFunctions is the functions and the keywords before parenthesis,
+// that can be in the query that doesn't write
+var readOnlyFunctions = map[string]bool{
+	"in": true, "any": true, "some": true, "all": true, "exists": true, "values": true,
+	"not": true, "and": true, "or": true, "select": true, "from": true, "where": true,
+	"on": true, "using": true, "as": true, "over": true, "filter": true, "within": true,
+	"join": true, "lateral": true, "cast": true, "row": true, "array": true, "by": true,
+	"coalesce": true, "nullif": true, "greatest": true, "least": true,
+	"count": true, "sum": true, "min": true, "max": true, "avg": true,
+	"array_agg": true, "string_agg": true, "json_agg": true, "jsonb_agg": true,
+	"lower": true, "upper": true, "length": true, "abs": true, "round": true,
+	"now": true, "date_trunc": true, "extract": true, "row_number": true, "unnest": true,
+	"numeric": true, "decimal": true, "varchar": true, "char": true, "timestamp": true,
+}
+
+// functionCall matches the name before parenthesis
+var functionCall = regexp.MustCompile(`([a-z_][a-z0-9_$.]*)\s*\(`)
+
+// selectInto matches SELECT INTO, that creates the table
+var selectInto = regexp.MustCompile(`\binto\b`)
+
+// isReadOnly returns true when the statements only read. The statement that
+// calls the function that is not in readOnlyFunctions might write, like
+// SELECT nextval(...), so it's not read only
+func isReadOnly(sql string) bool {
+	for _, stmt := range splitStatements(sql) {
+		switch firstWord(stmt) {
+		case "SELECT", "SHOW", "VALUES", "TABLE", "FETCH", "MOVE":
+		default:
+			return false
+		}
+
+		lower := strings.ToLower(stmt)
+		if selectInto.MatchString(lower) {
+			return false
+		}
+
+		for _, m := range functionCall.FindAllStringSubmatch(lower, -1) {
+			if !readOnlyFunctions[m[1]] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// normalizeTxStatement lower the case, collapse the whitespaces and remove
+// the trailing semicolon
+func normalizeTxStatement(sql string) string {
+	sql = strings.TrimSpace(strings.ToLower(sql))
+	sql = strings.TrimRight(sql, "; \t\n")
+	return strings.Join(strings.Fields(sql), " ")
+}
+
+func isTxStatement(stmt string, keywords ...string) bool {
+	for _, k := range keywords {
+		if stmt == k || strings.HasPrefix(stmt, k+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTxStatement returns true when one of the statements in sql begin or end
+// the transaction
+func hasTxStatement(sql string) bool {
+	for _, stmt := range splitStatements(sql) {
+		stmt = normalizeTxStatement(stmt)
+		if isTxStatement(stmt, "begin", "start transaction", "commit", "end", "rollback", "abort", "prepare transaction") &&
+			!strings.HasPrefix(stmt, "rollback to") {
+			return true
+		}
+	}
+	return false
+}
+
+// dollarTag matches the opening of dollar quoted string, like $$ or $body$
+var dollarTag = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// splitStatements split the multi-statement query by semicolon. The
+// semicolon inside quoted string, quoted identifier, dollar quoted string
+// (like function body) or comment doesn't end the statement. The empty
+// statements are dropped.
+func splitStatements(sql string) []string {
+	var stmts []string
+
+	add := func(stmt string) {
+		if strings.TrimSpace(stmt) != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+
+	start := 0
+	for i := 0; i < len(sql); i++ {
+		switch c := sql[i]; {
+		case c == '\'' || c == '"':
+			// the escaped quote is read as two adjacent strings
+			j := strings.IndexByte(sql[i+1:], c)
+			if j < 0 {
+				i = len(sql)
+				break
+			}
+			i += j + 1
+
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			j := strings.IndexByte(sql[i:], '\n')
+			if j < 0 {
+				i = len(sql)
+				break
+			}
+			i += j
+
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			j := strings.Index(sql[i:], "*/")
+			if j < 0 {
+				i = len(sql)
+				break
+			}
+			i += j + 1
+
+		case c == '$':
+			tag := dollarTag.FindString(sql[i:])
+			if tag == "" {
+				break
+			}
+			j := strings.Index(sql[i+len(tag):], tag)
+			if j < 0 {
+				i = len(sql)
+				break
+			}
+			i += len(tag) + j + len(tag) - 1
+
+		case c == ';':
+			add(sql[start:i])
+			start = i + 1
+		}
+	}
+
+	if start < len(sql) {
+		add(sql[start:])
+	}
+
+	return stmts
+}
@@ -0,0 +1,401 @@
+package pgsnap
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	keepSavepoint    = &pgproto3.Query{String: "RELEASE SAVEPOINT pgsnap_stmt; SAVEPOINT pgsnap_stmt"}
+	restoreSavepoint = &pgproto3.Query{String: "ROLLBACK TO SAVEPOINT pgsnap_stmt"}
+
+	keepResponses = []pgproto3.BackendMessage{
+		&pgproto3.CommandComplete{CommandTag: []byte("RELEASE")},
+		&pgproto3.CommandComplete{CommandTag: []byte("SAVEPOINT")},
+		&pgproto3.ReadyForQuery{TxStatus: 'T'},
+	}
+	restoreResponses = []pgproto3.BackendMessage{
+		&pgproto3.CommandComplete{CommandTag: []byte("ROLLBACK")},
+		&pgproto3.ReadyForQuery{TxStatus: 'T'},
+	}
+)
+
+// translateAll returns the translated messages that forwarded to the client
+func translateAll(t *testing.T, s *sandbox, msgs ...pgproto3.BackendMessage) []pgproto3.BackendMessage {
+	t.Helper()
+
+	var out []pgproto3.BackendMessage
+	for _, msg := range msgs {
+		m, err := s.translate(msg)
+		require.NoError(t, err)
+		if m != nil {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func Test_sandbox_transaction(t *testing.T) {
+	s := &sandbox{}
+
+	// BEGIN
+	msgs := s.rewrite(&pgproto3.Query{String: "BEGIN READ WRITE"})
+	assert.Equal(t, []pgproto3.FrontendMessage{&pgproto3.Query{String: "SAVEPOINT pgsnap_tx"}}, msgs)
+
+	assert.Equal(t, []pgproto3.BackendMessage{
+		&pgproto3.CommandComplete{CommandTag: []byte("BEGIN")},
+		&pgproto3.ReadyForQuery{TxStatus: 'T'},
+	}, translateAll(t, s,
+		&pgproto3.CommandComplete{CommandTag: []byte("SAVEPOINT")},
+		&pgproto3.ReadyForQuery{TxStatus: 'T'},
+	))
+
+	// statement inside transaction is not touched
+	insert := &pgproto3.Query{String: "insert into mytable(name) values ('Budi')"}
+	assert.Equal(t, []pgproto3.FrontendMessage{insert}, s.rewrite(insert))
+	translateAll(t, s, &pgproto3.CommandComplete{CommandTag: []byte("INSERT 0 1")}, &pgproto3.ReadyForQuery{TxStatus: 'T'})
+
+	// COMMIT
+	msgs = s.rewrite(&pgproto3.Query{String: "commit;"})
+	assert.Equal(t, []pgproto3.FrontendMessage{&pgproto3.Query{String: "RELEASE SAVEPOINT pgsnap_tx"}}, msgs)
+
+	assert.Equal(t, []pgproto3.BackendMessage{
+		&pgproto3.CommandComplete{CommandTag: []byte("COMMIT")},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	}, translateAll(t, s,
+		&pgproto3.CommandComplete{CommandTag: []byte("RELEASE")},
+		&pgproto3.ReadyForQuery{TxStatus: 'T'},
+	))
+	assert.Empty(t, s.responses)
+
+	// the committed changes are kept before the next batch, the response
+	// of the savepoint query is not forwarded
+	msgs = s.rewrite(&pgproto3.Query{String: "select 1"})
+	assert.Equal(t, []pgproto3.FrontendMessage{keepSavepoint, &pgproto3.Query{String: "select 1"}}, msgs)
+	assert.Equal(t, []pgproto3.BackendMessage{
+		&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	}, translateAll(t, s, append(keepResponses,
+		&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+		&pgproto3.ReadyForQuery{TxStatus: 'T'},
+	)...))
+}
+
+// outside client transaction, the savepoint is only moved after the batch
+// that writes, and restored after the failed one
+func Test_sandbox_savepoint(t *testing.T) {
+	s := &sandbox{}
+	selectOne := &pgproto3.Query{String: "select 1"}
+	selected := []pgproto3.BackendMessage{
+		&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+		&pgproto3.ReadyForQuery{TxStatus: 'T'},
+	}
+
+	// read only
+	assert.Equal(t, []pgproto3.FrontendMessage{selectOne}, s.rewrite(selectOne))
+	translateAll(t, s, selected...)
+	assert.Equal(t, []pgproto3.FrontendMessage{selectOne}, s.rewrite(selectOne))
+	translateAll(t, s, selected...)
+
+	// write
+	insert := &pgproto3.Query{String: "insert into x values (1)"}
+	assert.Equal(t, []pgproto3.FrontendMessage{insert}, s.rewrite(insert))
+	translateAll(t, s, &pgproto3.CommandComplete{CommandTag: []byte("INSERT 0 1")}, &pgproto3.ReadyForQuery{TxStatus: 'T'})
+	assert.Equal(t, []pgproto3.FrontendMessage{keepSavepoint, selectOne}, s.rewrite(selectOne))
+
+	// failed
+	errResponse := &pgproto3.ErrorResponse{Code: "42P01"}
+	assert.Equal(t, []pgproto3.BackendMessage{
+		errResponse,
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	}, translateAll(t, s, append(keepResponses,
+		errResponse,
+		&pgproto3.ReadyForQuery{TxStatus: 'E'},
+	)...))
+	assert.Equal(t, []pgproto3.FrontendMessage{restoreSavepoint, selectOne}, s.rewrite(selectOne))
+	translateAll(t, s, append(restoreResponses, selected...)...)
+
+	assert.Empty(t, s.responses)
+	assert.Empty(t, s.fixup)
+}
+
+func Test_sandbox_failedStatement(t *testing.T) {
+	s := &sandbox{}
+
+	t.Run("commit aborted transaction", func(t *testing.T) {
+		s.rewrite(&pgproto3.Query{String: "begin"})
+		translateAll(t, s, &pgproto3.CommandComplete{CommandTag: []byte("SAVEPOINT")}, &pgproto3.ReadyForQuery{TxStatus: 'T'})
+
+		s.rewrite(&pgproto3.Query{String: "insert into x values (1)"})
+		out := translateAll(t, s, &pgproto3.ReadyForQuery{TxStatus: 'E'})
+		assert.Equal(t, []pgproto3.BackendMessage{&pgproto3.ReadyForQuery{TxStatus: 'E'}}, out)
+
+		// the aborted client transaction is not restored by the sandbox
+		msgs := s.rewrite(&pgproto3.Query{String: "COMMIT"})
+		assert.Equal(t, []pgproto3.FrontendMessage{&pgproto3.Query{String: "ROLLBACK TO SAVEPOINT pgsnap_tx"}}, msgs)
+	})
+
+	t.Run("transaction ended by client", func(t *testing.T) {
+		s := &sandbox{}
+		s.rewrite(&pgproto3.Query{String: "select 1"})
+		_, err := s.translate(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		assert.Error(t, err)
+	})
+}
+
+// the client send the second batch before the first one is answered, both
+// savepoint queries are sent between them
+func Test_sandbox_pipeline(t *testing.T) {
+	s := &sandbox{}
+
+	var sent []pgproto3.FrontendMessage
+	for i := 0; i < 2; i++ {
+		sent = append(sent, s.rewrite(&pgproto3.Parse{Query: "select 1"})...)
+		sent = append(sent, s.rewrite(&pgproto3.Sync{})...)
+	}
+	assert.Equal(t, []pgproto3.FrontendMessage{
+		&pgproto3.Parse{Query: "select 1"}, &pgproto3.Sync{},
+		keepSavepoint, restoreSavepoint,
+		&pgproto3.Parse{Query: "select 1"}, &pgproto3.Sync{},
+	}, sent)
+
+	batch := []pgproto3.BackendMessage{&pgproto3.ParseComplete{}, &pgproto3.ReadyForQuery{TxStatus: 'T'}}
+
+	var responses []pgproto3.BackendMessage
+	responses = append(responses, batch...)
+	responses = append(responses, keepResponses...)
+	responses = append(responses, restoreResponses...)
+	responses = append(responses, batch...)
+
+	assert.Equal(t, []pgproto3.BackendMessage{
+		&pgproto3.ParseComplete{}, &pgproto3.ReadyForQuery{TxStatus: 'I'},
+		&pgproto3.ParseComplete{}, &pgproto3.ReadyForQuery{TxStatus: 'I'},
+	}, translateAll(t, s, responses...))
+
+	// the first batch is already handled
+	assert.Empty(t, s.fixup)
+}
+
+// the transaction statement in extended protocol is executed as the
+// statement of the sandbox
+func Test_sandbox_extendedProtocol(t *testing.T) {
+	s := &sandbox{}
+
+	var sent []pgproto3.FrontendMessage
+	for _, msg := range []pgproto3.FrontendMessage{
+		&pgproto3.Parse{Name: "s1", Query: "begin"},
+		&pgproto3.Bind{PreparedStatement: "s1"},
+		&pgproto3.Describe{ObjectType: 'P'},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	} {
+		sent = append(sent, s.rewrite(msg)...)
+	}
+	assert.Equal(t, []pgproto3.FrontendMessage{
+		&pgproto3.Parse{Name: "s1", Query: sandboxNoop},
+		&pgproto3.Bind{PreparedStatement: "s1"},
+		&pgproto3.Describe{ObjectType: 'P'},
+		&pgproto3.Parse{Name: "pgsnap_tx", Query: "SAVEPOINT pgsnap_tx"},
+		&pgproto3.Bind{DestinationPortal: "pgsnap_tx", PreparedStatement: "pgsnap_tx"},
+		&pgproto3.Execute{Portal: "pgsnap_tx"},
+		&pgproto3.Close{ObjectType: 'P', Name: "pgsnap_tx"},
+		&pgproto3.Close{ObjectType: 'S', Name: "pgsnap_tx"},
+		&pgproto3.Sync{},
+	}, sent)
+
+	assert.Equal(t, []pgproto3.BackendMessage{
+		&pgproto3.ParseComplete{},
+		&pgproto3.BindComplete{},
+		&pgproto3.NoData{},
+		&pgproto3.CommandComplete{CommandTag: []byte("BEGIN")},
+		&pgproto3.ReadyForQuery{TxStatus: 'T'},
+	}, translateAll(t, s,
+		&pgproto3.ParseComplete{},
+		&pgproto3.BindComplete{},
+		&pgproto3.NoData{},
+		&pgproto3.ParseComplete{},
+		&pgproto3.BindComplete{},
+		&pgproto3.CommandComplete{CommandTag: []byte("SAVEPOINT")},
+		&pgproto3.CloseComplete{},
+		&pgproto3.CloseComplete{},
+		&pgproto3.ReadyForQuery{TxStatus: 'T'},
+	))
+
+	// the prepared COMMIT is translated when it's executed
+	s.rewrite(&pgproto3.Parse{Name: "s2", Query: "commit"})
+	s.rewrite(&pgproto3.Bind{PreparedStatement: "s2"})
+	msgs := s.rewrite(&pgproto3.Execute{})
+	assert.Equal(t, &pgproto3.Parse{Name: "pgsnap_tx", Query: "RELEASE SAVEPOINT pgsnap_tx"}, msgs[0])
+	s.rewrite(&pgproto3.Bind{PreparedStatement: "s2"})
+	msgs = s.rewrite(&pgproto3.Execute{})
+	assert.Equal(t, &pgproto3.Parse{Name: "pgsnap_tx", Query: sandboxNoop}, msgs[0])
+}
+
+func Test_sandbox_rewriteQuery(t *testing.T) {
+	reject := &pgproto3.Query{String: sandboxReject}
+
+	tests := []struct {
+		name string
+		msg  pgproto3.FrontendMessage
+		want pgproto3.FrontendMessage
+	}{
+		{"multi-statement query", &pgproto3.Query{String: "BEGIN; insert into x values (1); COMMIT"},
+			&pgproto3.Query{String: "SAVEPOINT pgsnap_tx; insert into x values (1); RELEASE SAVEPOINT pgsnap_tx"}},
+		{"multi-statement query without transaction", &pgproto3.Query{String: "insert into x values (1); select 1"},
+			&pgproto3.Query{String: "insert into x values (1); select 1"}},
+		{"prepare transaction", &pgproto3.Query{String: "BEGIN; PREPARE TRANSACTION 'a'"}, reject},
+		{"extended protocol multi-statement", &pgproto3.Parse{Name: "s1", Query: "COMMIT; select 1"}, &pgproto3.Parse{Name: "s1", Query: sandboxReject}},
+		{"extended protocol rollback to savepoint", &pgproto3.Parse{Query: "ROLLBACK TO SAVEPOINT a"},
+			&pgproto3.Parse{Query: "ROLLBACK TO SAVEPOINT a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &sandbox{}
+			assert.Equal(t, tt.want, s.rewrite(tt.msg)[0])
+		})
+	}
+}
+
+func Test_sandbox_commitOutsideTransaction(t *testing.T) {
+	s := &sandbox{}
+
+	msgs := s.rewrite(&pgproto3.Query{String: "COMMIT"})
+	assert.Equal(t, []pgproto3.FrontendMessage{&pgproto3.Query{String: sandboxNoop}}, msgs)
+
+	out := translateAll(t, s,
+		&pgproto3.CommandComplete{CommandTag: []byte("DO")},
+		&pgproto3.ReadyForQuery{TxStatus: 'T'},
+	)
+	assert.Equal(t, []pgproto3.BackendMessage{
+		&pgproto3.CommandComplete{CommandTag: []byte("COMMIT")},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	}, out)
+}
+
+func Test_isReadOnly(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{"select id from mytable where id = $1", true},
+		{"SELECT count(*) FROM t WHERE id IN (1, 2)", true},
+		{"select 1; show timezone", true},
+		{"", true},
+		{"insert into t values (1)", false},
+		{"with x as (delete from t returning *) select * from x", false},
+		{"select nextval('s')", false},
+		{"select * into t2 from t", false},
+		{"select 1; delete from t", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			assert.Equal(t, tt.want, isReadOnly(tt.sql))
+		})
+	}
+}
+
+func Test_hasTxStatement(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{"select 1", false},
+		{"COMMIT", true},
+		{"insert into x values (1);\n  commit;", true},
+		{"start transaction isolation level serializable; select 1", true},
+		{"rollback to savepoint a", false},
+		{"select 'begin'", false},
+		{"select ';commit'", false},
+		{"create function f() returns void as $$ begin perform 1; end $$ language plpgsql", false},
+		{"create function f() returns void as $body$ begin perform 1; end $body$ language plpgsql; commit", true},
+		{"select $1; -- ;commit\nselect 2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			assert.Equal(t, tt.want, hasTxStatement(tt.sql))
+		})
+	}
+}
+
+func Test_sandbox_nil(t *testing.T) {
+	var s *sandbox
+
+	q := &pgproto3.Query{String: "BEGIN"}
+	assert.Equal(t, []pgproto3.FrontendMessage{q}, s.rewrite(q))
+
+	rfq := &pgproto3.ReadyForQuery{TxStatus: 'I'}
+	out, err := s.translate(rfq)
+	assert.Equal(t, rfq, out)
+	assert.NoError(t, err)
+}
+
+func Test_splitStatements(t *testing.T) {
+	assert.Equal(t, []string{"select 1", " select ';'", " select $a$;$a$"}, splitStatements("select 1; select ';'; select $a$;$a$;"))
+	assert.Empty(t, splitStatements(";"))
+}
+
+// the transaction statements in multi-statement query and extended protocol
+// are translated, PREPARE TRANSACTION is rejected by postgres before it's
+// executed, so the sandbox transaction is never committed
+func TestSnap_sandbox_txStatements(t *testing.T) {
+	// the fake server is used as the database, it expects the translated
+	// statements and the savepoint queries
+	upstream := NewSnapWithConfig(&namedTB{TB: t, name: "TestSnap_sandbox_txStatements_upstream"}, addr, Config{})
+
+	s := NewSnapWithConfig(t, upstream.Addr(), Config{ForceWrite: true, Sandbox: true})
+	t.Cleanup(func() { _ = os.Remove(s.script.getFilename()) })
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, s.Addr())
+	require.NoError(t, err)
+
+	t.Run("multi-statement query", func(t *testing.T) {
+		results, err := conn.PgConn().Exec(ctx, "BEGIN; insert into mytable(name) values ('Budi'); COMMIT").ReadAll()
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+		assert.Equal(t, "BEGIN", results[0].CommandTag.String())
+		assert.Equal(t, "COMMIT", results[2].CommandTag.String())
+		assert.Equal(t, byte('I'), conn.PgConn().TxStatus())
+	})
+
+	t.Run("extended protocol", func(t *testing.T) {
+		tag, err := conn.PgConn().ExecParams(ctx, "begin", nil, nil, nil, nil).Close()
+		require.NoError(t, err)
+		assert.Equal(t, "BEGIN", tag.String())
+		assert.Equal(t, byte('T'), conn.PgConn().TxStatus())
+
+		tag, err = conn.PgConn().ExecParams(ctx, "commit", nil, nil, nil, nil).Close()
+		require.NoError(t, err)
+		assert.Equal(t, "COMMIT", tag.String())
+		assert.Equal(t, byte('I'), conn.PgConn().TxStatus())
+	})
+
+	t.Run("prepare transaction", func(t *testing.T) {
+		_, err := conn.Exec(ctx, "PREPARE TRANSACTION 'a'")
+
+		var pgErr *pgconn.PgError
+		require.True(t, errors.As(err, &pgErr), "got %v", err)
+		assert.Equal(t, "0A000", pgErr.Code)
+		assert.Equal(t, byte('I'), conn.PgConn().TxStatus())
+	})
+
+	require.NoError(t, conn.Close(ctx))
+	assert.NoError(t, s.Finish())
+	assert.NoError(t, upstream.Finish())
+
+	// the snapshot contains the statements sent by the client
+	recorded, err := os.ReadFile(s.script.getFilename())
+	require.NoError(t, err)
+	assert.Contains(t, string(recorded), `F {"Type":"Query","String":"BEGIN; insert into mytable(name) values ('Budi'); COMMIT"}`)
+	assert.Contains(t, string(recorded), `F {"Type":"Parse","Name":"","Query":"commit","ParameterOIDs":null}`)
+	assert.Contains(t, string(recorded), `B {"Type":"CommandComplete","CommandTag":"COMMIT"}`)
+	assert.NotContains(t, string(recorded), "pgsnap_")
+}
@@ -2,8 +2,10 @@ package pgsnap
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"strings"
@@ -16,8 +18,40 @@ import (
 
 type (
 	script struct {
-		t    testing.TB
+		t    namer
 		path string
+
+		// metadata is read from the "M key value" lines of the snapshot
+		metadata map[string]string
+
+		// semantic is read from the "Q <json>" lines of the semantic
+		// snapshot
+		semantic []semanticQuery
+
+		// auth is read from the "A <json>" lines, the authentications
+		// before the client is accepted
+		auth []authAttempt
+
+		// names is used by the expectations of the script
+		names *nameMapping
+	}
+
+	// recordedStep is a step that created from a line in snapshot file
+	recordedStep struct {
+		step pgmock.Step
+		msg  pgproto3.Message
+
+		// line is the line number in the snapshot file
+		line int
+
+		// client is true for the F line, the message is received from the
+		// client. CopyData and CopyDone can be sent by both
+		client bool
+	}
+
+	// namer is used to generate the snapshot filename. testing.TB is a namer
+	namer interface {
+		Name() string
 	}
 )
 
@@ -45,7 +79,7 @@ func IsSnapshotExists(t testing.TB) bool {
 	return false
 }
 
-func newScript(t testing.TB) *script {
+func newScript(t namer) *script {
 	return &script{t: t}
 }
 
@@ -70,6 +104,12 @@ func (s *script) getFilename() string {
 	return s.path
 }
 
+// sideFilename returns the filename of the file that saved next to the
+// snapshot, like pgsnap_name.plans.json
+func (s *script) sideFilename(suffix string) string {
+	return strings.TrimSuffix(s.getFilename(), ".txt") + suffix
+}
+
 func (s *script) ReadOnlyFile() (*os.File, error) {
 	return os.OpenFile(s.getFilename(), os.O_RDONLY, 0)
 }
@@ -81,60 +121,165 @@ func (s *script) Read() (*pgmock.Script, error) {
 	}
 	defer f.Close()
 
-	script := s.readScript(f)
-	if len(script.Steps) < len(pgmock.AcceptUnauthenticatedConnRequestSteps())+1 {
+	script, err := s.readScript(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read snapshot %s: %w", s.getFilename(), err)
+	}
+
+	if len(s.semantic) == 0 && len(script.Steps) < len(pgmock.AcceptUnauthenticatedConnRequestSteps())+1 {
 		return script, EmptyScript
 	}
 
 	return script, nil
 }
 
-func (s *script) readScript(f io.Reader) *pgmock.Script {
+func (s *script) readScript(f io.Reader) (*pgmock.Script, error) {
 	script := &pgmock.Script{
 		Steps: pgmock.AcceptUnauthenticatedConnRequestSteps(),
 	}
 
-	scanner := bufio.NewScanner(f)
+	s.metadata = map[string]string{}
+	s.semantic = nil
+	s.auth = nil
+
+	// the snapshot is replayed by one connection
+	names := newNameMapping()
+	s.names = names
 
-	for scanner.Scan() {
-		b := scanner.Bytes()
+	// bufio.Reader is used instead of bufio.Scanner, because the line can
+	// be larger than the Scanner buffer, like DataRow with large jsonb
+	reader := bufio.NewReader(f)
+
+	for n := 1; ; n++ {
+		b, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if len(b) == 0 && err == io.EOF {
+			break
+		}
 
+		b = bytes.TrimRight(b, "\r\n")
 		if len(b) < 2 {
 			continue
 		}
 
-		switch b[0] {
-		case 'B':
-			msg := s.unmarshalB(b[1:])
-			script.Steps = append(script.Steps, pgmock.SendMessage(msg))
-		case 'F':
-			msg := s.unmarshalF(b[1:])
-
-			switch m := msg.(type) {
-			case *pgproto3.Parse:
-				script.Steps = append(script.Steps, &expectParseMessage{want: m})
-			case *pgproto3.Describe:
-				script.Steps = append(script.Steps, &expectDescribeMessage{want: m})
-			case *pgproto3.Bind:
-				script.Steps = append(script.Steps, &expectBindMessage{want: m})
-			default:
-				script.Steps = append(script.Steps, pgmock.ExpectMessage(m))
+		if b[0] != 'M' && b[0] != 'A' {
+			b, err = s.blobs(0).resolve(b)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
 			}
+		}
 
+		if err := s.readLine(script, names, n, b); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
 		}
 	}
 
-	return script
+	script.Steps = orderBatches(script.Steps)
+
+	return script, nil
+}
+
+// readLine add the snapshot line n into the script
+func (s *script) readLine(script *pgmock.Script, names *nameMapping, n int, b []byte) error {
+	switch b[0] {
+	case 'M':
+		k, v, err := parseMetadata(b[1:])
+		if err != nil {
+			return err
+		}
+		s.metadata[k] = v
+	case 'A':
+		var a authAttempt
+		if err := json.Unmarshal(b[1:], &a); err != nil {
+			return fmt.Errorf("unmarshal authentication failed: %w\nsource: %s", err, b[1:])
+		}
+		s.auth = append(s.auth, a)
+	case 'Q':
+		var q semanticQuery
+		if err := json.Unmarshal(b[1:], &q); err != nil {
+			return fmt.Errorf("unmarshal semantic query failed: %w\nsource: %s", err, abbreviate(b[1:]))
+		}
+		s.semantic = append(s.semantic, q)
+	case 'B':
+		msg, err := s.unmarshalB(b[1:])
+		if err != nil {
+			return err
+		}
+		script.Steps = append(script.Steps, &recordedStep{step: pgmock.SendMessage(msg), msg: msg, line: n})
+	case 'F':
+		msg, err := s.unmarshalF(b[1:])
+		if err != nil {
+			return err
+		}
+
+		var step pgmock.Step
+		switch m := msg.(type) {
+		case *pgproto3.Parse:
+			step = &expectParseMessage{want: m, names: names}
+		case *pgproto3.Describe:
+			step = &expectDescribeMessage{want: m, names: names}
+		case *pgproto3.Bind:
+			step = &expectBindMessage{want: m, names: names}
+		case *pgproto3.Close:
+			step = &expectCloseMessage{want: m, names: names}
+		case *pgproto3.Execute:
+			step = &expectExecuteMessage{want: m, names: names}
+		case *pgproto3.StartupMessage:
+			step = pgmock.ExpectMessage(m)
+		default:
+			step = &expectMessage{want: m}
+		}
+		script.Steps = append(script.Steps, &recordedStep{step: step, msg: msg, line: n, client: true})
+	default:
+		return fmt.Errorf("unknown line type %q", b[0])
+	}
+
+	return nil
+}
+
+// blobs returns the blob store next to the snapshot
+func (s *script) blobs(threshold int) *blobStore {
+	return &blobStore{dir: s.sideFilename(".blobs"), threshold: threshold}
+}
+
+// abbreviate cut the long source in the error message
+func abbreviate(src []byte) string {
+	const max = 200
+	if len(src) <= max {
+		return string(src)
+	}
+	return fmt.Sprintf("%s... (%d bytes)", src[:max], len(src))
+}
+
+// Step run the step. When the client message is not the expected one, it
+// returns *mismatchError that contains the message
+func (r *recordedStep) Step(backend *pgproto3.Backend) error {
+	c, ok := r.step.(comparer)
+	if !ok {
+		return r.step.Step(backend)
+	}
+
+	msg, err := backend.Receive()
+	if err != nil {
+		return err
+	}
+
+	if err := c.compare(msg); err != nil {
+		return &mismatchError{msg: msg, err: err}
+	}
+
+	return nil
 }
 
-func (s *script) unmarshalB(src []byte) pgproto3.BackendMessage {
+func (s *script) unmarshalB(src []byte) (pgproto3.BackendMessage, error) {
 	t := struct {
 		Type string
 	}{}
 
 	if err := json.Unmarshal(src, &t); err != nil {
-		s.t.Fatalf("unmarshal backend message failed: %v\nsource: %s", err, string(src))
-		return nil
+		return nil, fmt.Errorf("unmarshal backend message failed: %w\nsource: %s", err, abbreviate(src))
 	}
 
 	var o pgproto3.BackendMessage
@@ -188,25 +333,23 @@ func (s *script) unmarshalB(src []byte) pgproto3.BackendMessage {
 		o = &pgproto3.PortalSuspended{}
 
 	default:
-		s.t.Fatalf("unknown backend type: " + t.Type)
-		return nil
+		return nil, fmt.Errorf("unknown backend type: %s", t.Type)
 	}
 
 	if err := json.Unmarshal(src, o); err != nil {
-		s.t.Fatalf("unmarshal backend message to %T failed\nsource: %s", o, string(src))
-		return nil
+		return nil, fmt.Errorf("unmarshal backend message to %T failed: %w\nsource: %s", o, err, abbreviate(src))
 	}
 
-	return o
+	return o, nil
 }
 
-func (s *script) unmarshalF(src []byte) pgproto3.FrontendMessage {
+func (s *script) unmarshalF(src []byte) (pgproto3.FrontendMessage, error) {
 	t := struct {
 		Type string
 	}{}
 
 	if err := json.Unmarshal(src, &t); err != nil {
-		s.t.Fatalf("unmarshal frontend message failed: %v\nsource: %s", err, string(src))
+		return nil, fmt.Errorf("unmarshal frontend message failed: %w\nsource: %s", err, abbreviate(src))
 	}
 
 	var o pgproto3.FrontendMessage
@@ -244,13 +387,12 @@ func (s *script) unmarshalF(src []byte) pgproto3.FrontendMessage {
 		//
 		// gssEncRequest  GSSEncRequest
 		// sslRequest     SSLRequest
-		panic("unknown type: " + t.Type)
+		return nil, fmt.Errorf("unknown frontend type: %s", t.Type)
 	}
 
 	if err := json.Unmarshal(src, o); err != nil {
-		s.t.Fatalf("unmarshal backend message to %T failed\nsource: %s", o, string(src))
-		return nil
+		return nil, fmt.Errorf("unmarshal frontend message to %T failed: %w\nsource: %s", o, err, abbreviate(src))
 	}
 
-	return o
+	return o, nil
 }
@@ -1,9 +1,13 @@
 package pgsnap
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 
+	"github.com/jackc/pgproto3/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_getFilename(t *testing.T) {
@@ -20,3 +24,34 @@ func Test_getFilename(t *testing.T) {
 		assert.Equal(t, "pgsnap__getfilename__what_about_this_one_.txt", s.getFilename())
 	})
 }
+
+func Test_readScript_largeLine(t *testing.T) {
+	large := strings.Repeat("a", 200*1024)
+	line, err := json.Marshal(&pgproto3.DataRow{Values: [][]byte{[]byte(large)}})
+	require.NoError(t, err)
+
+	s := &script{t: t}
+	script, err := s.readScript(strings.NewReader(`F {"Type":"Query","String":"select data"}` + "\nB " + string(line)))
+	require.NoError(t, err)
+
+	last := script.Steps[len(script.Steps)-1].(*recordedStep)
+	assert.Equal(t, large, string(last.msg.(*pgproto3.DataRow).Values[0]))
+}
+
+func Test_readScript_error(t *testing.T) {
+	s := &script{t: t}
+
+	_, err := s.readScript(strings.NewReader("M schema sha256:abc\n" + `F {"Type":"Query","String":";"}` + "\n\n" + `B {"Type":"Unknown"}` + "\n"))
+	assert.EqualError(t, err, "line 4: unknown backend type: Unknown")
+
+	_, err = s.readScript(strings.NewReader(`F {"Type":"Query",` + "\n"))
+	assert.EqualError(t, err, "line 1: unmarshal frontend message failed: unexpected end of JSON input\nsource: "+` {"Type":"Query",`)
+
+	_, err = s.readScript(strings.NewReader("X unknown\n"))
+	assert.EqualError(t, err, `line 1: unknown line type 'X'`)
+}
+
+func Test_abbreviate(t *testing.T) {
+	assert.Equal(t, "short", abbreviate([]byte("short")))
+	assert.Equal(t, strings.Repeat("a", 200)+"... (300 bytes)", abbreviate([]byte(strings.Repeat("a", 300))))
+}
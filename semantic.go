@@ -0,0 +1,180 @@
+package pgsnap
+
+import (
+	"encoding/hex"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+)
+
+// SnapshotLevel is what saved into the snapshot when recording
+type SnapshotLevel int
+
+const (
+	// LevelWire save every message exchanged between client and postgres.
+	// The snapshot can only be replayed by the client that send the same
+	// messages, usually the same driver
+	LevelWire SnapshotLevel = iota
+
+	// LevelSemantic save the queries, the parameters, the columns and the
+	// rows. When replaying, the messages are synthesised for the flow and
+	// the text/binary format requested by the client, so the snapshot
+	// recorded with lib/pq can be replayed by pgx and vice versa
+	LevelSemantic
+)
+
+type (
+	// semanticQuery is a query in the semantic snapshot, saved as
+	// "Q <json>" line. The values are saved in text format, nil is NULL.
+	semanticQuery struct {
+		SQL string
+
+		// ParamOIDs is the parameter types described by postgres
+		ParamOIDs []uint32  `json:",omitempty"`
+		Params    []*string `json:",omitempty"`
+
+		// ParseFailed is true when the query is failed when it's parsed,
+		// so it's never executed
+		ParseFailed bool `json:",omitempty"`
+
+		// Results is the result of each statement. Only simple query can
+		// have more than one statement
+		Results []semanticResult
+
+		// TxStatus is the transaction status after the query
+		TxStatus string `json:",omitempty"`
+	}
+
+	semanticResult struct {
+		// Fields is nil when the statement returns no rows
+		Fields     []semanticField         `json:",omitempty"`
+		Rows       [][]*string             `json:",omitempty"`
+		CommandTag string                  `json:",omitempty"`
+		Empty      bool                    `json:",omitempty"`
+		Error      *pgproto3.ErrorResponse `json:",omitempty"`
+	}
+
+	// semanticField is the FieldDescription without the format
+	semanticField struct {
+		Name                 string
+		TableOID             uint32 `json:",omitempty"`
+		TableAttributeNumber uint16 `json:",omitempty"`
+		DataTypeOID          uint32
+		DataTypeSize         int16
+		TypeModifier         int32
+	}
+)
+
+func newSemanticFields(fields []pgproto3.FieldDescription) []semanticField {
+	result := make([]semanticField, len(fields))
+	for i, f := range fields {
+		result[i] = semanticField{
+			Name:                 string(f.Name),
+			TableOID:             f.TableOID,
+			TableAttributeNumber: f.TableAttributeNumber,
+			DataTypeOID:          f.DataTypeOID,
+			DataTypeSize:         f.DataTypeSize,
+			TypeModifier:         f.TypeModifier,
+		}
+	}
+	return result
+}
+
+// rowDescription returns the RowDescription with the format requested by
+// the client
+func rowDescription(fields []semanticField, formats []int16) *pgproto3.RowDescription {
+	m := &pgproto3.RowDescription{Fields: make([]pgproto3.FieldDescription, len(fields))}
+	for i, f := range fields {
+		m.Fields[i] = pgproto3.FieldDescription{
+			Name:                 []byte(f.Name),
+			TableOID:             f.TableOID,
+			TableAttributeNumber: f.TableAttributeNumber,
+			DataTypeOID:          f.DataTypeOID,
+			DataTypeSize:         f.DataTypeSize,
+			TypeModifier:         f.TypeModifier,
+			Format:               formatCode(formats, i),
+		}
+	}
+	return m
+}
+
+// canonicalize replaces the volatile fields like the wire snapshot
+func (q *semanticQuery) canonicalize(c *canonicalizer) *semanticQuery {
+	n := *q
+	n.Results = make([]semanticResult, len(q.Results))
+	for i, r := range q.Results {
+		if r.Fields != nil {
+			desc := c.canonicalize(rowDescription(r.Fields, nil)).(*pgproto3.RowDescription)
+			r.Fields = newSemanticFields(desc.Fields)
+		}
+		if r.Error != nil {
+			r.Error = c.canonicalize(r.Error).(*pgproto3.ErrorResponse)
+		}
+		n.Results[i] = r
+	}
+	return &n
+}
+
+// textValue returns the value in text format. The value of the known type is
+// decoded and encoded again, so the same value sent in text by lib/pq or in
+// binary by pgx become the same text
+func textValue(ci *pgtype.ConnInfo, oid uint32, format int16, src []byte) *string {
+	if src == nil {
+		return nil
+	}
+
+	fallback := func() *string {
+		s := string(src)
+		if format != pgtype.TextFormatCode {
+			s = `\x` + hex.EncodeToString(src)
+		}
+		return &s
+	}
+
+	v := decodeValueOf(ci, oid, format, src)
+	if v == nil {
+		return fallback()
+	}
+
+	e, ok := v.(pgtype.TextEncoder)
+	if !ok {
+		return fallback()
+	}
+
+	b, err := e.EncodeText(ci, nil)
+	if err != nil || b == nil {
+		return fallback()
+	}
+
+	s := string(b)
+	return &s
+}
+
+// encodeValue encode the text value into the format requested by client.
+// The value of unknown type is sent as is
+func encodeValue(ci *pgtype.ConnInfo, oid uint32, format int16, text *string) []byte {
+	if text == nil {
+		return nil
+	}
+
+	if format == pgtype.TextFormatCode {
+		return []byte(*text)
+	}
+
+	v := decodeValueOf(ci, oid, pgtype.TextFormatCode, []byte(*text))
+	if v == nil {
+		return []byte(*text)
+	}
+
+	e, ok := v.(pgtype.BinaryEncoder)
+	if !ok {
+		return []byte(*text)
+	}
+
+	b, err := e.EncodeBinary(ci, nil)
+	if err != nil || b == nil {
+		return []byte(*text)
+	}
+
+	return b
+}
@@ -0,0 +1,331 @@
+package pgsnap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+)
+
+// errTerminated is returned by semanticReplay when the client terminate the
+// connection
+var errTerminated = errors.New("client terminated the connection")
+
+type (
+	// semanticReplay synthesises the responses of the semantic snapshot for
+	// the client messages. The queries should be executed in the recorded
+	// order, but the client can use simple or extended protocol, and request
+	// any format of the parameters and the results.
+	//
+	// Execute with MaxRows, COPY and function call are not supported.
+	semanticReplay struct {
+		ci      *pgtype.ConnInfo
+		queries []semanticQuery
+		next    int
+
+		statements map[string]*replayStatement
+		portals    map[string]*replayPortal
+
+		txStatus byte
+
+		// failed is true after error in extended protocol, the messages
+		// are ignored until Sync like postgres does
+		failed bool
+	}
+
+	replayStatement struct {
+		sql  string
+		oids []uint32
+	}
+
+	replayPortal struct {
+		stmt          *replayStatement
+		params        []*string
+		resultFormats []int16
+	}
+)
+
+func newSemanticReplay(queries []semanticQuery) *semanticReplay {
+	return &semanticReplay{
+		ci:         pgtype.NewConnInfo(),
+		queries:    queries,
+		statements: map[string]*replayStatement{},
+		portals:    map[string]*replayPortal{},
+		txStatus:   'I',
+	}
+}
+
+// done returns true when every query is replayed
+func (r *semanticReplay) done() bool {
+	return r.next >= len(r.queries)
+}
+
+// handle returns the responses of the client message. The error is returned
+// when the message is different from the snapshot
+func (r *semanticReplay) handle(msg pgproto3.FrontendMessage) ([]pgproto3.BackendMessage, error) {
+	switch m := msg.(type) {
+	case *pgproto3.Query:
+		return r.simpleQuery(m)
+	case *pgproto3.Sync:
+		r.failed = false
+		return []pgproto3.BackendMessage{&pgproto3.ReadyForQuery{TxStatus: r.txStatus}}, nil
+	case *pgproto3.Flush:
+		return nil, nil
+	case *pgproto3.Terminate:
+		return nil, errTerminated
+	}
+
+	if r.failed {
+		return nil, nil
+	}
+
+	switch m := msg.(type) {
+	case *pgproto3.Parse:
+		return r.parse(m)
+	case *pgproto3.Describe:
+		return r.describe(m)
+	case *pgproto3.Bind:
+		return r.bind(m)
+	case *pgproto3.Execute:
+		return r.execute(m)
+	case *pgproto3.Close:
+		if m.ObjectType == 'S' {
+			delete(r.statements, m.Name)
+		} else {
+			delete(r.portals, m.Name)
+		}
+		return []pgproto3.BackendMessage{&pgproto3.CloseComplete{}}, nil
+	}
+
+	return nil, fmt.Errorf("%T is not supported by semantic snapshot", msg)
+}
+
+func (r *semanticReplay) simpleQuery(m *pgproto3.Query) ([]pgproto3.BackendMessage, error) {
+	q, err := r.take(m.String, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []pgproto3.BackendMessage
+	for _, result := range q.Results {
+		msgs = append(msgs, r.result(result, nil, true)...)
+		if result.Error != nil {
+			break
+		}
+	}
+
+	return append(msgs, &pgproto3.ReadyForQuery{TxStatus: r.txStatus}), nil
+}
+
+func (r *semanticReplay) parse(m *pgproto3.Parse) ([]pgproto3.BackendMessage, error) {
+	q := r.peek(m.Query)
+	if q == nil {
+		return nil, fmt.Errorf("query is not in the snapshot: %s", m.Query)
+	}
+
+	if q.ParseFailed && q == &r.queries[r.next] {
+		if _, err := r.take(m.Query, nil); err != nil {
+			return nil, err
+		}
+		r.failed = true
+		return r.result(q.Results[0], nil, false), nil
+	}
+
+	r.statements[m.Name] = &replayStatement{sql: m.Query, oids: m.ParameterOIDs}
+	return []pgproto3.BackendMessage{&pgproto3.ParseComplete{}}, nil
+}
+
+func (r *semanticReplay) describe(m *pgproto3.Describe) ([]pgproto3.BackendMessage, error) {
+	if m.ObjectType == 'S' {
+		stmt, ok := r.statements[m.Name]
+		if !ok {
+			return nil, fmt.Errorf("prepared statement %q does not exist", m.Name)
+		}
+
+		q := r.peek(stmt.sql)
+		if q == nil {
+			return nil, fmt.Errorf("query is not in the snapshot: %s", stmt.sql)
+		}
+
+		oids := q.ParamOIDs
+		if oids == nil {
+			oids = []uint32{}
+		}
+		return []pgproto3.BackendMessage{
+			&pgproto3.ParameterDescription{ParameterOIDs: oids},
+			fieldsDescription(q, nil),
+		}, nil
+	}
+
+	p, ok := r.portals[m.Name]
+	if !ok {
+		return nil, fmt.Errorf("portal %q does not exist", m.Name)
+	}
+
+	q := r.peek(p.stmt.sql)
+	if q == nil {
+		return nil, fmt.Errorf("query is not in the snapshot: %s", p.stmt.sql)
+	}
+
+	return []pgproto3.BackendMessage{fieldsDescription(q, p.resultFormats)}, nil
+}
+
+func (r *semanticReplay) bind(m *pgproto3.Bind) ([]pgproto3.BackendMessage, error) {
+	stmt, ok := r.statements[m.PreparedStatement]
+	if !ok {
+		return nil, fmt.Errorf("prepared statement %q does not exist", m.PreparedStatement)
+	}
+
+	// the client might not send the parameter types, use the recorded one
+	oids := stmt.oids
+	if q := r.peek(stmt.sql); q != nil {
+		oids = mergeOIDs(stmt.oids, q.ParamOIDs)
+	}
+
+	params := make([]*string, len(m.Parameters))
+	for i, param := range m.Parameters {
+		var oid uint32
+		if i < len(oids) {
+			oid = oids[i]
+		}
+		params[i] = textValue(r.ci, oid, formatCode(m.ParameterFormatCodes, i), param)
+	}
+
+	r.portals[m.DestinationPortal] = &replayPortal{
+		stmt:          stmt,
+		params:        params,
+		resultFormats: m.ResultFormatCodes,
+	}
+	return []pgproto3.BackendMessage{&pgproto3.BindComplete{}}, nil
+}
+
+func (r *semanticReplay) execute(m *pgproto3.Execute) ([]pgproto3.BackendMessage, error) {
+	p, ok := r.portals[m.Portal]
+	if !ok {
+		return nil, fmt.Errorf("portal %q does not exist", m.Portal)
+	}
+
+	q, err := r.take(p.stmt.sql, p.params)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(q.Results) == 0 {
+		return nil, fmt.Errorf("query has no result in the snapshot: %s", q.SQL)
+	}
+
+	result := q.Results[0]
+	if result.Error != nil {
+		r.failed = true
+	}
+
+	return r.result(result, p.resultFormats, false), nil
+}
+
+// result returns the messages of the result. RowDescription is only sent in
+// simple query, in extended protocol it's sent on Describe
+func (r *semanticReplay) result(result semanticResult, formats []int16, withDescription bool) []pgproto3.BackendMessage {
+	if result.Error != nil {
+		return []pgproto3.BackendMessage{result.Error}
+	}
+
+	if result.Empty {
+		return []pgproto3.BackendMessage{&pgproto3.EmptyQueryResponse{}}
+	}
+
+	var msgs []pgproto3.BackendMessage
+	if withDescription && result.Fields != nil {
+		msgs = append(msgs, rowDescription(result.Fields, formats))
+	}
+
+	for _, row := range result.Rows {
+		values := make([][]byte, len(row))
+		for i, v := range row {
+			var oid uint32
+			if i < len(result.Fields) {
+				oid = result.Fields[i].DataTypeOID
+			}
+			values[i] = encodeValue(r.ci, oid, formatCode(formats, i), v)
+		}
+		msgs = append(msgs, &pgproto3.DataRow{Values: values})
+	}
+
+	return append(msgs, &pgproto3.CommandComplete{CommandTag: []byte(result.CommandTag)})
+}
+
+// peek returns the next query in the snapshot with the sql, without
+// replaying it. It's used to describe the statement before executed
+func (r *semanticReplay) peek(sql string) *semanticQuery {
+	for i := r.next; i < len(r.queries); i++ {
+		if sameSQL(r.queries[i].SQL, sql) {
+			return &r.queries[i]
+		}
+	}
+	return nil
+}
+
+// take returns the next query, it should be the same sql and parameters
+func (r *semanticReplay) take(sql string, params []*string) (*semanticQuery, error) {
+	if r.done() {
+		return nil, fmt.Errorf("no more query in the snapshot, got: %s %s", sql, formatParams(params))
+	}
+
+	q := &r.queries[r.next]
+	if !sameSQL(q.SQL, sql) || formatParams(q.Params) != formatParams(params) {
+		return nil, fmt.Errorf(
+			"msg => query: %s %s, want => query: %s %s",
+			sql, formatParams(params),
+			q.SQL, formatParams(q.Params),
+		)
+	}
+
+	r.next++
+	if q.TxStatus != "" {
+		r.txStatus = q.TxStatus[0]
+	}
+
+	return q, nil
+}
+
+func fieldsDescription(q *semanticQuery, formats []int16) pgproto3.BackendMessage {
+	if len(q.Results) == 0 || q.Results[0].Fields == nil {
+		return &pgproto3.NoData{}
+	}
+	return rowDescription(q.Results[0].Fields, formats)
+}
+
+// mergeOIDs returns the client oids, the unspecified (zero) oid is replaced
+// by the recorded one
+func mergeOIDs(client, recorded []uint32) []uint32 {
+	n := len(recorded)
+	if len(client) > n {
+		n = len(client)
+	}
+
+	oids := make([]uint32, n)
+	copy(oids, recorded)
+	for i, oid := range client {
+		if oid != 0 {
+			oids[i] = oid
+		}
+	}
+	return oids
+}
+
+func sameSQL(a, b string) bool {
+	return strings.TrimSpace(a) == strings.TrimSpace(b)
+}
+
+func formatParams(params []*string) string {
+	values := make([]string, len(params))
+	for i, p := range params {
+		if p == nil {
+			values[i] = "NULL"
+		} else {
+			values[i] = fmt.Sprintf("%q", *p)
+		}
+	}
+	return "[" + strings.Join(values, " ") + "]"
+}
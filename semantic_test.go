@@ -0,0 +1,420 @@
+package pgsnap
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// pqFlow is the messages exchanged by lib/pq: text parameters and results
+var pqFlow = []pgproto3.Message{
+	&pgproto3.Query{String: ";"},
+	&pgproto3.EmptyQueryResponse{},
+	&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	&pgproto3.Parse{Query: "select id, name from mytable where id > $1"},
+	&pgproto3.Describe{ObjectType: 'S'},
+	&pgproto3.Sync{},
+	&pgproto3.ParseComplete{},
+	&pgproto3.ParameterDescription{ParameterOIDs: []uint32{23}},
+	&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{
+		{Name: []byte("id"), TableOID: 16386, TableAttributeNumber: 1, DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1},
+		{Name: []byte("name"), TableOID: 16386, TableAttributeNumber: 2, DataTypeOID: 1043, DataTypeSize: -1, TypeModifier: -1},
+	}},
+	&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	&pgproto3.Bind{Parameters: [][]byte{[]byte("1")}},
+	&pgproto3.Execute{},
+	&pgproto3.Sync{},
+	&pgproto3.BindComplete{},
+	&pgproto3.DataRow{Values: [][]byte{[]byte("2"), []byte("Budi")}},
+	&pgproto3.DataRow{Values: [][]byte{[]byte("3"), nil}},
+	&pgproto3.CommandComplete{CommandTag: []byte("SELECT 2")},
+	&pgproto3.ReadyForQuery{TxStatus: 'I'},
+}
+
+func Test_queryLog_semanticQueries(t *testing.T) {
+	l := newQueryLog()
+	for _, msg := range pqFlow {
+		l.observe(msg)
+	}
+
+	fields := []semanticField{
+		{Name: "id", TableOID: 16386, TableAttributeNumber: 1, DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1},
+		{Name: "name", TableOID: 16386, TableAttributeNumber: 2, DataTypeOID: 1043, DataTypeSize: -1, TypeModifier: -1},
+	}
+	assert.Equal(t, []semanticQuery{
+		{
+			SQL:      ";",
+			Results:  []semanticResult{{Empty: true}},
+			TxStatus: "I",
+		},
+		{
+			SQL:       "select id, name from mytable where id > $1",
+			ParamOIDs: []uint32{23},
+			Params:    []*string{strPtr("1")},
+			Results: []semanticResult{{
+				Fields:     fields,
+				Rows:       [][]*string{{strPtr("2"), strPtr("Budi")}, {strPtr("3"), nil}},
+				CommandTag: "SELECT 2",
+			}},
+			TxStatus: "I",
+		},
+	}, l.semanticQueries())
+
+	t.Run("binary values become the same text", func(t *testing.T) {
+		l := newQueryLog()
+		for _, msg := range []pgproto3.Message{
+			&pgproto3.Parse{Name: "lrupsc_1_0", Query: "select id from mytable where id > $1"},
+			&pgproto3.Describe{ObjectType: 'S', Name: "lrupsc_1_0"},
+			&pgproto3.Sync{},
+			&pgproto3.ParseComplete{},
+			&pgproto3.ParameterDescription{ParameterOIDs: []uint32{20}},
+			&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("id"), DataTypeOID: 23}}},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+			&pgproto3.Bind{PreparedStatement: "lrupsc_1_0", ParameterFormatCodes: []int16{1}, Parameters: [][]byte{{0, 0, 0, 0, 0, 0, 0, 1}}, ResultFormatCodes: []int16{1}},
+			&pgproto3.Describe{ObjectType: 'P'},
+			&pgproto3.Execute{},
+			&pgproto3.Sync{},
+			&pgproto3.BindComplete{},
+			&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("id"), DataTypeOID: 23, Format: 1}}},
+			&pgproto3.DataRow{Values: [][]byte{{0, 0, 0, 2}}},
+			&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+			&pgproto3.ReadyForQuery{TxStatus: 'T'},
+		} {
+			l.observe(msg)
+		}
+
+		queries := l.semanticQueries()
+		require.Len(t, queries, 1)
+		assert.Equal(t, []*string{strPtr("1")}, queries[0].Params)
+		assert.Equal(t, [][]*string{{strPtr("2")}}, queries[0].Results[0].Rows)
+		assert.Equal(t, "T", queries[0].TxStatus)
+	})
+
+	t.Run("failed on parse", func(t *testing.T) {
+		l := newQueryLog()
+		for _, msg := range []pgproto3.Message{
+			&pgproto3.Parse{Query: "select * from non_existing_table"},
+			&pgproto3.Describe{ObjectType: 'S'},
+			&pgproto3.Sync{},
+			&pgproto3.ErrorResponse{Code: "42P01", Message: "relation \"non_existing_table\" does not exist"},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		} {
+			l.observe(msg)
+		}
+
+		assert.Equal(t, []semanticQuery{{
+			SQL:         "select * from non_existing_table",
+			ParseFailed: true,
+			Results: []semanticResult{{
+				Error: &pgproto3.ErrorResponse{Code: "42P01", Message: "relation \"non_existing_table\" does not exist"},
+			}},
+			TxStatus: "I",
+		}}, l.semanticQueries())
+	})
+}
+
+func Test_semanticReplay_handle(t *testing.T) {
+	l := newQueryLog()
+	for _, msg := range pqFlow {
+		l.observe(msg)
+	}
+
+	// replay the lib/pq recording with pgx flow: binary parameter and
+	// results, and the portal is described
+	r := newSemanticReplay(l.semanticQueries())
+	for i, tt := range []struct {
+		msg  pgproto3.FrontendMessage
+		want []pgproto3.BackendMessage
+	}{
+		{
+			msg:  &pgproto3.Query{String: ";"},
+			want: []pgproto3.BackendMessage{&pgproto3.EmptyQueryResponse{}, &pgproto3.ReadyForQuery{TxStatus: 'I'}},
+		},
+		{
+			msg:  &pgproto3.Parse{Name: "stmtcache_1", Query: "select id, name from mytable where id > $1"},
+			want: []pgproto3.BackendMessage{&pgproto3.ParseComplete{}},
+		},
+		{
+			msg: &pgproto3.Describe{ObjectType: 'S', Name: "stmtcache_1"},
+			want: []pgproto3.BackendMessage{
+				&pgproto3.ParameterDescription{ParameterOIDs: []uint32{23}},
+				rowDescription(l.semanticQueries()[1].Results[0].Fields, nil),
+			},
+		},
+		{
+			msg:  &pgproto3.Sync{},
+			want: []pgproto3.BackendMessage{&pgproto3.ReadyForQuery{TxStatus: 'I'}},
+		},
+		{
+			msg:  &pgproto3.Bind{PreparedStatement: "stmtcache_1", ParameterFormatCodes: []int16{1}, Parameters: [][]byte{{0, 0, 0, 1}}, ResultFormatCodes: []int16{1, 0}},
+			want: []pgproto3.BackendMessage{&pgproto3.BindComplete{}},
+		},
+		{
+			msg:  &pgproto3.Describe{ObjectType: 'P'},
+			want: []pgproto3.BackendMessage{rowDescription(l.semanticQueries()[1].Results[0].Fields, []int16{1, 0})},
+		},
+		{
+			msg: &pgproto3.Execute{},
+			want: []pgproto3.BackendMessage{
+				&pgproto3.DataRow{Values: [][]byte{{0, 0, 0, 2}, []byte("Budi")}},
+				&pgproto3.DataRow{Values: [][]byte{{0, 0, 0, 3}, nil}},
+				&pgproto3.CommandComplete{CommandTag: []byte("SELECT 2")},
+			},
+		},
+		{
+			msg:  &pgproto3.Sync{},
+			want: []pgproto3.BackendMessage{&pgproto3.ReadyForQuery{TxStatus: 'I'}},
+		},
+	} {
+		got, err := r.handle(tt.msg)
+		require.NoError(t, err, "message %d", i)
+		assert.Equal(t, tt.want, got, "message %d", i)
+	}
+
+	assert.True(t, r.done())
+
+	_, err := r.handle(&pgproto3.Terminate{})
+	assert.Equal(t, errTerminated, err)
+}
+
+func Test_semanticReplay_mismatch(t *testing.T) {
+	l := newQueryLog()
+	for _, msg := range pqFlow {
+		l.observe(msg)
+	}
+
+	r := newSemanticReplay(l.semanticQueries())
+
+	_, err := r.handle(&pgproto3.Query{String: "select 1"})
+	assert.EqualError(t, err, `msg => query: select 1 [], want => query: ; []`)
+
+	_, err = r.handle(&pgproto3.Query{String: ";"})
+	require.NoError(t, err)
+
+	_, err = r.handle(&pgproto3.Parse{Query: "select id, name from mytable where id > $1"})
+	require.NoError(t, err)
+	_, err = r.handle(&pgproto3.Bind{Parameters: [][]byte{[]byte("5")}})
+	require.NoError(t, err)
+	_, err = r.handle(&pgproto3.Execute{})
+	assert.EqualError(t, err, `msg => query: select id, name from mytable where id > $1 ["5"], want => query: select id, name from mytable where id > $1 ["1"]`)
+
+	_, err = r.handle(&pgproto3.CopyData{})
+	assert.EqualError(t, err, "*pgproto3.CopyData is not supported by semantic snapshot")
+}
+
+func Test_semanticQuery_json(t *testing.T) {
+	q := semanticQuery{
+		SQL:     "select $1::text",
+		Params:  []*string{nil},
+		Results: []semanticResult{{CommandTag: "SELECT 1", Rows: [][]*string{{nil}}}},
+	}
+
+	b, err := json.Marshal(q)
+	require.NoError(t, err)
+	assert.Equal(t, `{"SQL":"select $1::text","Params":[null],"Results":[{"Rows":[[null]],"CommandTag":"SELECT 1"}]}`, string(b))
+}
+
+// pgsnap_snap_semantic.txt is written by hand like the snapshot of lib/pq,
+// and it can be replayed by lib/pq and pgx. TestSnap_semantic_record checks
+// the snapshot that recorded by the proxy
+func TestSnap_semantic_pq(t *testing.T) {
+	db, s := NewDB(&namedTB{TB: t, name: "TestSnap_semantic"}, addr)
+	defer s.Finish()
+
+	runSemantic(t, func(sql string, args ...interface{}) [][]interface{} {
+		require.NoError(t, db.Ping())
+		return queryRows(t, db, sql, args...)
+	})
+}
+
+func TestSnap_semantic_pgx(t *testing.T) {
+	s := NewSnap(&namedTB{TB: t, name: "TestSnap_semantic"}, addr)
+	defer s.Finish()
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, s.Addr())
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+
+	runSemantic(t, func(sql string, args ...interface{}) [][]interface{} {
+		require.NoError(t, conn.Ping(ctx))
+
+		rows, err := conn.Query(ctx, sql, args...)
+		require.NoError(t, err)
+		defer rows.Close()
+
+		var result [][]interface{}
+		for rows.Next() {
+			var id int
+			var name *string
+			require.NoError(t, rows.Scan(&id, &name))
+			result = append(result, []interface{}{id, name})
+		}
+		require.NoError(t, rows.Err())
+		return result
+	})
+}
+
+func runSemantic(t *testing.T, query func(sql string, args ...interface{}) [][]interface{}) {
+	t.Helper()
+
+	rows := query("select id, name from mytable where id > $1", 1)
+	assert.Equal(t, [][]interface{}{{2, strPtr("Budi")}, {3, (*string)(nil)}}, rows)
+}
+
+func queryRows(t *testing.T, db *sql.DB, query string, args ...interface{}) [][]interface{} {
+	t.Helper()
+
+	rows, err := db.Query(query, args...)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var result [][]interface{}
+	for rows.Next() {
+		var id int
+		var name *string
+		require.NoError(t, rows.Scan(&id, &name))
+		result = append(result, []interface{}{id, name})
+	}
+	require.NoError(t, rows.Err())
+	return result
+}
+
+// the semantic snapshot recorded by the proxy is replayed by lib/pq and pgx.
+// The fake server is used as the database, the proxy ping it before the
+// client send the query
+func TestSnap_semantic_record(t *testing.T) {
+	tb := &namedTB{TB: t, name: "TestSnap_semantic_record"}
+
+	upstream := NewSnapWithConfig(&namedTB{TB: t, name: "TestSnap_runScript_pq"}, addr, Config{})
+	rec := NewSnapWithConfig(tb, upstream.Addr(), Config{ForceWrite: true, Level: LevelSemantic})
+	t.Cleanup(func() { _ = os.Remove(rec.script.getFilename()) })
+
+	db, err := sql.Open("postgres", rec.Addr())
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, queryIDs(t, db))
+	require.NoError(t, db.Close())
+
+	require.NoError(t, rec.Finish())
+	require.NoError(t, upstream.Finish())
+
+	recorded, err := os.ReadFile(rec.script.getFilename())
+	require.NoError(t, err)
+	assert.Contains(t, string(recorded), `Q {"SQL":"select id from mytable limit $1"`)
+
+	t.Run("pq", func(t *testing.T) {
+		db, s := NewDBWithConfig(tb, unreachableAddr, Config{})
+		assert.Equal(t, []int{1, 2, 3}, queryIDs(t, db))
+		require.NoError(t, db.Close())
+		assert.NoError(t, s.Finish())
+	})
+
+	t.Run("pgx", func(t *testing.T) {
+		s := NewSnapWithConfig(tb, unreachableAddr, Config{})
+		ctx := context.Background()
+
+		conn, err := pgx.Connect(ctx, s.Addr())
+		require.NoError(t, err)
+
+		rows, err := conn.Query(ctx, "select id from mytable limit $1", 7)
+		require.NoError(t, err)
+		var ids []int
+		for rows.Next() {
+			var id int
+			require.NoError(t, rows.Scan(&id))
+			ids = append(ids, id)
+		}
+		require.NoError(t, rows.Err())
+		assert.Equal(t, []int{1, 2, 3}, ids)
+
+		require.NoError(t, conn.Close(ctx))
+		assert.NoError(t, s.Finish())
+	})
+}
+
+// the query after the snapshot is answered with error, and reported
+func TestSnap_semantic_notInSnapshot(t *testing.T) {
+	t.Run("pq", func(t *testing.T) {
+		tb := newFakeTB(&namedTB{TB: t, name: "TestSnap_semantic"})
+		db, s := NewDBWithConfig(tb, addr, Config{})
+
+		require.NoError(t, db.Ping())
+		runSemantic(t, func(sql string, args ...interface{}) [][]interface{} {
+			return queryRows(t, db, sql, args...)
+		})
+
+		_, err := db.Exec("select 42")
+		assert.ErrorContains(t, err, "*pgproto3.Query is not in the snapshot")
+		require.NoError(t, db.Close())
+
+		err = s.Finish()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "*pgproto3.Query is not in the snapshot, every query is already replayed")
+	})
+
+	t.Run("pgx", func(t *testing.T) {
+		tb := newFakeTB(&namedTB{TB: t, name: "TestSnap_semantic"})
+		s := NewSnapWithConfig(tb, addr, Config{})
+		ctx := context.Background()
+
+		conn, err := pgx.Connect(ctx, s.Addr())
+		require.NoError(t, err)
+
+		require.NoError(t, conn.Ping(ctx))
+		runSemantic(t, func(sql string, args ...interface{}) [][]interface{} {
+			rows, err := conn.Query(ctx, sql, args...)
+			require.NoError(t, err)
+			defer rows.Close()
+
+			var result [][]interface{}
+			for rows.Next() {
+				var id int
+				var name *string
+				require.NoError(t, rows.Scan(&id, &name))
+				result = append(result, []interface{}{id, name})
+			}
+			require.NoError(t, rows.Err())
+			return result
+		})
+
+		_, err = conn.Exec(ctx, "select 42")
+		assert.ErrorContains(t, err, "*pgproto3.Query is not in the snapshot")
+
+		// the connection is still usable
+		_, err = conn.Exec(ctx, "select 43")
+		assert.ErrorContains(t, err, "is not in the snapshot")
+		require.NoError(t, conn.Close(ctx))
+
+		err = s.Finish()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "*pgproto3.Query is not in the snapshot, every query is already replayed")
+	})
+}
+
+func queryIDs(t *testing.T, db *sql.DB) []int {
+	t.Helper()
+
+	rows, err := db.Query("select id from mytable limit $1", 7)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		require.NoError(t, rows.Scan(&id))
+		ids = append(ids, id)
+	}
+	require.NoError(t, rows.Err())
+	return ids
+}
@@ -1,23 +1,37 @@
 package pgsnap
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
+	"sync"
 	"testing"
 	"time"
 )
 
 type Snap struct {
-	t       testing.TB
-	addr    string
-	msgchan chan string
-	done    chan struct{}
-	l       net.Listener
-	isDebug bool
+	t        testing.TB
+	cfg      Config
+	url      string
+	script   *script
+	reporter *collector
+	queries  *queryLog
+	addr     string
+	msgchan  chan string
+	done     chan struct{}
+	l        net.Listener
+	isDebug  bool
+
+	// ctx is cancelled on Finish, the proxy and the fake server close the
+	// connections, and the goroutines in wg exit
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 
 	proxy  *proxy  // will be fill if using proxy
 	server *server // will be fill if using fake server
@@ -29,11 +43,83 @@ type Config struct {
 	// TestTimeout Default 5s
 	TestTimeout time.Duration
 
+	// StepTimeout is how long the replay waits for each client message.
+	// When it's exceeded, the step and the snapshot line are reported and
+	// the connection is closed. Zero means only TestTimeout is used
+	StepTimeout time.Duration
+
 	// Force to create proxy and connect to real postgres server
 	ForceWrite bool
 
 	// Debug if true it will print more verbose
 	Debug bool
+
+	// Reporter is where the errors and logs are reported.
+	// Default is the testing.TB passed into NewSnap
+	Reporter Reporter
+
+	// NPlusOneThreshold enable N+1 query detection. When the same SELECT
+	// shape is executed at least this many times, it will be reported on
+	// Finish. Zero means disabled
+	NPlusOneThreshold int
+
+	// NPlusOneWarnOnly report the N+1 query as log instead of error
+	NPlusOneWarnOnly bool
+
+	// CapturePlans will run EXPLAIN (VERBOSE, FORMAT JSON) for each
+	// distinct query in the recording session, right after the query is
+	// answered, and save it next to the snapshot. The changed plans and
+	// sequential scans are reported as error
+	CapturePlans bool
+
+	// PlanWarnOnly will only log the changed plans and sequential scans
+	// instead of failing the test
+	PlanWarnOnly bool
+
+	// SeqScanThreshold is the minimum estimated rows of the sequentially
+	// scanned relation that reported by CapturePlans. Default 1000
+	SeqScanThreshold float64
+
+	// Sandbox wraps the whole recording session in a transaction that is
+	// rolled back on Finish, so recording leave the database untouched.
+	// Client BEGIN/COMMIT/ROLLBACK are translated into savepoints
+	Sandbox bool
+
+	// Metadata is saved into the snapshot when recording, and compared
+	// when replaying, like the fingerprint of the schema. When it's
+	// different the snapshot is stale, and handled according to OnStale
+	Metadata map[string]string
+
+	// OnStale is what to do when the snapshot is stale. Default StaleWarn
+	OnStale StalePolicy
+
+	// Fixtures is the .sql, .yaml or .json files that loaded before
+	// recording, in the upstream connection, so it's not recorded in the
+	// snapshot. The hash of the fixtures is saved into the Metadata. The
+	// recording with fixtures is always in the Sandbox, so they are rolled
+	// back on Finish
+	Fixtures []string
+
+	// Level is what saved into the snapshot when recording. Default
+	// LevelWire. The snapshot is replayed according to its content
+	Level SnapshotLevel
+
+	// BlobThreshold is the minimum size in bytes of the value that saved
+	// into a side file (pgsnap_name.blobs/<sha256>) instead of the snapshot
+	// when recording. Zero means every value is saved in the snapshot
+	BlobThreshold int
+
+	// Hybrid replays the snapshot, and on the first client message that is
+	// not in the snapshot, it connects to the postgres url and continue by
+	// recording. The snapshot is rewritten with the replayed part followed
+	// by the new one. Only LevelWire snapshot is supported
+	Hybrid bool
+
+	// Auth is the user and password required from the client, with
+	// SCRAM-SHA-256, MD5 or cleartext. The client with wrong password gets
+	// FATAL 28P01 error, and the next connection is accepted. Addr contains
+	// the user and the password. Default is trust, every client is accepted
+	Auth Auth
 }
 
 // NewDB will create *sql.DB to be used in the test
@@ -60,11 +146,19 @@ func NewDBWithConfig(t testing.TB, url string, cfg Config) (*sql.DB, *Snap) {
 // NewSnap will create snap
 func NewSnap(t testing.TB, postgreURL string) *Snap {
 	t.Helper()
-	return NewSnapWithConfig(t, postgreURL, Config{
+	return NewSnapWithConfig(t, postgreURL, ConfigFromEnv())
+}
+
+// ConfigFromEnv returns the default Config, with ForceWrite, Debug and Hybrid
+// read from environment variable PGSNAP_FORCE_WRITE, PGSNAP_DEBUG and
+// PGSNAP_HYBRID
+func ConfigFromEnv() Config {
+	return Config{
 		ForceWrite:  os.Getenv("PGSNAP_FORCE_WRITE") == "true",
 		Debug:       os.Getenv("PGSNAP_DEBUG") == "true",
+		Hybrid:      os.Getenv("PGSNAP_HYBRID") == "true",
 		TestTimeout: 5 * time.Second,
-	})
+	}
 }
 
 // Deprecated
@@ -82,18 +176,36 @@ func NewSnapWithConfig(t testing.TB, url string, cfg Config) *Snap {
 	t.Helper()
 	cfg = setDefaultValue(cfg)
 
-	s := &Snap{
-		t:       t,
-		msgchan: make(chan string, 100),
-		done:    make(chan struct{}, 1),
-		isDebug: cfg.Debug,
+	if cfg.Reporter == nil {
+		cfg.Reporter = TBReporter(t)
 	}
 
-	s.setFailAfter(cfg.TestTimeout)
+	fixtures, err := FixturesMetadata(cfg.Fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Metadata = mergeMetadata(cfg.Metadata, fixtures)
+
+	s := &Snap{
+		t:        t,
+		cfg:      cfg,
+		url:      url,
+		reporter: newCollector(cfg.Reporter, t.Name()),
+		queries:  newQueryLog(),
+		msgchan:  make(chan string, 100),
+		done:     make(chan struct{}, 1),
+		isDebug:  cfg.Debug,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 
 	s.listen()
 
+	// started after the proxy or the fake server is created, so the timeout
+	// can report what it is doing
+	defer s.setFailAfter(cfg.TestTimeout)
+
 	script := newScript(t)
+	s.script = script
 
 	if cfg.ForceWrite {
 		s.runProxy(t, url, script, cfg)
@@ -110,7 +222,31 @@ func NewSnapWithConfig(t testing.TB, url string, cfg Config) *Snap {
 		s.t.Fatalf("can't open file \"%s\": %v", script.getFilename(), err)
 	}
 
-	s.server = newServer(s.l, s.done, s.t, s.isDebug)
+	if s.checkStale(script) {
+		s.runProxy(t, url, script, cfg)
+		return s
+	}
+
+	s.server = newServer(s.ctx, s.l, s.done, s.reporter, s.queries, s.isDebug)
+	s.server.stepTimeout = cfg.StepTimeout
+	s.server.auth = cfg.Auth
+	s.server.recordedAuth = script.auth
+	if len(script.semantic) > 0 {
+		s.server.RunSemantic(script.semantic)
+		return s
+	}
+
+	if cfg.Hybrid {
+		s.server.hybrid = &hybrid{
+			ctx:      s.ctx,
+			r:        s.reporter,
+			queries:  s.queries,
+			url:      url,
+			script:   script,
+			cfg:      cfg,
+			activity: s.server.activity,
+		}
+	}
 	s.server.Run(pgxScript)
 
 	return s
@@ -118,43 +254,103 @@ func NewSnapWithConfig(t testing.TB, url string, cfg Config) *Snap {
 
 func (s *Snap) runProxy(t testing.TB, url string, script *script, cfg Config) {
 	t.Helper()
-	s.proxy = newProxy(t, url, script, s.l, cfg.Debug)
-	s.proxy.run()
+	s.proxy = newProxy(s.ctx, s.reporter, s.queries, url, script, s.l, cfg)
+	if cfg.CapturePlans {
+		report := s.reporter.Errorf
+		if cfg.PlanWarnOnly {
+			report = s.reporter.Logf
+		}
+		s.queries.keepExecuted = true
+		s.proxy.plans = newPlanCapture(report)
+	}
+	if err := s.proxy.run(); err != nil {
+		t.Fatal(err)
+	}
 }
 
-// setFaileAfter will call (*testing.T).Fatalf after timeout
+// setFailAfter will report an error after timeout, stop accepting new
+// connection and close the connections, so the client that blocked in the
+// proxy or the fake server get error instead of hanging. The error itself
+// will be surfaced on Finish
 func (s *Snap) setFailAfter(timeout time.Duration) {
 	start := time.Now()
+	timer := time.NewTimer(timeout)
+
+	s.wg.Add(1)
 	go func() {
+		defer s.wg.Done()
+		defer timer.Stop()
+
 		select {
-		case <-time.After(timeout):
+		case <-timer.C:
 			log.Printf("pgsnap timeout after %v, start at %v, end at %v", timeout, start, time.Now())
-			s.t.Errorf("pgsnap timeout after %v", timeout)
-			s.t.FailNow()
+			s.reporter.Errorf("pgsnap timeout after %v: %s", timeout, s.activity())
+			_ = s.l.Close()
+			s.cancel()
+			s.closeConns()
 		case <-s.done:
+		case <-s.ctx.Done():
 		}
 	}()
 }
 
-func (s *Snap) Finish() {
+func (s *Snap) closeConns() {
+	if s.proxy != nil {
+		s.proxy.closeConns()
+	}
+	if s.server != nil {
+		s.server.closeConns()
+	}
+}
+
+// activity returns what the proxy or the fake server is doing
+func (s *Snap) activity() string {
+	if s.proxy != nil {
+		return s.proxy.activity.String()
+	}
+	if s.server != nil {
+		return s.server.activity.String()
+	}
+	return "not started"
+}
+
+// Finish closes the client and the database connections, and waits until
+// every goroutine of the proxy or the fake server exits. The errors are
+// reported into the Reporter, and returned as MultiError
+func (s *Snap) Finish() error {
 	// ignore the error
 	_ = s.l.Close()
+	s.cancel()
 
 	if s.proxy != nil {
 		s.proxy.finish()
-		s.done <- struct{}{}
 	}
 
 	if s.server != nil {
-		s.server.Wait()
+		s.server.finish()
 	}
 
+	s.wg.Wait()
+
+	s.capturePlans()
+	s.detectNPlusOne()
+
 	for _, f := range s.finishFuncs {
 		err := f()
 		if err != nil {
-			s.t.Error(err)
+			s.reporter.Errorf("%v", err)
 		}
 	}
+
+	if errs := s.reporter.flush(); len(errs) > 0 {
+		return MultiError(errs)
+	}
+	return nil
+}
+
+// Errors returns errors that reported by proxy or fake server so far
+func (s *Snap) Errors() []error {
+	return s.reporter.Errors()
 }
 
 // AddFinishFunc will add function that will be called when
@@ -178,6 +374,16 @@ func (s *Snap) listen() net.Listener {
 	}
 
 	s.addr = fmt.Sprintf("postgres://user@%s/?sslmode=disable", s.l.Addr())
+	if s.cfg.Auth.Method != AuthTrust {
+		u := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(s.cfg.Auth.User, s.cfg.Auth.Password),
+			Host:     s.l.Addr().String(),
+			Path:     "/",
+			RawQuery: "sslmode=disable",
+		}
+		s.addr = u.String()
+	}
 
 	return s.l
 }
@@ -199,5 +405,9 @@ func setDefaultValue(cfg Config) Config {
 		cfg.TestTimeout = 5 * time.Second
 	}
 
+	if cfg.SeqScanThreshold == 0 {
+		cfg.SeqScanThreshold = 1000
+	}
+
 	return cfg
 }
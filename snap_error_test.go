@@ -3,13 +3,16 @@ package pgsnap
 import (
 	"context"
 	"fmt"
-	"sync/atomic"
+	"net"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
 	"github.com/jackc/pgx/v4"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // wrong query, should not cause a panic.
@@ -25,16 +28,14 @@ func Test_error_case(t *testing.T) {
 	t.Run("non_existent_table", func(t *testing.T) {
 		_, err := conn.Query(ctx, "SELECT * FROM non_existing_table WHERE id = $1", 1)
 
-		assert.Equal(t, err, &pgconn.PgError{
-			Severity:         "ERROR",
-			Code:             "42P01",
-			Message:          "relation \"non_existing_table\" does not exist",
-			Position:         15,
-			InternalPosition: 0,
-			File:             "parse_relation.c",
-			Line:             1376,
-			Routine:          "parserOpenTable",
-		})
+		// the server source location (File, Line and Routine) is not
+		// kept in snapshot, so it's only exists when recording
+		var pgErr *pgconn.PgError
+		require.ErrorAs(t, err, &pgErr)
+		assert.Equal(t, "ERROR", pgErr.Severity)
+		assert.Equal(t, "42P01", pgErr.Code)
+		assert.Equal(t, "relation \"non_existing_table\" does not exist", pgErr.Message)
+		assert.Equal(t, int32(15), pgErr.Position)
 	})
 
 	t.Run("empty_rows", func(t *testing.T) {
@@ -50,24 +51,22 @@ func Test_if_not_accept_should_throw_timeout(t *testing.T) {
 	s := NewSnapWithConfig(tb, addr, Config{
 		TestTimeout: 10 * time.Millisecond,
 	})
-	defer s.Finish()
 
 	time.Sleep(100 * time.Millisecond)
 
-	assert.True(t, tb.FailNowCalled.Load())
+	s.Finish()
+
+	assert.Contains(t, tb.ErrorMessages, "pgsnap timeout after 10ms: no connection is accepted")
+	assert.Len(t, s.Errors(), 2)
 }
 
 type fakeTB struct {
 	testing.TB
 	ErrorMessages []string
-	FailNowCalled *atomic.Bool
 }
 
 func newFakeTB(t testing.TB) *fakeTB {
-	return &fakeTB{
-		TB:            t,
-		FailNowCalled: &atomic.Bool{},
-	}
+	return &fakeTB{TB: t}
 }
 
 func (f *fakeTB) Error(args ...interface{}) {
@@ -78,6 +77,178 @@ func (f *fakeTB) Errorf(format string, args ...interface{}) {
 	f.ErrorMessages = append(f.ErrorMessages, fmt.Sprintf(format, args...))
 }
 
-func (f *fakeTB) FailNow() {
-	f.FailNowCalled.Store(true)
+// after the mismatch, the client get error for the batch, and the replay
+// continue with the next batch
+func TestSnap_resync(t *testing.T) {
+	tb := newFakeTB(t)
+	db, s := NewDBWithConfig(tb, addr, Config{})
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	require.NoError(t, err)
+
+	_, err = conn.ExecContext(ctx, "update a set x = 1")
+	assert.NoError(t, err)
+
+	_, err = conn.ExecContext(ctx, "update x set x = 1")
+	assert.ErrorContains(t, err, "pgsnap:")
+
+	res, err := conn.ExecContext(ctx, "update c set x = 1")
+	require.NoError(t, err)
+	n, _ := res.RowsAffected()
+	assert.Equal(t, int64(3), n)
+
+	_, err = conn.ExecContext(ctx, "update d set x = 1")
+	assert.ErrorContains(t, err, "*pgproto3.Query is not in the snapshot")
+
+	_ = conn.Close()
+	_ = db.Close()
+	s.Finish()
+
+	require.Len(t, tb.ErrorMessages, 2)
+	assert.Contains(t, tb.ErrorMessages[0], `String:"update x set x = 1"`)
+	assert.Contains(t, tb.ErrorMessages[1], "*pgproto3.Query is not in the snapshot")
+}
+
+// the mismatch inside transaction aborts it, like the error from postgres
+func TestSnap_resync_transaction(t *testing.T) {
+	tb := newFakeTB(&namedTB{TB: t, name: "TestSnap_queries"})
+	s := NewSnapWithConfig(tb, addr, Config{})
+	ctx := context.Background()
+
+	conn, err := pgconn.Connect(ctx, s.Addr())
+	require.NoError(t, err)
+
+	_, err = conn.Exec(ctx, ";").ReadAll()
+	require.NoError(t, err)
+	_, err = conn.Exec(ctx, "BEGIN READ WRITE").ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, byte('T'), conn.TxStatus())
+
+	_, err = conn.Exec(ctx, "select 42").ReadAll()
+	assert.ErrorContains(t, err, "pgsnap:")
+	assert.Equal(t, byte('E'), conn.TxStatus())
+
+	_ = conn.Close(ctx)
+	s.Finish()
+
+	require.NotEmpty(t, tb.ErrorMessages)
+	assert.Contains(t, tb.ErrorMessages[0], "msg => *pgproto3.Query, want => *pgproto3.Parse")
+}
+
+func TestSnap_timeout_activity(t *testing.T) {
+	tb := newFakeTB(&namedTB{TB: t, name: "TestSnap_resync"})
+	db, s := NewDBWithConfig(tb, addr, Config{TestTimeout: 50 * time.Millisecond})
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	require.NoError(t, err)
+	_, err = conn.ExecContext(ctx, "update a set x = 1")
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	_ = conn.Close()
+	_ = db.Close()
+	s.Finish()
+
+	require.NotEmpty(t, tb.ErrorMessages)
+	assert.Equal(t,
+		"pgsnap timeout after 50ms: "+
+			"server: replaying step 6 of 11 (line 4), waiting for *pgproto3.Query from the client; "+
+			`last client message: *pgproto3.Query {"Type":"Query","String":"update a set x = 1"}`,
+		tb.ErrorMessages[0],
+	)
+}
+
+func TestSnap_stepTimeout(t *testing.T) {
+	tb := newFakeTB(&namedTB{TB: t, name: "TestSnap_resync"})
+	db, s := NewDBWithConfig(tb, addr, Config{StepTimeout: 20 * time.Millisecond})
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	require.NoError(t, err)
+	_, err = conn.ExecContext(ctx, "update a set x = 1")
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	_ = conn.Close()
+	_ = db.Close()
+	s.Finish()
+
+	assert.Equal(t, []string{
+		"server: run script got error: no message from the client after 20ms, " +
+			"replaying step 6 of 11 (line 4), waiting for *pgproto3.Query from the client",
+	}, tb.ErrorMessages)
+}
+
+// the client that waits for the response is not blocked until the go test
+// timeout, the connection is closed on the test timeout
+func TestSnap_timeout_hangingClient(t *testing.T) {
+	tb := newFakeTB(t)
+	s := NewSnapWithConfig(tb, silentUpstream(t), Config{ForceWrite: true, TestTimeout: 100 * time.Millisecond})
+	t.Cleanup(func() { _ = os.Remove(s.script.getFilename()) })
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, s.Addr())
+	require.NoError(t, err)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Exec(ctx, "select 1")
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		assert.Error(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the client is still blocked after the test timeout")
+	}
+
+	assert.Error(t, s.Finish())
+	assert.Contains(t, tb.ErrorMessages[0], "pgsnap timeout after 100ms")
+}
+
+// silentUpstream returns the address of the database that accept the
+// connection and the ping, then never answer
+func silentUpstream(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+		if _, err := be.ReceiveStartupMessage(); err != nil {
+			return
+		}
+
+		for _, msg := range []pgproto3.BackendMessage{
+			&pgproto3.AuthenticationOk{},
+			&pgproto3.BackendKeyData{},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		} {
+			_ = be.Send(msg)
+		}
+
+		// the ping
+		if _, err := be.Receive(); err != nil {
+			return
+		}
+		_ = be.Send(&pgproto3.EmptyQueryResponse{})
+		_ = be.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+
+		for {
+			if _, err := be.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+
+	return fmt.Sprintf("postgres://user@%s/?sslmode=disable", l.Addr())
 }